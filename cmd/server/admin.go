@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/rubinda/logtopus/pkg/access"
+	"github.com/rubinda/logtopus/pkg/userstore"
+)
+
+// createAdmin adds a user with every scope and the password read from the first line of input, so it doesn't end up in the
+// shell history (e.g. "echo $PASSWORD | logtopus create-admin alice"). The server has to be stopped, since it keeps users
+// in memory and would overwrite the file without the new admin.
+func createAdmin(users *userstore.Store, username string, input io.Reader) {
+	fmt.Fprintf(os.Stderr, "Password for %s: ", username)
+	password, err := bufio.NewReader(input).ReadString('\n')
+	if err != nil && err != io.EOF {
+		log.Fatal("can't read password: ", err)
+	}
+	password = strings.TrimRight(password, "\r\n")
+	_, problems, err := users.Create(username, password, access.AllScopes)
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			log.Printf("%s: %s\n", problem.Field, problem.Message)
+		}
+		log.Fatal("can't create admin")
+	}
+	if err != nil {
+		log.Fatal("can't save user store: ", err)
+	}
+	log.Printf("Admin %s created\n", username)
+}
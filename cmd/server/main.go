@@ -3,21 +3,53 @@ package main
 import (
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+	// Zone names in TIMESTAMP_DEFAULT_ZONE resolve without tzdata installed (e.g. in the alpine image)
+	_ "time/tzdata"
 
 	"github.com/joho/godotenv"
+	"github.com/rubinda/logtopus/pkg/apikeys"
+	"github.com/rubinda/logtopus/pkg/asyncstore"
+	"github.com/rubinda/logtopus/pkg/filestore"
 	"github.com/rubinda/logtopus/pkg/http"
 	"github.com/rubinda/logtopus/pkg/influxdb"
+	"github.com/rubinda/logtopus/pkg/memstore"
+	"github.com/rubinda/logtopus/pkg/schemaregistry"
+	"github.com/rubinda/logtopus/pkg/sessions"
+	"github.com/rubinda/logtopus/pkg/userstore"
 )
 
 const (
 	// apiServerURL defines the port the HTTP server listens on
 	apiServerURL string = "0.0.0.0:5000"
+	// defaultDedupWindow is how long event IDs are remembered when DEDUP_WINDOW is not set.
+	defaultDedupWindow time.Duration = 10 * time.Minute
+	// defaultUserStoreFile is where users are persisted when USER_STORE_FILE is not set.
+	defaultUserStoreFile string = "data/users.json"
+	// defaultAPIKeyStoreFile is where API keys are persisted when API_KEY_STORE_FILE is not set.
+	defaultAPIKeyStoreFile string = "data/apikeys.json"
+	// defaultSessionStoreFile is where sessions are persisted when SESSION_STORE_FILE is not set.
+	defaultSessionStoreFile string = "data/sessions.json"
+	// defaultAccessTokenTTL is how long tokens are valid when ACCESS_TOKEN_TTL is not set.
+	defaultAccessTokenTTL time.Duration = 5 * time.Minute
+	// defaultRefreshTokenTTL is how long refresh tokens are valid when REFRESH_TOKEN_TTL is not set.
+	defaultRefreshTokenTTL time.Duration = 7 * 24 * time.Hour
+	// defaultJWTKeyReloadInterval is how often JWT keys are read again when JWT_KEY_RELOAD_INTERVAL is not set.
+	defaultJWTKeyReloadInterval time.Duration = time.Minute
 )
 
 func main() {
-	// Optionally, an .env file can be given as the first parameter
-	if len(os.Args) == 2 {
-		envFilePath := os.Args[1]
+	args := os.Args[1:]
+	// "create-admin USERNAME" bootstraps an admin user instead of starting the server
+	adminUsername := ""
+	if len(args) >= 2 && args[0] == "create-admin" {
+		adminUsername, args = args[1], args[2:]
+	}
+	// Optionally, an .env file can be given as the (last) parameter
+	if len(args) == 1 {
+		envFilePath := args[0]
 		err := godotenv.Load(envFilePath)
 		if err != nil {
 			log.Fatal("Error loading .env file")
@@ -30,31 +62,220 @@ func main() {
 	//    would be wiser to use custom acces management
 	influxToken := os.Getenv("DOCKER_INFLUXDB_INIT_ADMIN_TOKEN")
 	influxBucket := os.Getenv("DOCKER_INFLUXDB_INIT_BUCKET")
+	// Path to a single file event store, used for small deployments without InfluxDB
+	eventStoreFile := os.Getenv("EVENT_STORE_FILE")
+	// Registered JSON Schemas for event details are persisted to this file, otherwise kept in memory
+	schemaRegistryFile := os.Getenv("SCHEMA_REGISTRY_FILE")
+	// Opt-in asynchronous writes, events are buffered and written in batches
+	asyncWrites := os.Getenv("ASYNC_WRITES") == "true"
+	// Opt-in storage of nested details as separate (queryable) fields
+	flattenDetails := os.Getenv("DETAILS_FLATTEN") == "true"
+	// Comma separated keys stored as InfluxDB tags (e.g. "entityId,details.region")
+	tagKeys := os.Getenv("TAG_KEYS")
 	jwtPrivateKeyPath := os.Getenv("JWT_PRIVATE_KEY")
 	jwtPublicKeyPath := os.Getenv("JWT_PUBLIC_KEY")
+	// Directory with multiple JWT keys for key rotation, replaces JWT_PRIVATE_KEY and JWT_PUBLIC_KEY
+	jwtKeyDir := os.Getenv("JWT_KEY_DIR")
 	// TODO:
 	//  - uses a self signed certificate, which causes warnings from clients (hence --insecure OR -k is needed for cURL)
 	//	  for actual deployments something like Let's encrypt could be used (https://letsencrypt.org/)
 	caCertFile := os.Getenv("SERVER_CERT_FILE")
 	caKeyFile := os.Getenv("SERVER_KEY_FILE")
+	// Users which can request tokens are persisted to this file
+	userStoreFile := os.Getenv("USER_STORE_FILE")
+	if userStoreFile == "" {
+		userStoreFile = defaultUserStoreFile
+	}
 
-	// Ensure a database client
-	influxConf := influxdb.Configuration{
-		ServerURL:    influxURL,
-		Token:        influxToken,
-		InfluxOrg:    influxOrg,
-		InfluxBucket: influxBucket,
+	users, err := userstore.Open(userStoreFile)
+	if err != nil {
+		log.Fatal("can't open user store file: ", err)
+	}
+	if adminUsername != "" {
+		createAdmin(users, adminUsername, os.Stdin)
+		return
+	}
+	// API keys of event sources are persisted to this file
+	apiKeyStoreFile := os.Getenv("API_KEY_STORE_FILE")
+	if apiKeyStoreFile == "" {
+		apiKeyStoreFile = defaultAPIKeyStoreFile
+	}
+	apiKeys, err := apikeys.Open(apiKeyStoreFile)
+	if err != nil {
+		log.Fatal("can't open API key store file: ", err)
+	}
+	// Refresh tokens and revoked tokens are persisted to this file
+	sessionStoreFile := os.Getenv("SESSION_STORE_FILE")
+	if sessionStoreFile == "" {
+		sessionStoreFile = defaultSessionStoreFile
+	}
+	accessTokenTTL, refreshTokenTTL := tokenLifetimes()
+	sessionStore, err := sessions.Open(sessionStoreFile, accessTokenTTL, refreshTokenTTL)
+	if err != nil {
+		log.Fatal("can't open session store file: ", err)
+	}
+	if len(users.List()) == 0 {
+		log.Printf("[WARNING] No users in %s, create an admin with the create-admin command\n", userStoreFile)
+	}
+
+	// Ensure a database client, events are kept in a file or in memory when no InfluxDB host is configured
+	var db http.EventStore
+	if influxURL == "" && eventStoreFile != "" {
+		fileStore, err := filestore.Open(eventStoreFile)
+		if err != nil {
+			log.Fatal("can't open event store file: ", err)
+		}
+		db = fileStore
+	} else if influxURL == "" {
+		log.Println("[WARNING] INFLUXDB_HOST not set, using in-memory event store (data is lost on shutdown)")
+		db = memstore.New()
+	} else {
+		influxConf := influxdb.Configuration{
+			ServerURL:      influxURL,
+			Token:          influxToken,
+			InfluxOrg:      influxOrg,
+			InfluxBucket:   influxBucket,
+			FlattenDetails: flattenDetails,
+		}
+		if tagKeys != "" {
+			for _, key := range strings.Split(tagKeys, ",") {
+				influxConf.TagKeys = append(influxConf.TagKeys, strings.TrimSpace(key))
+			}
+		}
+		if v := os.Getenv("TAG_MAX_CARDINALITY"); v != "" {
+			var err error
+			if influxConf.MaxTagCardinality, err = strconv.Atoi(v); err != nil {
+				log.Fatal("invalid TAG_MAX_CARDINALITY: ", err)
+			}
+		}
+		influxClient, err := influxdb.NewClient(influxConf)
+		if err != nil {
+			log.Fatal("can't connect to InfluxDB: ", err)
+		}
+		db = influxClient
+	}
+	if asyncWrites {
+		db = asyncstore.New(db, asyncWriteConfiguration())
+	}
+
+	schemas := schemaregistry.New()
+	if schemaRegistryFile != "" {
+		var err error
+		if schemas, err = schemaregistry.Open(schemaRegistryFile); err != nil {
+			log.Fatal("can't open schema registry file: ", err)
+		}
 	}
-	influxClient := influxdb.NewClient(influxConf)
 
 	// Run the http(s) api server
 	httpServerConf := http.Configuration{
-		DB:            influxClient,
-		Address:       apiServerURL,
-		CAKeyPath:     caKeyFile,
-		CACertPath:    caCertFile,
-		JWTKeyPath:    jwtPrivateKeyPath,
-		JWTPubKeyPath: jwtPublicKeyPath,
+		DB:                   db,
+		Users:                users,
+		APIKeys:              apiKeys,
+		Sessions:             sessionStore,
+		AccessTokenTTL:       accessTokenTTL,
+		Schemas:              schemas,
+		Address:              apiServerURL,
+		CAKeyPath:            caKeyFile,
+		CACertPath:           caCertFile,
+		JWTKeyPath:           jwtPrivateKeyPath,
+		JWTPubKeyPath:        jwtPublicKeyPath,
+		JWTKeyDir:            jwtKeyDir,
+		JWTKeyReloadInterval: jwtKeyReloadInterval(),
+		FlattenDetails:       flattenDetails,
+		Timestamps:           timestampPolicy(),
+		DedupWindow:          dedupWindow(),
 	}
 	http.ListenAndServe(httpServerConf)
 }
+
+// timestampPolicy reads how event timestamps are parsed and checked from the environment. Unset values use defaults.
+func timestampPolicy() influxdb.TimestampPolicy {
+	p := influxdb.TimestampPolicy{Required: os.Getenv("TIMESTAMP_REQUIRED") == "true"}
+	var err error
+	if v := os.Getenv("TIMESTAMP_DEFAULT_ZONE"); v != "" {
+		if p.Location, err = time.LoadLocation(v); err != nil {
+			log.Fatal("invalid TIMESTAMP_DEFAULT_ZONE: ", err)
+		}
+	}
+	if v := os.Getenv("TIMESTAMP_MAX_FUTURE"); v != "" {
+		if p.MaxFuture, err = time.ParseDuration(v); err != nil {
+			log.Fatal("invalid TIMESTAMP_MAX_FUTURE: ", err)
+		}
+	}
+	if v := os.Getenv("TIMESTAMP_MAX_PAST"); v != "" {
+		if p.MaxPast, err = time.ParseDuration(v); err != nil {
+			log.Fatal("invalid TIMESTAMP_MAX_PAST: ", err)
+		}
+	}
+	return p
+}
+
+// dedupWindow reads how long event IDs are remembered to recognize retried events from the environment.
+func dedupWindow() time.Duration {
+	v := os.Getenv("DEDUP_WINDOW")
+	if v == "" {
+		return defaultDedupWindow
+	}
+	window, err := time.ParseDuration(v)
+	if err != nil || window < 0 {
+		log.Fatal("invalid DEDUP_WINDOW: ", v)
+	}
+	return window
+}
+
+// tokenLifetimes reads how long tokens and refresh tokens are valid from the environment. Unset values use defaults.
+func tokenLifetimes() (time.Duration, time.Duration) {
+	accessTTL, refreshTTL := defaultAccessTokenTTL, defaultRefreshTokenTTL
+	var err error
+	if v := os.Getenv("ACCESS_TOKEN_TTL"); v != "" {
+		if accessTTL, err = time.ParseDuration(v); err != nil || accessTTL <= 0 {
+			log.Fatal("invalid ACCESS_TOKEN_TTL: ", v)
+		}
+	}
+	if v := os.Getenv("REFRESH_TOKEN_TTL"); v != "" {
+		if refreshTTL, err = time.ParseDuration(v); err != nil || refreshTTL <= 0 {
+			log.Fatal("invalid REFRESH_TOKEN_TTL: ", v)
+		}
+	}
+	return accessTTL, refreshTTL
+}
+
+// jwtKeyReloadInterval reads how often JWT keys are read from disk again from the environment, zero disables reloading.
+func jwtKeyReloadInterval() time.Duration {
+	v := os.Getenv("JWT_KEY_RELOAD_INTERVAL")
+	if v == "" {
+		return defaultJWTKeyReloadInterval
+	}
+	interval, err := time.ParseDuration(v)
+	if err != nil || interval < 0 {
+		log.Fatal("invalid JWT_KEY_RELOAD_INTERVAL: ", v)
+	}
+	return interval
+}
+
+// asyncWriteConfiguration reads the write pipeline parameters from the environment. Unset values use defaults.
+func asyncWriteConfiguration() asyncstore.Configuration {
+	var c asyncstore.Configuration
+	var err error
+	if v := os.Getenv("ASYNC_WRITE_BUFFER_SIZE"); v != "" {
+		if c.BufferSize, err = strconv.Atoi(v); err != nil {
+			log.Fatal("invalid ASYNC_WRITE_BUFFER_SIZE: ", err)
+		}
+	}
+	if v := os.Getenv("ASYNC_WRITE_BATCH_SIZE"); v != "" {
+		if c.BatchSize, err = strconv.Atoi(v); err != nil {
+			log.Fatal("invalid ASYNC_WRITE_BATCH_SIZE: ", err)
+		}
+	}
+	if v := os.Getenv("ASYNC_WRITE_FLUSH_INTERVAL"); v != "" {
+		if c.FlushInterval, err = time.ParseDuration(v); err != nil {
+			log.Fatal("invalid ASYNC_WRITE_FLUSH_INTERVAL: ", err)
+		}
+	}
+	if v := os.Getenv("ASYNC_WRITE_MAX_RETRIES"); v != "" {
+		if c.MaxRetries, err = strconv.Atoi(v); err != nil {
+			log.Fatal("invalid ASYNC_WRITE_MAX_RETRIES: ", err)
+		}
+	}
+	return c
+}
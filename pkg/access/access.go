@@ -0,0 +1,117 @@
+package access
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rubinda/logtopus/pkg/influxdb"
+)
+
+// Scopes of credentials, each allows a group of endpoints.
+const (
+	// ScopeIngest allows storing events.
+	ScopeIngest string = "ingest"
+	// ScopeQuery allows reading stored and live events, and their schema.
+	ScopeQuery string = "query"
+	// ScopeAdmin allows managing users, API keys and event schemas.
+	ScopeAdmin string = "admin"
+)
+
+// AllScopes contains every scope, in the order they are listed.
+var AllScopes = []string{ScopeIngest, ScopeQuery, ScopeAdmin}
+
+// HasScope reports whether scopes contain the scope.
+func HasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Intersect returns the scopes contained in both lists, in the order of the first one.
+func Intersect(scopes, allowed []string) []string {
+	result := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		if HasScope(allowed, scope) {
+			result = append(result, scope)
+		}
+	}
+	return result
+}
+
+// ValidateScopes reports unknown scopes and scopes which aren't allowed, as problems of the field.
+func ValidateScopes(scopes, allowed []string, field string) []influxdb.ModelError {
+	problems := make([]influxdb.ModelError, 0)
+	for _, scope := range scopes {
+		if !HasScope(AllScopes, scope) {
+			problems = append(problems, influxdb.ModelError{Field: field, Message: fmt.Sprintf("unknown scope %q, expected %s", scope, strings.Join(AllScopes, ", "))})
+		} else if !HasScope(allowed, scope) {
+			problems = append(problems, influxdb.ModelError{Field: field, Message: fmt.Sprintf("scope %q can't be granted", scope)})
+		}
+	}
+	return problems
+}
+
+// Binding limits credentials to events of some entity types or entities. Empty lists don't limit anything.
+type Binding struct {
+	// EntityTypes contains the entity types of events the credentials may store and read.
+	EntityTypes []string `json:"entityTypes,omitempty"`
+	// EntityIds contains the entity identifiers of events the credentials may store and read.
+	EntityIds []string `json:"entityIds,omitempty"`
+}
+
+// Bound reports whether the binding limits any events.
+func (b Binding) Bound() bool {
+	return len(b.EntityTypes) > 0 || len(b.EntityIds) > 0
+}
+
+// Check returns a problem when an event of the entity type and entity is outside the binding.
+func (b Binding) Check(entityType, entityId string) []influxdb.ModelError {
+	if len(b.EntityTypes) > 0 && !HasScope(b.EntityTypes, entityType) {
+		return []influxdb.ModelError{{Field: influxdb.MeasurementFieldName, Message: "entity type not allowed for these credentials"}}
+	}
+	if len(b.EntityIds) > 0 && !HasScope(b.EntityIds, entityId) {
+		return []influxdb.ModelError{{Field: influxdb.EntityIdFieldName, Message: "entity not allowed for these credentials"}}
+	}
+	return nil
+}
+
+// Restrict returns query fields (see "/query/events") which only match events within the binding. Conditions of the
+// query are combined with the binding in an "$and" condition, other attributes (time range, pagination, ...) are kept.
+func (b Binding) Restrict(queryFields map[string]any) map[string]any {
+	if !b.Bound() {
+		return queryFields
+	}
+	restricted := make(map[string]any)
+	conditions := make(map[string]any)
+	for key, value := range queryFields {
+		if strings.HasPrefix(key, "_") || key == influxdb.TimestampFieldName {
+			restricted[key] = value
+		} else {
+			conditions[key] = value
+		}
+	}
+	filters := make([]any, 0, 3)
+	if len(conditions) > 0 {
+		filters = append(filters, conditions)
+	}
+	if len(b.EntityTypes) > 0 {
+		filters = append(filters, map[string]any{influxdb.MeasurementFieldName: map[string]any{influxdb.OpIn: stringsToAny(b.EntityTypes)}})
+	}
+	if len(b.EntityIds) > 0 {
+		filters = append(filters, map[string]any{influxdb.EntityIdFieldName: map[string]any{influxdb.OpIn: stringsToAny(b.EntityIds)}})
+	}
+	restricted[influxdb.OpAnd] = filters
+	return restricted
+}
+
+// stringsToAny converts values to the type of decoded JSON arrays, which query parsing expects.
+func stringsToAny(values []string) []any {
+	result := make([]any, len(values))
+	for i, value := range values {
+		result[i] = value
+	}
+	return result
+}
@@ -0,0 +1,77 @@
+package access
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rubinda/logtopus/pkg/influxdb"
+)
+
+// TestScopes checks scope lists are intersected and validated.
+func TestScopes(t *testing.T) {
+	if scopes := Intersect([]string{ScopeAdmin, ScopeQuery}, []string{ScopeIngest, ScopeQuery}); !reflect.DeepEqual(scopes, []string{ScopeQuery}) {
+		t.Errorf("expected only %s, got %v", ScopeQuery, scopes)
+	}
+	if problems := ValidateScopes([]string{ScopeIngest, ScopeQuery}, []string{ScopeIngest, ScopeQuery}, "scopes"); len(problems) != 0 {
+		t.Errorf("expected no problems, got %v", problems)
+	}
+	problems := ValidateScopes([]string{"everything", ScopeAdmin}, []string{ScopeIngest}, "scopes")
+	if len(problems) != 2 || problems[0].Field != "scopes" || problems[1].Field != "scopes" {
+		t.Errorf("expected problems with the unknown and the denied scope, got %v", problems)
+	}
+}
+
+// TestBindingCheck makes sure events outside a binding are rejected.
+func TestBindingCheck(t *testing.T) {
+	tests := []struct {
+		name       string
+		binding    Binding
+		entityType string
+		entityId   string
+		field      string
+	}{
+		{"unbound", Binding{}, "mediaServer", "plex001", ""},
+		{"bound entity type", Binding{EntityTypes: []string{"mediaServer"}}, "mediaServer", "plex001", ""},
+		{"other entity type", Binding{EntityTypes: []string{"mediaServer"}}, "database", "plex001", influxdb.MeasurementFieldName},
+		{"bound entity", Binding{EntityIds: []string{"plex001", "plex002"}}, "mediaServer", "plex002", ""},
+		{"other entity", Binding{EntityIds: []string{"plex001"}}, "mediaServer", "plex002", influxdb.EntityIdFieldName},
+		{"both bound", Binding{EntityTypes: []string{"mediaServer"}, EntityIds: []string{"plex001"}}, "mediaServer", "plex001", ""},
+		{"other entity of the bound type", Binding{EntityTypes: []string{"mediaServer"}, EntityIds: []string{"plex001"}}, "mediaServer", "db001", influxdb.EntityIdFieldName},
+	}
+	for _, test := range tests {
+		problems := test.binding.Check(test.entityType, test.entityId)
+		if test.field == "" && len(problems) > 0 {
+			t.Errorf("%s: expected no problems, got %v", test.name, problems)
+		} else if test.field != "" && (len(problems) != 1 || problems[0].Field != test.field) {
+			t.Errorf("%s: expected a problem with %s, got %v", test.name, test.field, problems)
+		}
+	}
+}
+
+// TestBindingRestrict makes sure query conditions are combined with the binding and other attributes are kept.
+func TestBindingRestrict(t *testing.T) {
+	query := map[string]any{"severity": map[string]any{"$gt": 3}, "_limit": 10, influxdb.TimestampFieldName: map[string]any{"$gt": "-1h"}}
+	if restricted := (Binding{}).Restrict(query); !reflect.DeepEqual(restricted, query) {
+		t.Errorf("unbound: expected the query to be kept, got %v", restricted)
+	}
+	binding := Binding{EntityTypes: []string{"mediaServer"}, EntityIds: []string{"plex001"}}
+	expected := map[string]any{
+		"_limit":                    10,
+		influxdb.TimestampFieldName: query[influxdb.TimestampFieldName],
+		influxdb.OpAnd: []any{
+			map[string]any{"severity": map[string]any{"$gt": 3}},
+			map[string]any{influxdb.MeasurementFieldName: map[string]any{influxdb.OpIn: []any{"mediaServer"}}},
+			map[string]any{influxdb.EntityIdFieldName: map[string]any{influxdb.OpIn: []any{"plex001"}}},
+		},
+	}
+	if restricted := binding.Restrict(query); !reflect.DeepEqual(restricted, expected) {
+		t.Errorf("expected %v, got %v", expected, restricted)
+	}
+	// An "$or" of the query can't widen the binding, it is nested in the "$and"
+	or := map[string]any{influxdb.OpOr: []any{map[string]any{influxdb.EntityIdFieldName: "db001"}}}
+	restricted := Binding{EntityIds: []string{"plex001"}}.Restrict(or)
+	filters, ok := restricted[influxdb.OpAnd].([]any)
+	if len(restricted) != 1 || !ok || len(filters) != 2 || !reflect.DeepEqual(filters[0], or) {
+		t.Errorf("expected the query nested in %s, got %v", influxdb.OpAnd, restricted)
+	}
+}
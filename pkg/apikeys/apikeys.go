@@ -0,0 +1,303 @@
+package apikeys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/access"
+	"github.com/rubinda/logtopus/pkg/eventid"
+	"github.com/rubinda/logtopus/pkg/influxdb"
+)
+
+const (
+	// keyPrefix starts every API key, so leaked keys are easy to recognize (e.g. by secret scanners).
+	keyPrefix string = "ltk_"
+	// secretSize is the number of random bytes in a key.
+	secretSize int = 32
+	// lastUsedResolution limits how often the last use of a key is recorded, and how long recorded uses wait to be
+	// persisted together.
+	lastUsedResolution time.Duration = time.Minute
+)
+
+var (
+	// ErrNotFound is returned when an API key doesn't exist.
+	ErrNotFound = fmt.Errorf("API key not found")
+	// ErrInvalidKey is returned when an API key is unknown, revoked or expired.
+	ErrInvalidKey = fmt.Errorf("invalid, revoked or expired API key")
+)
+
+var (
+	// DefaultScopes are granted to keys minted without scopes, event sources usually only store events.
+	DefaultScopes = []string{access.ScopeIngest}
+	// GrantableScopes can be granted to keys, keys never allow administration.
+	GrantableScopes = []string{access.ScopeIngest, access.ScopeQuery}
+	// legacyScopes are granted to keys stored before keys had scopes, which could store and read events.
+	legacyScopes = []string{access.ScopeIngest, access.ScopeQuery}
+)
+
+// sourcePattern limits event source names to characters which are safe in URL paths and logs.
+var sourcePattern = regexp.MustCompile(`^[A-Za-z0-9._@-]{1,64}$`)
+
+// Key describes an API key of an event source, without its secret.
+type Key struct {
+	// Id identifies the key, it is also part of the key itself.
+	Id string `json:"id"`
+	// Source is the name of the event source (e.g. a device) the key was minted for.
+	Source string `json:"source"`
+	// Scopes are the scopes the key allows (see the access package).
+	Scopes []string `json:"scopes"`
+	// Binding limits the key to events of some entity types or entities.
+	access.Binding
+	// CreatedAt is the time the key was minted.
+	CreatedAt time.Time `json:"createdAt"`
+	// ExpiresAt is the time the key stops being accepted, the key doesn't expire when nil.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// LastUsedAt is the time the key was last accepted (persisted with a resolution of a minute).
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	// RevokedAt is the time the key was revoked, revoked keys are kept for auditing.
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// record is a key as persisted, with the hash of its secret.
+type record struct {
+	Key
+	// SecretHash is the hex encoded SHA-256 hash of the secret. Secrets are random, so a slow hash isn't needed.
+	SecretHash string `json:"secretHash"`
+}
+
+// Store keeps API keys in memory and persists them to a file.
+type Store struct {
+	// mu guards records, version and flushPending.
+	mu sync.Mutex
+	// records contains keys by id.
+	records map[string]*record
+	// path is the file keys are persisted to.
+	path string
+	// version counts snapshots of records, so an older snapshot never replaces a newer one in the file.
+	version uint64
+	// flushPending is set while recorded uses wait to be persisted.
+	flushPending bool
+	// fileMu guards the store file and written.
+	fileMu sync.Mutex
+	// written is the version of the snapshot in the store file.
+	written uint64
+}
+
+// Open returns a store persisted to the file at given path, keys stored in the file are loaded.
+func Open(path string) (*Store, error) {
+	s := &Store{records: make(map[string]*record), path: path}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var records []record
+	if err := json.Unmarshal(content, &records); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i := range records {
+		if records[i].Scopes == nil {
+			records[i].Scopes = legacyScopes
+		}
+		s.records[records[i].Id] = &records[i]
+	}
+	return s, nil
+}
+
+// Create mints a key for the event source with the scopes (DefaultScopes when empty) and binding, expiring at
+// expiresAt unless it is nil. Returns the key description and the key itself, which isn't stored and can't be shown
+// again. Invalid parameters are reported as problems, the error is set when the store can't be persisted.
+func (s *Store) Create(source string, scopes []string, binding access.Binding, expiresAt *time.Time, now time.Time) (Key, string, []influxdb.ModelError, error) {
+	problems := make([]influxdb.ModelError, 0)
+	if !sourcePattern.MatchString(source) {
+		problems = append(problems, influxdb.ModelError{Field: "source", Message: "expected 1 to 64 letters, digits or any of . _ @ -"})
+	}
+	if len(scopes) == 0 {
+		scopes = DefaultScopes
+	}
+	problems = append(problems, access.ValidateScopes(scopes, GrantableScopes, "scopes")...)
+	if expiresAt != nil && !expiresAt.After(now) {
+		problems = append(problems, influxdb.ModelError{Field: "expiresAt", Message: "expected a time in the future"})
+	}
+	if len(problems) > 0 {
+		return Key{}, "", problems, nil
+	}
+	secret := make([]byte, secretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return Key{}, "", nil, err
+	}
+	encodedSecret := hex.EncodeToString(secret)
+	r := &record{Key{Id: eventid.New(now), Source: source, Scopes: scopes, Binding: binding, CreatedAt: now.UTC()}, hashSecret(encodedSecret)}
+	if expiresAt != nil {
+		expires := expiresAt.UTC()
+		r.ExpiresAt = &expires
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[r.Id] = r
+	if err := s.save(); err != nil {
+		// Keep memory and file consistent
+		delete(s.records, r.Id)
+		return Key{}, "", nil, err
+	}
+	return r.Key, keyPrefix + r.Id + "_" + encodedSecret, nil, nil
+}
+
+// Authenticate returns the description of a valid key and records its use. Returns ErrInvalidKey when the key is
+// unknown, revoked or expired.
+func (s *Store) Authenticate(key string, now time.Time) (Key, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(key, keyPrefix), "_")
+	if !ok || !strings.HasPrefix(key, keyPrefix) {
+		return Key{}, ErrInvalidKey
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.records[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(r.SecretHash)) != 1 {
+		return Key{}, ErrInvalidKey
+	}
+	if r.RevokedAt != nil || (r.ExpiresAt != nil && !r.ExpiresAt.After(now)) {
+		return Key{}, ErrInvalidKey
+	}
+	if r.LastUsedAt == nil || now.Sub(*r.LastUsedAt) >= lastUsedResolution {
+		lastUsed := now.UTC()
+		r.LastUsedAt = &lastUsed
+		// Uses of all keys are persisted together later, requests don't wait for the file
+		if !s.flushPending {
+			s.flushPending = true
+			time.AfterFunc(lastUsedResolution, s.flushLastUsed)
+		}
+	}
+	return r.Key, nil
+}
+
+// flushLastUsed persists recorded uses of keys. Uses recorded shortly before shutdown aren't persisted.
+func (s *Store) flushLastUsed() {
+	s.mu.Lock()
+	s.flushPending = false
+	content, version, err := s.snapshot()
+	s.mu.Unlock()
+	if err == nil {
+		// The lock isn't held while writing, so authentication isn't blocked by the disk
+		err = s.write(content, version)
+	}
+	if err != nil {
+		// The keys are valid regardless, an outdated last use isn't worth more than a warning
+		log.Printf("[WARNING] Can't save API key store: %s\n", err)
+	}
+}
+
+// Get returns the key with the id, ErrNotFound when there is none.
+func (s *Store) Get(id string) (Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.records[id]
+	if !ok {
+		return Key{}, ErrNotFound
+	}
+	return r.Key, nil
+}
+
+// List returns all keys (including revoked ones) ordered by creation.
+func (s *Store) List() []Key {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]Key, 0, len(s.records))
+	for _, r := range s.records {
+		keys = append(keys, r.Key)
+	}
+	// Ids are ULIDs, which sort by creation time
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Id < keys[j].Id
+	})
+	return keys
+}
+
+// Revoke stops accepting the key and returns its updated description. Revoking a revoked key keeps the first revocation time.
+func (s *Store) Revoke(id string, now time.Time) (Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.records[id]
+	if !ok {
+		return Key{}, ErrNotFound
+	}
+	if r.RevokedAt != nil {
+		return r.Key, nil
+	}
+	revokedAt := now.UTC()
+	r.RevokedAt = &revokedAt
+	if err := s.save(); err != nil {
+		r.RevokedAt = nil
+		return Key{}, err
+	}
+	return r.Key, nil
+}
+
+// hashSecret returns the hex encoded SHA-256 hash of a key secret.
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// save writes all keys to the store file. The file is replaced atomically, so a failed write doesn't lose earlier
+// keys. Has to be called with mu held.
+func (s *Store) save() error {
+	content, version, err := s.snapshot()
+	if err != nil {
+		return err
+	}
+	return s.write(content, version)
+}
+
+// snapshot returns the encoded keys and their version. Has to be called with mu held.
+func (s *Store) snapshot() ([]byte, uint64, error) {
+	records := make([]*record, 0, len(s.records))
+	for _, r := range s.records {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Id < records[j].Id
+	})
+	content, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return nil, 0, err
+	}
+	s.version++
+	return content, s.version, nil
+}
+
+// write replaces the store file with a snapshot, unless a newer snapshot was written already.
+func (s *Store) write(content []byte, version uint64) error {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	if version <= s.written {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	// Key hashes are only readable by the server user
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return err
+	}
+	s.written = version
+	return nil
+}
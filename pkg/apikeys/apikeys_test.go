@@ -0,0 +1,154 @@
+package apikeys
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/access"
+)
+
+// openStore returns an empty store in a temporary directory.
+func openStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := Open(filepath.Join(t.TempDir(), "apikeys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// TestCreate checks validation of minted keys and that secrets are only stored hashed.
+func TestCreate(t *testing.T) {
+	s := openStore(t)
+	now := time.Now()
+	past, future := now.Add(-time.Minute), now.Add(time.Hour)
+	tests := []struct {
+		name      string
+		source    string
+		scopes    []string
+		expiresAt *time.Time
+		problems  []string
+	}{
+		{"valid", "sensor-1", nil, nil, nil},
+		{"expiring", "sensor-1", []string{access.ScopeIngest, access.ScopeQuery}, &future, nil},
+		{"invalid source", "sensor 1", nil, nil, []string{"source"}},
+		{"admin scope", "sensor-1", []string{access.ScopeAdmin}, nil, []string{"scopes"}},
+		{"expired", "sensor-1", nil, &past, []string{"expiresAt"}},
+	}
+	for _, test := range tests {
+		key, secret, problems, err := s.Create(test.source, test.scopes, access.Binding{}, test.expiresAt, now)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if len(problems) != len(test.problems) {
+			t.Errorf("%s: expected problems with %v, got %v", test.name, test.problems, problems)
+			continue
+		}
+		for i, field := range test.problems {
+			if problems[i].Field != field {
+				t.Errorf("%s: expected a problem with %s, got %v", test.name, field, problems[i])
+			}
+		}
+		if len(problems) > 0 {
+			continue
+		}
+		if !strings.HasPrefix(secret, keyPrefix+key.Id+"_") || (test.scopes == nil && strings.Join(key.Scopes, ",") != strings.Join(DefaultScopes, ",")) {
+			t.Errorf("%s: unexpected key %+v (%s)", test.name, key, secret)
+		}
+		content, err := os.ReadFile(s.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, encodedSecret, _ := strings.Cut(strings.TrimPrefix(secret, keyPrefix), "_"); strings.Contains(string(content), encodedSecret) {
+			t.Errorf("%s: expected only a hash of the secret to be stored", test.name)
+		}
+	}
+	if keys := s.List(); len(keys) != 2 {
+		t.Errorf("expected 2 keys, got %+v", keys)
+	}
+}
+
+// TestAuthenticate accepts valid keys and rejects malformed, unknown, revoked and expired ones.
+func TestAuthenticate(t *testing.T) {
+	s := openStore(t)
+	now := time.Now()
+	expiresAt := now.Add(time.Hour)
+	_, valid, _, err := s.Create("sensor-1", nil, access.Binding{EntityTypes: []string{"thermometer"}}, nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, expiring, _, err := s.Create("sensor-2", nil, access.Binding{}, &expiresAt, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokedKey, revoked, _, err := s.Create("sensor-3", nil, access.Binding{}, nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Revoke(revokedKey.Id, now); err != nil {
+		t.Fatal(err)
+	}
+	id, _, _ := strings.Cut(strings.TrimPrefix(valid, keyPrefix), "_")
+	tests := []struct {
+		name string
+		key  string
+		at   time.Duration
+		err  error
+	}{
+		{"valid", valid, 0, nil},
+		{"before expiry", expiring, time.Hour - time.Second, nil},
+		{"expired", expiring, time.Hour, ErrInvalidKey},
+		{"revoked", revoked, 0, ErrInvalidKey},
+		{"wrong secret", keyPrefix + id + "_" + strings.Repeat("0", 2*secretSize), 0, ErrInvalidKey},
+		{"unknown id", keyPrefix + "01GRHE9N2FQ4ZB1R9D4TW6V8XK_00", 0, ErrInvalidKey},
+		{"without prefix", strings.TrimPrefix(valid, keyPrefix), 0, ErrInvalidKey},
+		{"without secret", keyPrefix + id, 0, ErrInvalidKey},
+		{"empty", "", 0, ErrInvalidKey},
+	}
+	for _, test := range tests {
+		key, err := s.Authenticate(test.key, now.Add(test.at))
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		} else if err == nil && key.LastUsedAt == nil {
+			t.Errorf("%s: expected the use to be recorded", test.name)
+		}
+	}
+	if key, _ := s.Get(id); len(key.EntityTypes) != 1 || key.EntityTypes[0] != "thermometer" {
+		t.Errorf("expected the binding to be kept, got %+v", key)
+	}
+}
+
+// TestRevoke makes sure revocations are persisted and keep the first revocation time.
+func TestRevoke(t *testing.T) {
+	s := openStore(t)
+	now := time.Now()
+	key, secret, _, err := s.Create("sensor-1", nil, access.Binding{}, nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Revoke("missing", now); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected %v, got %v", ErrNotFound, err)
+	}
+	revoked, err := s.Revoke(key.Id, now)
+	if err != nil || revoked.RevokedAt == nil {
+		t.Fatalf("expected a revocation time, got %+v (%v)", revoked, err)
+	}
+	again, err := s.Revoke(key.Id, now.Add(time.Hour))
+	if err != nil || !again.RevokedAt.Equal(*revoked.RevokedAt) {
+		t.Errorf("expected the first revocation time %s, got %+v (%v)", revoked.RevokedAt, again, err)
+	}
+	reopened, err := Open(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.Authenticate(secret, now); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("expected the revocation to be restored, got %v", err)
+	}
+	if keys := reopened.List(); len(keys) != 1 || keys[0].RevokedAt == nil {
+		t.Errorf("expected the revoked key to be kept, got %+v", keys)
+	}
+}
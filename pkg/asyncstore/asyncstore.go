@@ -0,0 +1,376 @@
+package asyncstore
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/influxdb"
+)
+
+const (
+	// defaultBufferSize is the default number of events waiting to be written.
+	defaultBufferSize int = 10000
+	// defaultBatchSize is the default number of events written at once.
+	defaultBatchSize int = 1000
+	// defaultFlushInterval is the default time between flushes of a non-full batch.
+	defaultFlushInterval time.Duration = time.Second
+	// defaultMaxRetries is the default number of retries for a failed write.
+	defaultMaxRetries int = 5
+	// defaultRetryInterval is the default wait time before the first retry.
+	defaultRetryInterval time.Duration = 500 * time.Millisecond
+	// maxRetryInterval caps the exponential backoff between retries.
+	maxRetryInterval time.Duration = 30 * time.Second
+)
+
+var (
+	// ErrBufferFull is returned when events can't be queued because too many are waiting to be written.
+	ErrBufferFull = fmt.Errorf("write buffer is full, try again later")
+	// ErrClosed is returned when events are stored after the store has been disconnected.
+	ErrClosed = fmt.Errorf("event store is shut down")
+)
+
+// Backend contains the storage methods the asynchronous store writes to.
+type Backend interface {
+	StoreEvents(events []influxdb.BasicEvent) error
+	QueryEvents(queryFields map[string]any) (influxdb.QueryResult, error)
+	AggregateEvents(queryFields map[string]any) (influxdb.AggregateResult, error)
+	DistinctValues(field string, start, stop time.Time) ([]string, error)
+	DetailFields(entityType string, start, stop time.Time) ([]influxdb.DetailField, error)
+	Disconnect()
+}
+
+// checker is implemented by backends which can refuse events, so they are checked before being queued.
+type checker interface {
+	CheckEvent(eventData influxdb.BasicEvent) error
+	TagKeys() []string
+}
+
+// Configuration represents write pipeline parameters. Zero values are replaced with defaults.
+type Configuration struct {
+	// BufferSize is the maximum number of events waiting to be written.
+	BufferSize int
+	// BatchSize is the number of events written to the backend at once.
+	BatchSize int
+	// FlushInterval is the maximum time an event waits before being written.
+	FlushInterval time.Duration
+	// MaxRetries is the number of retries for a failed write before the batch is dropped.
+	MaxRetries int
+	// RetryInterval is the wait time before the first retry, doubled with each further retry.
+	RetryInterval time.Duration
+}
+
+// Stats contains write pipeline counters.
+type Stats struct {
+	// Pending is the number of events waiting to be written.
+	Pending int `json:"pending"`
+	// Written is the number of events successfully written.
+	Written uint64 `json:"written"`
+	// FailedWrites is the number of failed write attempts.
+	FailedWrites uint64 `json:"failedWrites"`
+	// Retries is the number of repeated write attempts.
+	Retries uint64 `json:"retries"`
+	// Dropped is the number of events discarded after all retries failed.
+	Dropped uint64 `json:"dropped"`
+	// Invalid is the number of events discarded because the backend refused them (e.g. conflicting field types).
+	Invalid uint64 `json:"invalid"`
+	// Rejected is the number of events refused because the buffer was full.
+	Rejected uint64 `json:"rejected"`
+	// LastError is the message of the most recent write error.
+	LastError string `json:"lastError,omitempty"`
+	// LastErrorTime is the time of the most recent write error.
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+// queued is an event waiting to be written.
+type queued struct {
+	// source identifies who stored the event, it is passed to the callbacks (see Notify).
+	source string
+	// event is the event to write.
+	event influxdb.BasicEvent
+}
+
+// Store queues events in a bounded buffer and writes them to the backend in batches, flushed by size or interval.
+// Queries are passed to the backend directly, so they don't include events which haven't been written yet.
+type Store struct {
+	// backend is the storage the events are written to.
+	backend Backend
+	// conf contains the write pipeline parameters.
+	conf Configuration
+	// mu guards pending, closed, stats and the callbacks.
+	mu sync.Mutex
+	// pending contains events waiting to be written.
+	pending []queued
+	// closed is set when the store is disconnected.
+	closed bool
+	// stats contains write pipeline counters.
+	stats Stats
+	// onWritten is called with events of a source after they were written.
+	onWritten func(string, []influxdb.BasicEvent)
+	// onDropped is called with events of a source which were dropped without being written.
+	onDropped func(string, []influxdb.BasicEvent)
+	// flushSignal notifies the writer that a full batch is waiting.
+	flushSignal chan struct{}
+	// done is closed to stop the writer.
+	done chan struct{}
+	// wg waits for the writer to finish.
+	wg sync.WaitGroup
+}
+
+// New starts an asynchronous write pipeline in front of the given backend.
+func New(backend Backend, c Configuration) *Store {
+	if c.BufferSize <= 0 {
+		c.BufferSize = defaultBufferSize
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = defaultBatchSize
+	}
+	if c.BatchSize > c.BufferSize {
+		c.BatchSize = c.BufferSize
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = defaultFlushInterval
+	}
+	if c.MaxRetries <= 0 {
+		c.MaxRetries = defaultMaxRetries
+	}
+	if c.RetryInterval <= 0 {
+		c.RetryInterval = defaultRetryInterval
+	}
+	s := &Store{
+		backend:     backend,
+		conf:        c,
+		pending:     make([]queued, 0, c.BatchSize),
+		flushSignal: make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.writer()
+	return s
+}
+
+// StoreEvent queues the event for writing. Returns ErrBufferFull when the buffer has no room left.
+func (s *Store) StoreEvent(eventData influxdb.BasicEvent) error {
+	return s.StoreEvents([]influxdb.BasicEvent{eventData})
+}
+
+// StoreEvents queues all events for writing, or none of them when the buffer doesn't have enough room.
+func (s *Store) StoreEvents(events []influxdb.BasicEvent) error {
+	return s.StoreEventsFrom("", events)
+}
+
+// StoreEventsFrom queues all events of the source for writing, or none of them when the buffer doesn't have enough
+// room. The source is passed to the callbacks once the events are written or dropped.
+func (s *Store) StoreEventsFrom(source string, events []influxdb.BasicEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if len(s.pending)+len(events) > s.conf.BufferSize {
+		s.stats.Rejected += uint64(len(events))
+		return ErrBufferFull
+	}
+	for _, eventData := range events {
+		s.pending = append(s.pending, queued{source, eventData})
+	}
+	if len(s.pending) >= s.conf.BatchSize {
+		select {
+		case s.flushSignal <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Notify registers callbacks for events once their write is done: onWritten after they were written, onDropped when
+// they were dropped. Callbacks are called with the events of one source (see StoreEventsFrom) at a time, by the
+// writer, so they should return quickly.
+func (s *Store) Notify(onWritten, onDropped func(source string, events []influxdb.BasicEvent)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onWritten, s.onDropped = onWritten, onDropped
+}
+
+// CheckEvent returns why the backend can't store the event, nil when the backend doesn't check events.
+func (s *Store) CheckEvent(eventData influxdb.BasicEvent) error {
+	if c, ok := s.backend.(checker); ok {
+		return c.CheckEvent(eventData)
+	}
+	return nil
+}
+
+// TagKeys lists the detail keys the backend stores as tags.
+func (s *Store) TagKeys() []string {
+	if c, ok := s.backend.(checker); ok {
+		return c.TagKeys()
+	}
+	return nil
+}
+
+// QueryEvents runs the query on the backend.
+func (s *Store) QueryEvents(queryFields map[string]any) (influxdb.QueryResult, error) {
+	return s.backend.QueryEvents(queryFields)
+}
+
+// AggregateEvents runs the aggregation query on the backend.
+func (s *Store) AggregateEvents(queryFields map[string]any) (influxdb.AggregateResult, error) {
+	return s.backend.AggregateEvents(queryFields)
+}
+
+// DistinctValues lists distinct attribute values on the backend.
+func (s *Store) DistinctValues(field string, start, stop time.Time) ([]string, error) {
+	return s.backend.DistinctValues(field, start, stop)
+}
+
+// DetailFields lists detail field keys and their types on the backend.
+func (s *Store) DetailFields(entityType string, start, stop time.Time) ([]influxdb.DetailField, error) {
+	return s.backend.DetailFields(entityType, start, stop)
+}
+
+// Stats returns a snapshot of the write pipeline counters.
+func (s *Store) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.stats
+	stats.Pending = len(s.pending)
+	return stats
+}
+
+// Disconnect stops accepting events, writes all pending events and disconnects the backend.
+func (s *Store) Disconnect() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.mu.Unlock()
+	close(s.done)
+	s.wg.Wait()
+	s.backend.Disconnect()
+}
+
+// writer writes batches to the backend until the store is disconnected, then flushes whatever is left.
+func (s *Store) writer() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.conf.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush(false)
+		case <-s.flushSignal:
+			s.flush(true)
+		case <-s.done:
+			log.Printf("Flushing %d pending events before shutdown\n", s.Stats().Pending)
+			s.flush(false)
+			return
+		}
+	}
+}
+
+// flush writes pending events in batches. When onlyFull is set, a trailing partial batch is left for later.
+func (s *Store) flush(onlyFull bool) {
+	for {
+		s.mu.Lock()
+		n := len(s.pending)
+		if n == 0 || (onlyFull && n < s.conf.BatchSize) {
+			s.mu.Unlock()
+			return
+		}
+		if n > s.conf.BatchSize {
+			n = s.conf.BatchSize
+		}
+		batch := make([]queued, n)
+		copy(batch, s.pending)
+		s.pending = append(s.pending[:0], s.pending[n:]...)
+		s.mu.Unlock()
+		s.write(batch)
+	}
+}
+
+// write stores a batch on the backend. Transient errors are retried with exponential backoff and the batch is dropped
+// when all retries fail. Batches refused by the backend are split, so only the events which can't be stored are dropped.
+func (s *Store) write(batch []queued) {
+	events := make([]influxdb.BasicEvent, len(batch))
+	for i, q := range batch {
+		events[i] = q.event
+	}
+	wait := s.conf.RetryInterval
+	for attempt := 0; ; attempt++ {
+		err := s.backend.StoreEvents(events)
+		s.mu.Lock()
+		if err == nil {
+			s.stats.Written += uint64(len(batch))
+			onWritten := s.onWritten
+			s.mu.Unlock()
+			notify(onWritten, batch)
+			return
+		}
+		now := time.Now()
+		s.stats.FailedWrites++
+		s.stats.LastError = err.Error()
+		s.stats.LastErrorTime = &now
+		if influxdb.IsPermanent(err) && len(batch) == 1 {
+			s.stats.Invalid++
+			onDropped := s.onDropped
+			s.mu.Unlock()
+			log.Printf("[WARNING] Dropping event %q, it can't be stored: %s\n", batch[0].event.EventId, err)
+			notify(onDropped, batch)
+			return
+		} else if influxdb.IsPermanent(err) {
+			s.mu.Unlock()
+			// Events of a partially written half are written again, which overwrites them with the same values
+			half := len(batch) / 2
+			s.write(batch[:half])
+			s.write(batch[half:])
+			return
+		}
+		if attempt >= s.conf.MaxRetries {
+			s.stats.Dropped += uint64(len(batch))
+			onDropped := s.onDropped
+			s.mu.Unlock()
+			log.Printf("[WARNING] Dropping %d events after %d failed writes: %s\n", len(batch), attempt+1, err)
+			notify(onDropped, batch)
+			return
+		}
+		s.stats.Retries++
+		s.mu.Unlock()
+		log.Printf("[WARNING] Writing %d events failed (attempt %d), retrying in %s: %s\n", len(batch), attempt+1, wait, err)
+		s.backoff(wait)
+		if wait *= 2; wait > maxRetryInterval {
+			wait = maxRetryInterval
+		}
+	}
+}
+
+// notify calls the callback (unless it is nil) with consecutive events of the same source.
+func notify(callback func(string, []influxdb.BasicEvent), batch []queued) {
+	if callback == nil {
+		return
+	}
+	for start := 0; start < len(batch); {
+		end := start + 1
+		for end < len(batch) && batch[end].source == batch[start].source {
+			end++
+		}
+		events := make([]influxdb.BasicEvent, end-start)
+		for i, q := range batch[start:end] {
+			events[i] = q.event
+		}
+		callback(batch[start].source, events)
+		start = end
+	}
+}
+
+// backoff waits before a retry. During shutdown retries aren't delayed, so shutdown isn't held up by the backoff.
+func (s *Store) backoff(wait time.Duration) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-s.done:
+	}
+}
@@ -0,0 +1,244 @@
+package asyncstore
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/influxdb"
+	"github.com/rubinda/logtopus/pkg/memstore"
+)
+
+// errUnavailable is a transient write error.
+var errUnavailable = errors.New("service unavailable")
+
+// fakeBackend stores events in memory and fails writes as told.
+type fakeBackend struct {
+	*memstore.Store
+	// mu guards the fields below.
+	mu sync.Mutex
+	// fail returns the error of a write attempt, nil to store the events.
+	fail func(attempt int, events []influxdb.BasicEvent) error
+	// attempts counts write attempts.
+	attempts int
+	// disconnected is set when the backend is disconnected.
+	disconnected bool
+}
+
+// StoreEvents stores the events unless fail returns an error.
+func (b *fakeBackend) StoreEvents(events []influxdb.BasicEvent) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.attempts++
+	if b.fail != nil {
+		if err := b.fail(b.attempts, events); err != nil {
+			return err
+		}
+	}
+	return b.Store.StoreEvents(events)
+}
+
+// Disconnect marks the backend as disconnected.
+func (b *fakeBackend) Disconnect() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.disconnected = true
+}
+
+// stored returns the number of stored events.
+func (b *fakeBackend) stored(t *testing.T) int {
+	t.Helper()
+	result, err := b.QueryEvents(map[string]any{influxdb.QueryRangeStartTag: "2000-01-01T00:00:00Z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(result.Events)
+}
+
+// notifications collects the events passed to the callbacks by source.
+type notifications struct {
+	// mu guards written and dropped.
+	mu sync.Mutex
+	// written contains the IDs of written events by source.
+	written map[string][]string
+	// dropped contains the IDs of dropped events by source.
+	dropped map[string][]string
+}
+
+// newNotifications registers callbacks on the store.
+func newNotifications(s *Store) *notifications {
+	n := &notifications{written: make(map[string][]string), dropped: make(map[string][]string)}
+	record := func(to map[string][]string) func(string, []influxdb.BasicEvent) {
+		return func(source string, events []influxdb.BasicEvent) {
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			for _, eventData := range events {
+				to[source] = append(to[source], eventData.EventId)
+			}
+		}
+	}
+	s.Notify(record(n.written), record(n.dropped))
+	return n
+}
+
+// testEvents returns events with the given IDs.
+func testEvents(ids ...string) []influxdb.BasicEvent {
+	events := make([]influxdb.BasicEvent, len(ids))
+	for i, id := range ids {
+		events[i] = influxdb.BasicEvent{EventId: id, EntityId: "plex001", EntityType: "mediaServer", EventType: "log", Timestamp: time.Now()}
+	}
+	return events
+}
+
+// waitFor waits until the condition holds, at most a few seconds.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !condition(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// TestFlush writes full batches right away and partial batches on the flush interval.
+func TestFlush(t *testing.T) {
+	backend := &fakeBackend{Store: memstore.New()}
+	s := New(backend, Configuration{BatchSize: 3, FlushInterval: time.Hour})
+	defer s.Disconnect()
+	if err := s.StoreEvents(testEvents("1", "2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StoreEvents(testEvents("3", "4")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a full batch", func() bool { return s.Stats().Written == 3 })
+	if pending := s.Stats().Pending; pending != 1 {
+		t.Errorf("expected the partial batch to wait, got %d pending events", pending)
+	}
+
+	backend = &fakeBackend{Store: memstore.New()}
+	s = New(backend, Configuration{BatchSize: 100, FlushInterval: 10 * time.Millisecond})
+	defer s.Disconnect()
+	if err := s.StoreEvent(testEvents("1")[0]); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the flush interval", func() bool { return s.Stats().Written == 1 })
+	if stored := backend.stored(t); stored != 1 {
+		t.Errorf("expected 1 stored event, got %d", stored)
+	}
+
+	s = New(&fakeBackend{Store: memstore.New()}, Configuration{BufferSize: 2, FlushInterval: time.Hour})
+	defer s.Disconnect()
+	if err := s.StoreEvents(testEvents("1", "2", "3")); !errors.Is(err, ErrBufferFull) {
+		t.Errorf("expected %v, got %v", ErrBufferFull, err)
+	}
+	if stats := s.Stats(); stats.Pending != 0 || stats.Rejected != 3 {
+		t.Errorf("expected all events to be rejected, got %+v", stats)
+	}
+}
+
+// TestRetry retries transient errors until the batch is written or the retries are used up, events the backend
+// refuses are dropped without retries.
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name    string
+		fail    func(attempt int, events []influxdb.BasicEvent) error
+		stats   Stats
+		written []string
+		dropped []string
+	}{
+		{
+			name: "transient",
+			fail: func(attempt int, _ []influxdb.BasicEvent) error {
+				if attempt <= 2 {
+					return errUnavailable
+				}
+				return nil
+			},
+			stats:   Stats{Written: 2, FailedWrites: 2, Retries: 2},
+			written: []string{"1", "2"},
+		},
+		{
+			name:    "retries used up",
+			fail:    func(int, []influxdb.BasicEvent) error { return errUnavailable },
+			stats:   Stats{FailedWrites: 3, Retries: 2, Dropped: 2},
+			dropped: []string{"1", "2"},
+		},
+		{
+			name: "permanent",
+			fail: func(int, []influxdb.BasicEvent) error {
+				return fmt.Errorf("%w: conflicting field type", influxdb.ErrInvalidEvent)
+			},
+			stats:   Stats{FailedWrites: 3, Invalid: 2},
+			dropped: []string{"1", "2"},
+		},
+	}
+	for _, test := range tests {
+		backend := &fakeBackend{Store: memstore.New(), fail: test.fail}
+		s := New(backend, Configuration{MaxRetries: 2, RetryInterval: time.Millisecond, FlushInterval: time.Hour})
+		n := newNotifications(s)
+		if err := s.StoreEventsFrom("agent", testEvents("1", "2")); err != nil {
+			t.Fatal(err)
+		}
+		s.Disconnect()
+		stats := s.Stats()
+		stats.LastError, stats.LastErrorTime = "", nil
+		if stats != test.stats {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.stats, stats)
+		}
+		if fmt.Sprint(n.written["agent"]) != fmt.Sprint(test.written) || fmt.Sprint(n.dropped["agent"]) != fmt.Sprint(test.dropped) {
+			t.Errorf("%s: expected %v written and %v dropped, got %v and %v", test.name, test.written, test.dropped, n.written, n.dropped)
+		}
+	}
+}
+
+// TestSplit splits refused batches, so only the events the backend can't store are dropped.
+func TestSplit(t *testing.T) {
+	backend := &fakeBackend{Store: memstore.New(), fail: func(_ int, events []influxdb.BasicEvent) error {
+		for _, eventData := range events {
+			if eventData.EventId == "bad" {
+				return fmt.Errorf("%w: conflicting field type", influxdb.ErrInvalidEvent)
+			}
+		}
+		return nil
+	}}
+	s := New(backend, Configuration{BatchSize: 5, FlushInterval: time.Hour})
+	n := newNotifications(s)
+	if err := s.StoreEventsFrom("agent", testEvents("1", "2", "bad")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StoreEventsFrom("admin", testEvents("3", "4")); err != nil {
+		t.Fatal(err)
+	}
+	s.Disconnect()
+	if stats := s.Stats(); stats.Written != 4 || stats.Invalid != 1 || stats.Retries != 0 {
+		t.Errorf("expected 4 written and 1 invalid event without retries, got %+v", stats)
+	}
+	if stored := backend.stored(t); stored != 4 {
+		t.Errorf("expected 4 stored events, got %d", stored)
+	}
+	expected := map[string][]string{"agent": {"1", "2"}, "admin": {"3", "4"}}
+	if fmt.Sprint(n.written) != fmt.Sprint(expected) || fmt.Sprint(n.dropped) != fmt.Sprint(map[string][]string{"agent": {"bad"}}) {
+		t.Errorf("expected %v written and only bad dropped, got %v and %v", expected, n.written, n.dropped)
+	}
+}
+
+// TestDisconnect writes buffered events before disconnecting the backend and refuses events afterwards.
+func TestDisconnect(t *testing.T) {
+	backend := &fakeBackend{Store: memstore.New()}
+	s := New(backend, Configuration{BatchSize: 2, FlushInterval: time.Hour})
+	// Less than a batch, so it is only written on the flush interval
+	if err := s.StoreEvents(testEvents("1")); err != nil {
+		t.Fatal(err)
+	}
+	s.Disconnect()
+	if stored := backend.stored(t); stored != 1 || !backend.disconnected {
+		t.Errorf("expected 1 stored event on a disconnected backend, got %d (%t)", stored, backend.disconnected)
+	}
+	if err := s.StoreEvent(testEvents("2")[0]); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected %v, got %v", ErrClosed, err)
+	}
+	s.Disconnect()
+}
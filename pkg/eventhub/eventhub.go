@@ -0,0 +1,113 @@
+package eventhub
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/rubinda/logtopus/pkg/eventquery"
+	"github.com/rubinda/logtopus/pkg/influxdb"
+)
+
+// Hub distributes newly stored events to subscribers. Publishing never blocks: each subscriber has a bounded buffer,
+// events which don't fit are dropped for that subscriber (and counted).
+type Hub struct {
+	// mu guards subscribers and closed.
+	mu sync.RWMutex
+	// subscribers contains all active subscriptions.
+	subscribers map[*Subscription]struct{}
+	// closed is set when the hub is shut down.
+	closed bool
+	// bufferSize is the number of events buffered for each subscriber.
+	bufferSize int
+	// done is closed when the hub is shut down.
+	done chan struct{}
+}
+
+// Subscription receives published events matching its query.
+type Subscription struct {
+	// hub is the hub the subscription belongs to.
+	hub *Hub
+	// query selects the received events.
+	query eventquery.Query
+	// events buffers matching events until they are consumed.
+	events chan influxdb.BasicEvent
+	// dropped counts events which didn't fit into the buffer.
+	dropped atomic.Uint64
+	// closeOnce makes sure the events channel is closed once.
+	closeOnce sync.Once
+}
+
+// New returns a hub with given per subscriber buffer size.
+func New(bufferSize int) *Hub {
+	return &Hub{subscribers: make(map[*Subscription]struct{}), bufferSize: bufferSize, done: make(chan struct{})}
+}
+
+// Subscribe registers a new subscription for events matching the query (see eventquery.ParseFilter).
+// The subscription has to be closed when no longer needed.
+func (h *Hub) Subscribe(query eventquery.Query) *Subscription {
+	s := &Subscription{hub: h, query: query, events: make(chan influxdb.BasicEvent, h.bufferSize)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		s.closeOnce.Do(func() { close(s.events) })
+		return s
+	}
+	h.subscribers[s] = struct{}{}
+	return s
+}
+
+// Publish hands events to every subscriber they match.
+func (h *Hub) Publish(events ...influxdb.BasicEvent) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for s := range h.subscribers {
+		for _, event := range events {
+			if !s.query.Matches(event) {
+				continue
+			}
+			select {
+			case s.events <- event:
+			default:
+				s.dropped.Add(1)
+			}
+		}
+	}
+}
+
+// Close ends all subscriptions, their event channels are closed.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	h.closed = true
+	close(h.done)
+	for s := range h.subscribers {
+		delete(h.subscribers, s)
+		s.closeOnce.Do(func() { close(s.events) })
+	}
+}
+
+// Done returns a channel which is closed when the hub is shut down.
+func (h *Hub) Done() <-chan struct{} {
+	return h.done
+}
+
+// Events returns the channel of matching events. It is closed when the subscription or hub is closed.
+func (s *Subscription) Events() <-chan influxdb.BasicEvent {
+	return s.events
+}
+
+// Dropped returns the number of events dropped because the subscriber didn't keep up.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close removes the subscription from the hub.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	delete(s.hub.subscribers, s)
+	s.closeOnce.Do(func() { close(s.events) })
+}
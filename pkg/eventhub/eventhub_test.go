@@ -0,0 +1,110 @@
+package eventhub
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/eventquery"
+	"github.com/rubinda/logtopus/pkg/influxdb"
+)
+
+// subscribe subscribes to events matching the filter.
+func subscribe(t *testing.T, h *Hub, filter map[string]any) *Subscription {
+	t.Helper()
+	query, err := eventquery.ParseFilter(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h.Subscribe(query)
+}
+
+// publish publishes events with the given IDs and fails when Publish blocks.
+func publish(t *testing.T, h *Hub, ids ...string) {
+	t.Helper()
+	events := make([]influxdb.BasicEvent, len(ids))
+	for i, id := range ids {
+		events[i] = influxdb.BasicEvent{EventId: id, EntityId: "plex001", EntityType: "mediaServer", EventType: "log", Timestamp: time.Now()}
+	}
+	done := make(chan struct{})
+	go func() {
+		h.Publish(events...)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publish blocked")
+	}
+}
+
+// received returns the IDs of buffered events, without waiting for more.
+func received(s *Subscription) []string {
+	ids := make([]string, 0)
+	for {
+		select {
+		case event, ok := <-s.Events():
+			if !ok {
+				return ids
+			}
+			ids = append(ids, event.EventId)
+		default:
+			return ids
+		}
+	}
+}
+
+// TestSlowSubscriber drops events for a subscriber which doesn't keep up, without blocking Publish or other subscribers.
+func TestSlowSubscriber(t *testing.T) {
+	h := New(2)
+	defer h.Close()
+	slow := subscribe(t, h, map[string]any{})
+	filtered := subscribe(t, h, map[string]any{influxdb.EventIdFieldName: "5"})
+	publish(t, h, "1", "2", "3", "4", "5")
+	if ids := received(slow); len(ids) != 2 || ids[0] != "1" || ids[1] != "2" {
+		t.Errorf("expected the buffered events 1 and 2, got %v", ids)
+	}
+	if dropped := slow.Dropped(); dropped != 3 {
+		t.Errorf("expected 3 dropped events, got %d", dropped)
+	}
+	if ids := received(filtered); len(ids) != 1 || ids[0] != "5" || filtered.Dropped() != 0 {
+		t.Errorf("expected the matching event 5 without drops, got %v (%d dropped)", ids, filtered.Dropped())
+	}
+	// Once the subscriber caught up, it receives events again
+	publish(t, h, "6")
+	if ids := received(slow); len(ids) != 1 || ids[0] != "6" {
+		t.Errorf("expected event 6 after catching up, got %v", ids)
+	}
+}
+
+// TestClose closes the event channels of closed subscriptions and of all subscriptions when the hub is closed.
+// Publishing afterwards doesn't panic and doesn't reach closed subscriptions.
+func TestClose(t *testing.T) {
+	h := New(4)
+	unsubscribed := subscribe(t, h, map[string]any{})
+	open := subscribe(t, h, map[string]any{})
+	unsubscribed.Close()
+	unsubscribed.Close()
+	publish(t, h, "1")
+	if _, ok := <-unsubscribed.Events(); ok {
+		t.Errorf("expected the events channel of a closed subscription to be closed")
+	}
+	if ids := received(open); len(ids) != 1 {
+		t.Errorf("expected event 1 on the open subscription, got %v", ids)
+	}
+
+	h.Close()
+	h.Close()
+	select {
+	case <-h.Done():
+	default:
+		t.Errorf("expected Done to be closed")
+	}
+	publish(t, h, "2")
+	if _, ok := <-open.Events(); ok {
+		t.Errorf("expected the events channel to be closed with the hub")
+	}
+	open.Close()
+	if _, ok := <-subscribe(t, h, map[string]any{}).Events(); ok {
+		t.Errorf("expected subscriptions of a closed hub to be closed")
+	}
+}
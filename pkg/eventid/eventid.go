@@ -0,0 +1,162 @@
+package eventid
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// crockford is the Crockford's base32 alphabet used by ULIDs.
+const crockford string = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// New returns a ULID (https://github.com/ulid/spec) for the given time: 48 bits of Unix milliseconds followed by 80
+// random bits, encoded as 26 characters. IDs sort by time (with millisecond precision).
+func New(t time.Time) string {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(t.UnixMilli())<<16)
+	// crypto/rand doesn't fail on supported platforms
+	_, _ = rand.Read(b[6:])
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	var encoded [26]byte
+	for i := len(encoded) - 1; i >= 0; i-- {
+		encoded[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(encoded[:])
+}
+
+// Time returns the time encoded in a ULID with millisecond precision, false when the ID isn't a ULID.
+func Time(id string) (time.Time, bool) {
+	if len(id) != 26 || id[0] > '7' {
+		// The first character only holds 3 bits
+		return time.Time{}, false
+	}
+	var ms uint64
+	for i := 0; i < len(id); i++ {
+		value := strings.IndexByte(crockford, byte(unicode.ToUpper(rune(id[i]))))
+		if value < 0 {
+			return time.Time{}, false
+		}
+		if i < 10 {
+			ms = ms<<5 | uint64(value)
+		}
+	}
+	return time.UnixMilli(int64(ms)), true
+}
+
+// Status is the state of an event ID in a Window.
+type Status int
+
+const (
+	// Reserved means the ID was reserved for the caller, who stores the event and commits or releases the ID.
+	Reserved Status = iota
+	// Pending means an event with the ID is being stored, its write may still fail.
+	Pending
+	// Stored means an event with the ID was stored.
+	Stored
+)
+
+// reservation is an event ID reserved by a scope, remembered until it expires.
+type reservation struct {
+	// scope separates IDs of different clients, so one can't suppress events of another.
+	scope string
+	// id is the event ID.
+	id string
+	// expires is the time the ID is forgotten.
+	expires time.Time
+	// stored is set once the event was stored.
+	stored bool
+}
+
+// Window remembers event IDs for a fixed duration, so retried events can be recognized as duplicates.
+type Window struct {
+	// mu guards reserved and queue.
+	mu sync.Mutex
+	// duration is how long IDs are remembered, zero disables deduplication.
+	duration time.Duration
+	// reserved contains the current reservation of each ID by scope.
+	reserved map[string]map[string]*reservation
+	// queue contains reservations in the order they were made, so expired IDs are removed oldest first.
+	queue []*reservation
+}
+
+// NewWindow returns a window remembering IDs for the duration. With a zero duration every ID is reserved.
+func NewWindow(duration time.Duration) *Window {
+	return &Window{duration: duration, reserved: make(map[string]map[string]*reservation)}
+}
+
+// Reserve reserves the ID in the scope when it isn't already, otherwise returns whether the event with the ID is
+// still being stored or was stored inside the window (a duplicate).
+func (w *Window) Reserve(scope, id string, now time.Time) Status {
+	if w.duration <= 0 {
+		return Reserved
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.expire(now)
+	if r, ok := w.reserved[id][scope]; ok && r.stored {
+		return Stored
+	} else if ok {
+		return Pending
+	}
+	r := &reservation{scope: scope, id: id, expires: now.Add(w.duration)}
+	if w.reserved[id] == nil {
+		w.reserved[id] = make(map[string]*reservation)
+	}
+	w.reserved[id][scope] = r
+	w.queue = append(w.queue, r)
+	return Reserved
+}
+
+// Commit marks the IDs reserved in the scope as stored. Reservations of the same IDs in other scopes stay pending,
+// their events are stored (or not) by other requests.
+func (w *Window) Commit(scope string, ids ...string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, id := range ids {
+		if r, ok := w.reserved[id][scope]; ok {
+			r.stored = true
+		}
+	}
+}
+
+// Release forgets IDs pending in the scope, e.g. after storing their events failed, so a retry isn't considered a
+// duplicate.
+func (w *Window) Release(scope string, ids ...string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, id := range ids {
+		if r, ok := w.reserved[id][scope]; ok && !r.stored {
+			w.forget(r)
+		}
+	}
+}
+
+// expire forgets IDs reserved before the window. Has to be called with mu held.
+func (w *Window) expire(now time.Time) {
+	expired := 0
+	for _, r := range w.queue {
+		if r.expires.After(now) {
+			break
+		}
+		// Released and reserved again, the newer reservation is further in the queue
+		if w.reserved[r.id][r.scope] == r {
+			w.forget(r)
+		}
+		expired++
+	}
+	// The backing array is reallocated (without expired entries) as the queue grows
+	w.queue = w.queue[expired:]
+}
+
+// forget removes the reservation. Has to be called with mu held.
+func (w *Window) forget(r *reservation) {
+	delete(w.reserved[r.id], r.scope)
+	if len(w.reserved[r.id]) == 0 {
+		delete(w.reserved, r.id)
+	}
+}
@@ -0,0 +1,55 @@
+package eventid
+
+import (
+	"testing"
+	"time"
+)
+
+// TestTime makes sure the time of generated IDs is decoded and other IDs are recognized.
+func TestTime(t *testing.T) {
+	now := time.UnixMilli(1675626186159)
+	if decoded, ok := Time(New(now)); !ok || !decoded.Equal(now) {
+		t.Errorf("expected %s, got %s (%t)", now, decoded, ok)
+	}
+	for _, id := range []string{"", "KEY-0", "81GRHE9N2FQ4ZB1R9D4TW6V8XK", "01GRHE9N2FQ4ZB1R9D4TW6V8XU"} {
+		if _, ok := Time(id); ok {
+			t.Errorf("%q: expected not to be a ULID", id)
+		}
+	}
+}
+
+// TestWindow goes through the states of an event ID, which are kept apart for each scope.
+func TestWindow(t *testing.T) {
+	now := time.Now()
+	w := NewWindow(time.Minute)
+	steps := []struct {
+		name   string
+		scope  string
+		do     func()
+		at     time.Duration
+		status Status
+	}{
+		{"first", "a", nil, 0, Reserved},
+		{"retry while pending", "a", nil, 0, Pending},
+		{"other scope", "b", nil, 0, Reserved},
+		{"retry after release", "a", func() { w.Release("a", "id") }, 0, Reserved},
+		{"other scope after release", "b", nil, 0, Pending},
+		{"retry after commit", "a", func() { w.Commit("a", "id") }, time.Second, Stored},
+		{"other scope after commit", "b", nil, time.Second, Pending},
+		{"release after commit", "a", func() { w.Release("a", "id") }, time.Second, Stored},
+		{"other scope after own release", "b", func() { w.Release("b", "id") }, time.Second, Reserved},
+		{"other scope after own commit", "b", func() { w.Commit("b", "id") }, time.Second, Stored},
+		{"retry after window", "a", nil, time.Minute, Reserved},
+	}
+	for _, step := range steps {
+		if step.do != nil {
+			step.do()
+		}
+		if status := w.Reserve(step.scope, "id", now.Add(step.at)); status != step.status {
+			t.Errorf("%s: expected status %d, got %d", step.name, step.status, status)
+		}
+	}
+	if status := NewWindow(0).Reserve("a", "id", now); status != Reserved {
+		t.Errorf("disabled window: expected status %d, got %d", Reserved, status)
+	}
+}
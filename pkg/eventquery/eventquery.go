@@ -0,0 +1,439 @@
+package eventquery
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/influxdb"
+	"github.com/rubinda/logtopus/pkg/parseutils"
+)
+
+// Query is a parsed "/query/events" payload for storage backends that don't speak Flux.
+// It follows the semantics of the InfluxDB backend.
+type Query struct {
+	// Start is the (inclusive) beginning of the time range.
+	Start time.Time
+	// Stop is the (exclusive) end of the time range.
+	Stop time.Time
+	// TimeField is the time the range applies to, timestamp (when empty) or receivedAt.
+	TimeField string
+	// Filter contains conditions on event values.
+	Filter influxdb.Filter
+	// Page describes ordering and the returned part of matching events.
+	Page influxdb.Pagination
+	// patterns contains compiled regular expressions used by the filter.
+	patterns map[string]*regexp.Regexp
+}
+
+// Parse converts the query fields to a Query. See influxdb.ParseTimeRange for accepted "_timeFrom" and "_timeTo" values,
+// which apply to the time selected by "_timeField". "timestamp" is ignored. Given map is modified.
+func Parse(queryFields map[string]any, now time.Time) (Query, error) {
+	page, err := influxdb.ParsePagination(queryFields)
+	if err != nil {
+		return Query{}, err
+	}
+	timeField, err := influxdb.ParseTimeField(queryFields)
+	if err != nil {
+		return Query{}, err
+	}
+	start, stop, err := influxdb.ParseTimeRange(queryFields, now)
+	if err != nil {
+		return Query{}, err
+	}
+	// Ignore timestamp field
+	parseutils.Pop(queryFields, influxdb.TimestampFieldName)
+	filter, err := influxdb.ParseFilter(queryFields)
+	if err != nil {
+		return Query{}, err
+	}
+	patterns := make(map[string]*regexp.Regexp)
+	compilePatterns(filter, patterns)
+	return Query{start, stop, timeField, filter, page, patterns}, nil
+}
+
+// Paginate orders matching events and returns the requested page.
+func (q Query) Paginate(events []influxdb.BasicEvent) influxdb.QueryResult {
+	positions := make([]influxdb.PagePosition, len(events))
+	for i, event := range events {
+		positions[i] = q.Page.Position(event)
+	}
+	sort.Stable(byPosition{events, positions, q.Page.Descending})
+	first := 0
+	if q.Page.After != nil {
+		first = sort.Search(len(events), func(i int) bool {
+			order := comparePositions(positions[i], *q.Page.After)
+			if q.Page.Descending {
+				return order < 0
+			}
+			return order > 0
+		})
+	}
+	end := first + q.Page.Limit + 1
+	if end > len(events) {
+		end = len(events)
+	}
+	return q.Page.Result(events[first:end])
+}
+
+// byPosition orders events by their positions (see influxdb.PagePosition).
+type byPosition struct {
+	// events are the ordered events.
+	events []influxdb.BasicEvent
+	// positions contains the position of each event.
+	positions []influxdb.PagePosition
+	// descending reverses the order.
+	descending bool
+}
+
+// Len returns the number of events.
+func (s byPosition) Len() int { return len(s.events) }
+
+// Less checks if event i is ordered before event j.
+func (s byPosition) Less(i, j int) bool {
+	order := comparePositions(s.positions[i], s.positions[j])
+	if s.descending {
+		return order > 0
+	}
+	return order < 0
+}
+
+// Swap swaps events i and j.
+func (s byPosition) Swap(i, j int) {
+	s.events[i], s.events[j] = s.events[j], s.events[i]
+	s.positions[i], s.positions[j] = s.positions[j], s.positions[i]
+}
+
+// comparePositions orders positions by their sort field values, then by timestamp, then by event identifier. Missing
+// values are considered smallest, same as null values in Flux, false is considered smaller than true.
+func comparePositions(a, b influxdb.PagePosition) int {
+	order := 0
+	switch {
+	case a.Value == nil && b.Value != nil:
+		order = -1
+	case a.Value != nil && b.Value == nil:
+		order = 1
+	case a.Value != nil:
+		if av, ok := a.Value.(bool); ok {
+			if bv, ok := b.Value.(bool); ok && av != bv {
+				order = 1
+				if bv {
+					order = -1
+				}
+			}
+		} else {
+			order, _ = compare(a.Value, b.Value)
+		}
+	}
+	if order == 0 {
+		order = a.Timestamp.Compare(b.Timestamp)
+	}
+	if order == 0 {
+		order = strings.Compare(a.EventId, b.EventId)
+	}
+	return order
+}
+
+// compilePatterns compiles regular expressions of all "$regex" conditions in the filter.
+func compilePatterns(f influxdb.Filter, patterns map[string]*regexp.Regexp) {
+	if f.Operator == influxdb.OpRegex {
+		pattern := f.Value.(string)
+		// Patterns are validated when parsing the filter
+		patterns[pattern] = regexp.MustCompile(pattern)
+	}
+	for _, sub := range f.Filters {
+		compilePatterns(sub, patterns)
+	}
+}
+
+// InRange checks if the timestamp is inside the query time range.
+func (q Query) InRange(t time.Time) bool {
+	return !t.Before(q.Start) && t.Before(q.Stop)
+}
+
+// Matches checks if the event is inside the time range and satisfies the query filter.
+func (q Query) Matches(event influxdb.BasicEvent) bool {
+	t := event.Timestamp
+	if q.TimeField == influxdb.ReceivedAtFieldName {
+		t = event.ReceivedAt
+	}
+	return q.InRange(t) && q.evaluate(q.Filter, event)
+}
+
+// evaluate checks if the event satisfies the filter. Conditions on missing fields never match (except "$exists": false),
+// same as null values in Flux.
+func (q Query) evaluate(f influxdb.Filter, event influxdb.BasicEvent) bool {
+	switch f.Operator {
+	case influxdb.OpAnd:
+		for _, sub := range f.Filters {
+			if !q.evaluate(sub, event) {
+				return false
+			}
+		}
+		return true
+	case influxdb.OpOr:
+		for _, sub := range f.Filters {
+			if q.evaluate(sub, event) {
+				return true
+			}
+		}
+		return false
+	}
+	eventValue, ok := influxdb.FieldValue(event, f.Field)
+	if f.Operator == influxdb.OpExists {
+		return ok == f.Value.(bool)
+	}
+	if !ok {
+		return false
+	}
+	switch f.Operator {
+	case influxdb.OpEq:
+		return ValuesEqual(eventValue, f.Value)
+	case influxdb.OpNe:
+		return !ValuesEqual(eventValue, f.Value)
+	case influxdb.OpIn, influxdb.OpNin:
+		found := false
+		for _, value := range f.Value.([]any) {
+			found = found || ValuesEqual(eventValue, value)
+		}
+		return found == (f.Operator == influxdb.OpIn)
+	case influxdb.OpRegex:
+		str, ok := eventValue.(string)
+		return ok && q.patterns[f.Value.(string)].MatchString(str)
+	}
+	order, ok := compare(eventValue, f.Value)
+	if !ok {
+		return false
+	}
+	switch f.Operator {
+	case influxdb.OpGt:
+		return order > 0
+	case influxdb.OpGte:
+		return order >= 0
+	case influxdb.OpLt:
+		return order < 0
+	case influxdb.OpLte:
+		return order <= 0
+	}
+	return false
+}
+
+// compare orders two values of the same kind (numbers or strings). Returns false when the values can't be compared.
+func compare(a, b any) (int, bool) {
+	if av, ok := a.(float64); ok {
+		if bv, ok := b.(float64); ok {
+			switch {
+			case av < bv:
+				return -1, true
+			case av > bv:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	if an, ok := exactNumber(a); ok {
+		bn, ok := exactNumber(b)
+		if !ok {
+			return 0, false
+		}
+		return an.Cmp(bn), true
+	}
+	if av, ok := a.(string); ok {
+		bv, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(av, bv), true
+	}
+	return 0, false
+}
+
+// exactNumber converts a numeric value (decoded from JSON or read from a backend) to an exact rational, so integers
+// beyond float64 precision are compared correctly.
+func exactNumber(value any) (*big.Rat, bool) {
+	switch v := value.(type) {
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return nil, false
+		}
+		return new(big.Rat).SetFloat64(v), true
+	case json.Number:
+		return new(big.Rat).SetString(v.String())
+	case int64:
+		return new(big.Rat).SetInt64(v), true
+	case uint64:
+		return new(big.Rat).SetInt(new(big.Int).SetUint64(v)), true
+	}
+	return nil, false
+}
+
+// floatNumber converts a numeric value to float64, used for aggregation.
+func floatNumber(value any) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// ValuesEqual compares two JSON decoded values. Numbers are compared by value, complex values by their JSON encoding.
+func ValuesEqual(a, b any) bool {
+	switch a.(type) {
+	case string, bool:
+		return a == b
+	case float64, json.Number, int64, uint64:
+		order, ok := compare(a, b)
+		return ok && order == 0
+	}
+	aJSON, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bJSON, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return string(aJSON) == string(bJSON)
+}
+
+// aggregateBucket collects values of a single group in a single time bucket.
+type aggregateBucket struct {
+	group  map[string]any
+	time   time.Time
+	values []float64
+}
+
+// Aggregate summarizes events (which have to match the query) in the same way as the InfluxDB backend: values are
+// grouped by the groupBy fields and time buckets aligned to the Unix epoch, each point is timestamped with the end
+// of its bucket (or query range).
+func (q Query) Aggregate(events []influxdb.BasicEvent, aggregation influxdb.Aggregation) influxdb.AggregateResult {
+	buckets := make(map[string]*aggregateBucket)
+	keys := make([]string, 0)
+	for _, event := range events {
+		value := 1.0
+		if aggregation.Function != influxdb.AggregateCount {
+			fieldValue, _ := influxdb.FieldValue(event, aggregation.Field)
+			number, ok := floatNumber(fieldValue)
+			if !ok {
+				continue
+			}
+			value = number
+		}
+		group := make(map[string]any, len(aggregation.GroupBy))
+		for _, field := range aggregation.GroupBy {
+			group[field], _ = influxdb.FieldValue(event, field)
+		}
+		bucketTime := q.Stop
+		if aggregation.Interval > 0 {
+			bucketTime = windowStop(event.Timestamp, aggregation.Interval)
+			if bucketTime.After(q.Stop) {
+				bucketTime = q.Stop
+			}
+		}
+		key := fmt.Sprint(group, bucketTime.UnixNano())
+		bucket, ok := buckets[key]
+		if !ok {
+			bucket = &aggregateBucket{group: group, time: bucketTime}
+			buckets[key] = bucket
+			keys = append(keys, key)
+		}
+		bucket.values = append(bucket.values, value)
+	}
+	builder := influxdb.NewSeriesBuilder(aggregation)
+	for _, key := range keys {
+		bucket := buckets[key]
+		builder.Add(bucket.group, bucket.time, aggregateValues(bucket.values, aggregation))
+	}
+	return builder.Result()
+}
+
+// windowStop returns the end of the time window containing t, with windows aligned to the Unix epoch.
+func windowStop(t time.Time, interval time.Duration) time.Time {
+	ns := t.UnixNano()
+	start := ns - ns%int64(interval)
+	if ns%int64(interval) < 0 {
+		start -= int64(interval)
+	}
+	return time.Unix(0, start+int64(interval)).UTC()
+}
+
+// aggregateValues applies the aggregate function to a non-empty list of values.
+func aggregateValues(values []float64, aggregation influxdb.Aggregation) float64 {
+	switch aggregation.Function {
+	case influxdb.AggregateCount:
+		return float64(len(values))
+	case influxdb.AggregateSum, influxdb.AggregateMean:
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		if aggregation.Function == influxdb.AggregateMean {
+			return sum / float64(len(values))
+		}
+		return sum
+	case influxdb.AggregateMin:
+		result := values[0]
+		for _, v := range values[1:] {
+			if v < result {
+				result = v
+			}
+		}
+		return result
+	case influxdb.AggregateMax:
+		result := values[0]
+		for _, v := range values[1:] {
+			if v > result {
+				result = v
+			}
+		}
+		return result
+	}
+	// Percentile, the smallest value with at least the given share of values being smaller or equal (exact selector)
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	i := int(math.Ceil(aggregation.Percentile/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// ParseFilter converts the query fields to a Query for live events, which only checks conditions on event values.
+// Time range and pagination attributes aren't supported, "timestamp" is ignored. Given map is modified.
+func ParseFilter(queryFields map[string]any) (Query, error) {
+	problems := make([]influxdb.ModelError, 0)
+	for _, tag := range []string{influxdb.QueryRangeStartTag, influxdb.QueryRangeStopTag, influxdb.QueryTimeFieldTag, influxdb.QueryLimitTag, influxdb.QuerySortTag, influxdb.QueryCursorTag} {
+		if _, ok := queryFields[tag]; ok {
+			problems = append(problems, influxdb.ModelError{Field: tag, Message: "not supported for live events"})
+		}
+	}
+	if len(problems) > 0 {
+		return Query{}, &influxdb.QueryError{Problems: problems}
+	}
+	// Ignore timestamp field
+	parseutils.Pop(queryFields, influxdb.TimestampFieldName)
+	filter, err := influxdb.ParseFilter(queryFields)
+	if err != nil {
+		return Query{}, err
+	}
+	patterns := make(map[string]*regexp.Regexp)
+	compilePatterns(filter, patterns)
+	return Query{
+		Start:    time.Unix(0, math.MinInt64),
+		Stop:     time.Unix(0, math.MaxInt64),
+		Filter:   filter,
+		patterns: patterns,
+	}, nil
+}
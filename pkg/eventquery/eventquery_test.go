@@ -0,0 +1,59 @@
+package eventquery
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/influxdb"
+)
+
+// TestPaginate walks through pages with cursors and makes sure every event is returned once, also when events are
+// stored before the current page in the meantime or share their sort value and timestamp across a page boundary.
+func TestPaginate(t *testing.T) {
+	base := time.Date(2023, 2, 5, 19, 43, 6, 0, time.UTC)
+	event := func(id string, seconds int, severity any) influxdb.BasicEvent {
+		details := map[string]any{}
+		if severity != nil {
+			details["severity"] = severity
+		}
+		return influxdb.BasicEvent{EventId: id, EntityId: "a", EntityType: "server", EventType: "log", Timestamp: base.Add(time.Duration(seconds) * time.Second), EventDetails: details}
+	}
+	for _, sort := range []string{"timestamp", "timestamp:desc", "severity", "severity:desc"} {
+		events := []influxdb.BasicEvent{
+			event("1", 1, json.Number("3")), event("2", 2, json.Number("1")), event("3", 3, nil),
+			event("4", 4, json.Number("3")), event("5", 5, json.Number("2")), event("6", 6, nil),
+			// Ties of three events, so each spans a page boundary
+			event("a", 8, json.Number("5")), event("c", 8, json.Number("5")), event("b", 8, json.Number("5")),
+			event("d", 9, nil), event("f", 9, nil), event("e", 9, nil),
+		}
+		seen := make(map[string]int)
+		cursor := ""
+		for page := 0; page < 10; page++ {
+			params := map[string]any{influxdb.QueryLimitTag: float64(2), influxdb.QuerySortTag: sort, influxdb.QueryRangeStartTag: "2023-01-01T00:00:00Z"}
+			if cursor != "" {
+				params[influxdb.QueryCursorTag] = cursor
+			}
+			query, err := Parse(params, base.Add(time.Hour))
+			if err != nil {
+				t.Fatalf("%s: %s", sort, err)
+			}
+			result := query.Paginate(append([]influxdb.BasicEvent(nil), events...))
+			for _, e := range result.Events {
+				seen[e.EventId]++
+			}
+			if page == 0 {
+				// Events stored meanwhile mustn't shift the following pages
+				events = append(events, event("0", 0, nil), event("7", 7, json.Number("9")))
+			}
+			if cursor = result.NextCursor; cursor == "" {
+				break
+			}
+		}
+		for _, id := range []string{"1", "2", "3", "4", "5", "6", "a", "b", "c", "d", "e", "f"} {
+			if seen[id] != 1 {
+				t.Errorf("%s: event %s returned %d times", sort, id, seen[id])
+			}
+		}
+	}
+}
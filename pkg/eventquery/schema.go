@@ -0,0 +1,46 @@
+package eventquery
+
+import (
+	"sort"
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/influxdb"
+)
+
+// TimeRange returns a query matching every event in the time range.
+func TimeRange(start, stop time.Time) Query {
+	return Query{Start: start, Stop: stop, Filter: influxdb.Filter{Operator: influxdb.OpAnd}}
+}
+
+// DistinctValues lists distinct values of entityType, eventType or entityId of the events, in the same way as the
+// InfluxDB backend.
+func DistinctValues(events []influxdb.BasicEvent, field string) ([]string, error) {
+	switch field {
+	case influxdb.MeasurementFieldName, influxdb.EventTypeFieldName, influxdb.EntityIdFieldName:
+	default:
+		return nil, influxdb.ErrUnknownSchemaField
+	}
+	seen := make(map[string]bool)
+	values := make([]string, 0)
+	for _, event := range events {
+		value, _ := influxdb.FieldValue(event, field)
+		if str := value.(string); !seen[str] {
+			seen[str] = true
+			values = append(values, str)
+		}
+	}
+	sort.Strings(values)
+	return values, nil
+}
+
+// DetailFields lists detail field keys of the events with the types their values are stored as. Nested values are
+// listed by their path, since they can be queried by it.
+func DetailFields(events []influxdb.BasicEvent) []influxdb.DetailField {
+	collector := influxdb.NewDetailFieldCollector()
+	for _, event := range events {
+		for key, value := range influxdb.FlattenDetails(event.EventDetails) {
+			collector.Add(key, influxdb.FieldType(value))
+		}
+	}
+	return collector.Result()
+}
@@ -0,0 +1,315 @@
+package filestore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/eventquery"
+	"github.com/rubinda/logtopus/pkg/influxdb"
+)
+
+// ErrCorruptFile is returned when a stored record can't be decoded.
+var ErrCorruptFile = fmt.Errorf("corrupt event store file")
+
+// indexedFields are query field names which have an index (besides time).
+var indexedFields = []string{influxdb.MeasurementFieldName, influxdb.EntityIdFieldName, influxdb.EventTypeFieldName, influxdb.EventIdFieldName}
+
+// record locates a single stored event inside the file.
+type record struct {
+	// offset is the position of the record in the file.
+	offset int64
+	// length is the size of the encoded record (without the trailing newline).
+	length int
+	// timestamp is the event time, kept in memory for range lookups.
+	timestamp time.Time
+}
+
+// Store persists events to a single append-only file of newline delimited JSON records.
+// Indexes for time, entityType, entityId, eventType and eventId are kept in memory and rebuilt when the file is opened.
+type Store struct {
+	// mu guards the file and indexes.
+	mu sync.RWMutex
+	// file is the append-only data file.
+	file *os.File
+	// size is the offset where the next record is written.
+	size int64
+	// records contains every stored record in insertion order.
+	records []record
+	// byTime contains record positions sorted by event time.
+	byTime []int
+	// byField maps an indexed field name to its values and the positions of records with such value.
+	byField map[string]map[string][]int
+}
+
+// Open opens (or creates) the data file at given path and rebuilds indexes from its content.
+// A partially written record at the end of the file (e.g. after a crash) is discarded.
+func Open(path string) (*Store, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{
+		file:    file,
+		records: make([]record, 0),
+		byTime:  make([]int, 0),
+		byField: make(map[string]map[string][]int),
+	}
+	for _, field := range indexedFields {
+		s.byField[field] = make(map[string][]int)
+	}
+	if err := s.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads every record in the file and adds it to the indexes.
+func (s *Store) load() error {
+	reader := bufio.NewReader(s.file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("[WARNING] Discarding incomplete record at the end of %s (offset %d)\n", s.file.Name(), offset)
+				if err := s.file.Truncate(offset); err != nil {
+					return err
+				}
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var event influxdb.BasicEvent
+		if err := json.Unmarshal(line, &event); err != nil {
+			return fmt.Errorf("%w: offset %d: %s", ErrCorruptFile, offset, err)
+		}
+		s.index(record{offset, len(line) - 1, event.Timestamp}, event)
+		offset += int64(len(line))
+	}
+	s.size = offset
+	return nil
+}
+
+// index adds a record to the in-memory indexes.
+func (s *Store) index(r record, event influxdb.BasicEvent) {
+	position := len(s.records)
+	s.records = append(s.records, r)
+	// Keep insertion order for equal timestamps
+	i := sort.Search(len(s.byTime), func(i int) bool {
+		return s.records[s.byTime[i]].timestamp.After(r.timestamp)
+	})
+	s.byTime = append(s.byTime, 0)
+	copy(s.byTime[i+1:], s.byTime[i:])
+	s.byTime[i] = position
+	for _, field := range indexedFields {
+		value, _ := influxdb.FieldValue(event, field)
+		key := fmt.Sprint(value)
+		s.byField[field][key] = append(s.byField[field][key], position)
+	}
+}
+
+// StoreEvent appends the event to the data file and waits for it to be flushed to disk.
+func (s *Store) StoreEvent(eventData influxdb.BasicEvent) error {
+	return s.StoreEvents([]influxdb.BasicEvent{eventData})
+}
+
+// StoreEvents appends the events to the data file with a single write and waits for them to be flushed to disk.
+func (s *Store) StoreEvents(events []influxdb.BasicEvent) error {
+	var buf bytes.Buffer
+	stored := make([]influxdb.BasicEvent, len(events))
+	lengths := make([]int, len(events))
+	for i, eventData := range events {
+		details := make(map[string]any, len(eventData.EventDetails))
+		for key, value := range eventData.EventDetails {
+			// Null values are skipped, same as with InfluxDB
+			if value != nil {
+				details[key] = value
+			}
+		}
+		eventData.EventDetails = details
+		stored[i] = eventData
+		line, err := json.Marshal(eventData)
+		if err != nil {
+			return err
+		}
+		lengths[i] = len(line)
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.WriteAt(buf.Bytes(), s.size); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	for i, eventData := range stored {
+		s.index(record{s.size, lengths[i], eventData.Timestamp}, eventData)
+		s.size += int64(lengths[i]) + 1
+	}
+	return nil
+}
+
+// QueryEvents returns a page of events matching the query. See eventquery.Parse for the semantics.
+func (s *Store) QueryEvents(queryFields map[string]any) (influxdb.QueryResult, error) {
+	query, err := eventquery.Parse(queryFields, time.Now())
+	if err != nil {
+		return influxdb.QueryResult{}, err
+	}
+	events, err := s.matchingEvents(query)
+	if err != nil {
+		return influxdb.QueryResult{}, err
+	}
+	return query.Paginate(events), nil
+}
+
+// matchingEvents reads all events matching the query, using indexes to skip records which can't match.
+func (s *Store) matchingEvents(query eventquery.Query) ([]influxdb.BasicEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	candidates := s.fieldCandidates(query)
+	// Receive times aren't indexed, every record is read
+	byTimestamp := query.TimeField != influxdb.ReceivedAtFieldName
+	first := 0
+	if byTimestamp {
+		first = sort.Search(len(s.byTime), func(i int) bool {
+			return !s.records[s.byTime[i]].timestamp.Before(query.Start)
+		})
+	}
+	events := make([]influxdb.BasicEvent, 0)
+	for _, position := range s.byTime[first:] {
+		r := s.records[position]
+		if byTimestamp && !r.timestamp.Before(query.Stop) {
+			break
+		}
+		if candidates != nil && !candidates[position] {
+			continue
+		}
+		event, err := s.read(r)
+		if err != nil {
+			return nil, err
+		}
+		if query.Matches(event) {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// fieldCandidates returns positions of records matching the most selective indexed query field.
+// Returns nil when the query doesn't contain any indexed fields.
+func (s *Store) fieldCandidates(query eventquery.Query) map[int]bool {
+	var positions []int
+	found := false
+	equalities := query.Filter.Equalities()
+	for _, field := range indexedFields {
+		value, ok := equalities[field]
+		if !ok {
+			continue
+		}
+		str, ok := value.(string)
+		if !ok {
+			// Indexed fields are always strings, nothing can match
+			return map[int]bool{}
+		}
+		if p := s.byField[field][str]; !found || len(p) < len(positions) {
+			positions = p
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+	candidates := make(map[int]bool, len(positions))
+	for _, position := range positions {
+		candidates[position] = true
+	}
+	return candidates
+}
+
+// read decodes a single record from the data file.
+func (s *Store) read(r record) (influxdb.BasicEvent, error) {
+	var event influxdb.BasicEvent
+	buf := make([]byte, r.length)
+	if _, err := s.file.ReadAt(buf, r.offset); err != nil {
+		return event, err
+	}
+	if err := json.Unmarshal(buf, &event); err != nil {
+		return event, fmt.Errorf("%w: offset %d: %s", ErrCorruptFile, r.offset, err)
+	}
+	return event, nil
+}
+
+// AggregateEvents summarizes events matching the query. See eventquery.Query.Aggregate for the semantics.
+func (s *Store) AggregateEvents(queryFields map[string]any) (influxdb.AggregateResult, error) {
+	aggregation, err := influxdb.ParseAggregation(queryFields)
+	if err != nil {
+		return influxdb.AggregateResult{}, err
+	}
+	query, err := eventquery.Parse(queryFields, time.Now())
+	if err != nil {
+		return influxdb.AggregateResult{}, err
+	}
+	events, err := s.matchingEvents(query)
+	if err != nil {
+		return influxdb.AggregateResult{}, err
+	}
+	return query.Aggregate(events, aggregation), nil
+}
+
+// DistinctValues lists distinct values of entityType, eventType or entityId for events in the time range,
+// using the field indexes.
+func (s *Store) DistinctValues(field string, start, stop time.Time) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	index, ok := s.byField[field]
+	if !ok {
+		return nil, influxdb.ErrUnknownSchemaField
+	}
+	values := make([]string, 0)
+	for value, positions := range index {
+		for _, position := range positions {
+			if t := s.records[position].timestamp; !t.Before(start) && t.Before(stop) {
+				values = append(values, value)
+				break
+			}
+		}
+	}
+	sort.Strings(values)
+	return values, nil
+}
+
+// DetailFields lists detail field keys and their types for events in the time range, of all entity types when
+// entityType is empty.
+func (s *Store) DetailFields(entityType string, start, stop time.Time) ([]influxdb.DetailField, error) {
+	query := eventquery.TimeRange(start, stop)
+	if entityType != "" {
+		query.Filter = influxdb.Filter{Operator: influxdb.OpEq, Field: influxdb.MeasurementFieldName, Value: entityType}
+	}
+	events, err := s.matchingEvents(query)
+	if err != nil {
+		return nil, err
+	}
+	return eventquery.DetailFields(events), nil
+}
+
+// Disconnect closes the data file.
+func (s *Store) Disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.file.Close(); err != nil {
+		log.Printf("[WARNING] Closing event store file: %s\n", err)
+	}
+}
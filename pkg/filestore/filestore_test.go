@@ -0,0 +1,245 @@
+package filestore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/eventquery"
+	"github.com/rubinda/logtopus/pkg/influxdb"
+	"github.com/rubinda/logtopus/pkg/memstore"
+)
+
+// base is the time of the first test event.
+var base = time.Date(2023, 2, 5, 19, 43, 6, 159000000, time.UTC)
+
+// testEvents returns events of two entity types, some of them sharing a timestamp.
+func testEvents() []influxdb.BasicEvent {
+	events := make([]influxdb.BasicEvent, 0)
+	for i := 0; i < 12; i++ {
+		entityType, eventType := "mediaServer", "playback"
+		if i%3 == 0 {
+			entityType, eventType = "router", "reboot"
+		}
+		// Numbers are decoded as json.Number on ingestion
+		details := map[string]any{"severity": json.Number(fmt.Sprint(i % 5)), "cause": nil}
+		if i%4 == 0 {
+			details = map[string]any{"region": "eu"}
+		}
+		events = append(events, influxdb.BasicEvent{
+			EventId:      fmt.Sprintf("e%02d", i),
+			EntityId:     fmt.Sprintf("host%d", i%4),
+			EntityType:   entityType,
+			EventType:    eventType,
+			Timestamp:    base.Add(time.Duration(i/2) * time.Minute),
+			EventDetails: details,
+		})
+	}
+	return events
+}
+
+// openStore opens the store at path and closes it at the end of the test.
+func openStore(t *testing.T, path string) *Store {
+	t.Helper()
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Disconnect)
+	return s
+}
+
+// queryAll returns the identifiers of all stored events in timestamp order.
+func queryAll(t *testing.T, s *Store) []string {
+	t.Helper()
+	result, err := s.QueryEvents(map[string]any{influxdb.QueryRangeStartTag: "2023-01-01T00:00:00Z", influxdb.QueryRangeStopTag: "2024-01-01T00:00:00Z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, len(result.Events))
+	for i, e := range result.Events {
+		ids[i] = e.EventId
+	}
+	return ids
+}
+
+// TestReopen makes sure stored events are found again after the file is reopened, and later events are appended.
+func TestReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	events := testEvents()
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StoreEvents(events[:10]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StoreEvent(events[10]); err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprint(queryAll(t, s))
+	s.Disconnect()
+
+	s = openStore(t, path)
+	if ids := fmt.Sprint(queryAll(t, s)); ids != expected {
+		t.Errorf("expected %s after reopening, got %s", expected, ids)
+	}
+	if err := s.StoreEvent(events[11]); err != nil {
+		t.Fatal(err)
+	}
+	if ids := queryAll(t, s); len(ids) != 12 || ids[11] != "e11" {
+		t.Errorf("expected e11 to be appended, got %v", ids)
+	}
+}
+
+// TestTruncate discards a partially written record at the end of the file, but refuses a corrupt record before it.
+func TestTruncate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StoreEvents(testEvents()[:2]); err != nil {
+		t.Fatal(err)
+	}
+	s.Disconnect()
+	complete, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, append(complete, `{"eventId":"e02","entityId":"ho`...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != int64(len(complete)) {
+		t.Errorf("expected the file to be truncated to %d bytes, got %v (%v)", len(complete), info.Size(), err)
+	}
+	if err := s.StoreEvent(testEvents()[2]); err != nil {
+		t.Fatal(err)
+	}
+	s.Disconnect()
+	s = openStore(t, path)
+	if ids := fmt.Sprint(queryAll(t, s)); ids != "[e00 e01 e02]" {
+		t.Errorf("expected [e00 e01 e02], got %s", ids)
+	}
+
+	corrupt := filepath.Join(t.TempDir(), "events.jsonl")
+	if err := os.WriteFile(corrupt, append([]byte("{\"eventId\":\n"), complete...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(corrupt); !errors.Is(err, ErrCorruptFile) {
+		t.Errorf("expected %v, got %v", ErrCorruptFile, err)
+	}
+}
+
+// TestIndexLookup makes sure queries by indexed fields only read records with the value.
+func TestIndexLookup(t *testing.T) {
+	s := openStore(t, filepath.Join(t.TempDir(), "events.jsonl"))
+	if err := s.StoreEvents(testEvents()); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		filter     map[string]any
+		candidates int
+		ids        string
+	}{
+		{map[string]any{influxdb.MeasurementFieldName: "router"}, 4, "[e00 e03 e06 e09]"},
+		{map[string]any{influxdb.EventIdFieldName: "e07"}, 1, "[e07]"},
+		// The most selective index is used
+		{map[string]any{influxdb.MeasurementFieldName: "mediaServer", influxdb.EventIdFieldName: "e07"}, 1, "[e07]"},
+		{map[string]any{influxdb.MeasurementFieldName: "router", influxdb.EntityIdFieldName: "host1"}, 3, "[e09]"},
+		{map[string]any{influxdb.EventIdFieldName: "missing"}, 0, "[]"},
+		{map[string]any{influxdb.EventIdFieldName: float64(7)}, 0, "[]"},
+		{map[string]any{"severity": float64(2)}, -1, "[e02 e07]"},
+	}
+	for _, test := range tests {
+		params := map[string]any{influxdb.QueryRangeStartTag: "2023-01-01T00:00:00Z", influxdb.QueryRangeStopTag: "2024-01-01T00:00:00Z"}
+		for field, value := range test.filter {
+			params[field] = value
+		}
+		result, err := s.QueryEvents(params)
+		if err != nil {
+			t.Fatalf("%v: %s", test.filter, err)
+		}
+		ids := make([]string, len(result.Events))
+		for i, e := range result.Events {
+			ids[i] = e.EventId
+		}
+		if fmt.Sprint(ids) != test.ids {
+			t.Errorf("%v: expected %s, got %v", test.filter, test.ids, ids)
+		}
+		query, err := eventquery.Parse(params, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		candidates := s.fieldCandidates(query)
+		if (test.candidates < 0 && candidates != nil) || (test.candidates >= 0 && len(candidates) != test.candidates) {
+			t.Errorf("%v: expected %d candidates, got %v", test.filter, test.candidates, candidates)
+		}
+	}
+}
+
+// TestMatchesMemstore runs the same queries on the file and in-memory stores, which have to return the same results.
+func TestMatchesMemstore(t *testing.T) {
+	s := openStore(t, filepath.Join(t.TempDir(), "events.jsonl"))
+	mem := memstore.New()
+	events := testEvents()
+	for _, store := range []interface {
+		StoreEvents([]influxdb.BasicEvent) error
+	}{s, mem} {
+		if err := store.StoreEvents(events); err != nil {
+			t.Fatal(err)
+		}
+	}
+	payloads := []string{
+		`{"_timeFrom": "2023-01-01T00:00:00Z"}`,
+		`{"_timeFrom": "2023-02-05T19:45:00Z", "_timeTo": "2023-02-05T19:47:00Z"}`,
+		`{"_timeFrom": "2023-01-01T00:00:00Z", "entityType": "mediaServer", "severity": {"$gte": 2}}`,
+		`{"_timeFrom": "2023-01-01T00:00:00Z", "$or": [{"region": "eu"}, {"entityId": "host3"}]}`,
+		`{"_timeFrom": "2023-01-01T00:00:00Z", "eventType": {"$in": ["reboot"]}, "_sort": "timestamp:desc"}`,
+		`{"_timeFrom": "2023-01-01T00:00:00Z", "_sort": "severity:desc", "_limit": 3}`,
+		`{"_timeFrom": "2023-01-01T00:00:00Z", "severity": {"$exists": false}, "_limit": 2}`,
+	}
+	for _, payload := range payloads {
+		// Parameters are consumed by the query, each store gets its own
+		params := func(cursor string) map[string]any {
+			var params map[string]any
+			if err := json.Unmarshal([]byte(payload), &params); err != nil {
+				t.Fatal(err)
+			}
+			if cursor != "" {
+				params[influxdb.QueryCursorTag] = cursor
+			}
+			return params
+		}
+		// Follow the cursors, so every page is compared
+		cursor := ""
+		for page := 0; page < 10; page++ {
+			expected, err := mem.QueryEvents(params(cursor))
+			if err != nil {
+				t.Fatalf("%s: %s", payload, err)
+			}
+			result, err := s.QueryEvents(params(cursor))
+			if err != nil {
+				t.Fatalf("%s: %s", payload, err)
+			}
+			expectedJSON, _ := json.Marshal(expected)
+			resultJSON, _ := json.Marshal(result)
+			if string(resultJSON) != string(expectedJSON) {
+				t.Errorf("%s: expected\n%s\ngot\n%s", payload, expectedJSON, resultJSON)
+				break
+			}
+			if cursor = result.NextCursor; cursor == "" {
+				break
+			}
+		}
+	}
+}
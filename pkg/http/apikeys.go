@@ -0,0 +1,80 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/apikeys"
+)
+
+// apiKeysHandler handles the "/admin/apikeys" API endpoint requests.
+func (server *Server) apiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[%s] %s\n", r.Method, r.URL.Path)
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, http.StatusOK, apiKeyListResponse{server.apiKeys.List()})
+	case http.MethodPost:
+		server.handleAPIKeysPost(w, r)
+	default:
+		server.methodNotAllowed(w)
+	}
+}
+
+// handleAPIKeysPost mints an API key for an event source.
+func (server *Server) handleAPIKeysPost(w http.ResponseWriter, r *http.Request) {
+	var request createAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		jsonResponse(w, http.StatusBadRequest, errResponse{err.Error(), nil})
+		return
+	}
+	key, secret, problems, err := server.apiKeys.Create(request.Source, request.Scopes, request.Binding, request.ExpiresAt, time.Now())
+	if len(problems) > 0 {
+		jsonResponse(w, http.StatusBadRequest, errResponse{errBadRequestBody, problems})
+		return
+	}
+	if err != nil {
+		log.Printf("[WARNING] Can't save API key store: %s\n", err)
+		jsonResponse(w, http.StatusInternalServerError, errResponse{errSavingAPIKeys, nil})
+		return
+	}
+	jsonResponse(w, http.StatusCreated, createAPIKeyResponse{key, secret})
+}
+
+// apiKeyHandler handles the "/admin/apikeys/{id}" API endpoint requests.
+func (server *Server) apiKeyHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[%s] %s\n", r.Method, r.URL.Path)
+	id := strings.TrimPrefix(r.URL.Path, apiBasePath+"/admin/apikeys/")
+	switch r.Method {
+	case http.MethodGet:
+		key, err := server.apiKeys.Get(id)
+		if err != nil {
+			apiKeyErrorResponse(w, err)
+			return
+		}
+		jsonResponse(w, http.StatusOK, key)
+	case http.MethodDelete:
+		// Revoked keys are kept, so their use remains auditable
+		key, err := server.apiKeys.Revoke(id, time.Now())
+		if err != nil {
+			apiKeyErrorResponse(w, err)
+			return
+		}
+		jsonResponse(w, http.StatusOK, key)
+	default:
+		server.methodNotAllowed(w)
+	}
+}
+
+// apiKeyErrorResponse responds with the status matching an API key store error.
+func apiKeyErrorResponse(w http.ResponseWriter, err error) {
+	if errors.Is(err, apikeys.ErrNotFound) {
+		jsonResponse(w, http.StatusNotFound, errResponse{err.Error(), nil})
+		return
+	}
+	log.Printf("[WARNING] Can't save API key store: %s\n", err)
+	jsonResponse(w, http.StatusInternalServerError, errResponse{errSavingAPIKeys, nil})
+}
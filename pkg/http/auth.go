@@ -1,12 +1,14 @@
 package http
 
 import (
-	"crypto"
+	"errors"
 	"fmt"
-	"os"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/rubinda/logtopus/pkg/access"
+	"github.com/rubinda/logtopus/pkg/eventid"
 )
 
 // Error message for token validation.
@@ -16,71 +18,143 @@ var (
 	ErrTokenMalformed          error = fmt.Errorf("can't parse token")
 	ErrTokenEmpty              error = fmt.Errorf("token is empty")
 	ErrTokenMissing            error = fmt.Errorf(`missing "Token" in header`)
+	ErrUserDisabled            error = fmt.Errorf("user is disabled or was removed")
+	ErrAdminRequired           error = fmt.Errorf("admin privileges required")
+	ErrAuthorizationScheme     error = fmt.Errorf(`expected "Authorization: ApiKey KEY" header`)
+	ErrScopeRequired           error = fmt.Errorf("credentials lack the required scope")
+	ErrBindingNotAllowed       error = fmt.Errorf("credentials bound to entities can't access this endpoint")
+	ErrTokenRevoked            error = fmt.Errorf("token was revoked")
+	ErrUnknownKey              error = fmt.Errorf("token was signed with an unknown key")
+	ErrLogoutCredentials       error = fmt.Errorf(`expected a "Token" header or a refresh token`)
 )
 
 // eventSourceClaims represents JWT payload.
 type eventSourceClaims struct {
+	// IssuedTo is the username of the user the token was issued to.
 	IssuedTo string `json:"issuedTo"`
+	// Scopes are the scopes the token allows, limited to the current scopes of the user when it is used.
+	// Tokens issued before scopes existed don't have any, they allow the scopes of the user.
+	Scopes []string `json:"scopes,omitempty"`
+	// Binding limits the token to events of some entity types or entities.
+	access.Binding
+	// SessionId identifies the session the token was issued in, revoking the session revokes the token.
+	SessionId string `json:"sid,omitempty"`
 	jwt.RegisteredClaims
 }
 
-// JWTAuthority is a token issuer and validator.
+// RevocationList contains identifiers of revoked tokens and sessions.
+type RevocationList interface {
+	// IsRevoked reports whether the token or session identifier was revoked.
+	IsRevoked(id string) bool
+}
+
+// JWTAuthority is a token issuer and validator. Tokens are signed with the current signing key, and verified with
+// the key named by their "kid" header, so keys can be rotated while earlier tokens are still valid.
 type JWTAuthority struct {
-	privateKey crypto.PrivateKey
-	publicKey  crypto.PublicKey
+	// mu guards keys, which are replaced when reloaded.
+	mu sync.RWMutex
+	// keys contains the signing key and the keys tokens are verified with.
+	keys keySet
+	// load reads the keys from disk.
+	load func() (keySet, error)
+	// ttl is how long issued tokens are valid.
+	ttl time.Duration
+	// revocations rejects revoked tokens, nothing is revoked when nil.
+	revocations RevocationList
 }
 
-// NewJWTAuthority returns a new JWT token issuer and validator.
-func NewJWTAuthority(privateKeyFilePath, publicKeyFilePath string) (*JWTAuthority, error) {
-	keyBytes, err := os.ReadFile(privateKeyFilePath)
-	if err != nil {
-		return nil, err
-	}
-	pubKeyBytes, err := os.ReadFile(publicKeyFilePath)
-	if err != nil {
-		return nil, err
-	}
-	key, err := jwt.ParseEdPrivateKeyFromPEM(keyBytes)
-	if err != nil {
-		return nil, err
-	}
-	pubKey, err := jwt.ParseEdPublicKeyFromPEM(pubKeyBytes)
+// NewJWTAuthority returns a new JWT token issuer and validator with a single key pair, issuing tokens valid for ttl.
+// Tokens listed in revocations are rejected.
+func NewJWTAuthority(privateKeyFilePath, publicKeyFilePath string, ttl time.Duration, revocations RevocationList) (*JWTAuthority, error) {
+	return newJWTAuthority(func() (keySet, error) {
+		return loadKeyPair(privateKeyFilePath, publicKeyFilePath)
+	}, ttl, revocations)
+}
+
+// NewJWTAuthorityFromDir returns a new JWT token issuer and validator with the keys in a directory (see loadKeyDir),
+// issuing tokens valid for ttl. Tokens listed in revocations are rejected.
+func NewJWTAuthorityFromDir(keyDir string, ttl time.Duration, revocations RevocationList) (*JWTAuthority, error) {
+	return newJWTAuthority(func() (keySet, error) {
+		return loadKeyDir(keyDir)
+	}, ttl, revocations)
+}
+
+// newJWTAuthority returns a JWT token issuer and validator with the keys returned by load.
+func newJWTAuthority(load func() (keySet, error), ttl time.Duration, revocations RevocationList) (*JWTAuthority, error) {
+	keys, err := load()
 	if err != nil {
 		return nil, err
 	}
-	return &JWTAuthority{key, pubKey}, nil
+	return &JWTAuthority{keys: keys, load: load, ttl: ttl, revocations: revocations}, nil
 }
 
-// ValidateToken checks if given token is valid with our issuer. Returns error when token is invalid.
+// ValidateToken checks if given token is valid with our issuer and wasn't revoked. Returns error when token is invalid.
 func (jwtAuth *JWTAuthority) ValidateToken(tokenStr string) (*jwt.Token, error) {
 	if tokenStr == "" {
 		return nil, ErrTokenEmpty
 	}
-	token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) {
+	token, err := jwt.ParseWithClaims(tokenStr, &eventSourceClaims{}, func(t *jwt.Token) (interface{}, error) {
 		if _, ok := t.Method.(*jwt.SigningMethodEd25519); !ok {
 			return nil, ErrUnexpectedSigningMethod
 		}
-		return jwtAuth.publicKey, nil
+		jwtAuth.mu.RLock()
+		defer jwtAuth.mu.RUnlock()
+		// Tokens issued before keys had identifiers were signed with the only key there was
+		kid, ok := t.Header["kid"].(string)
+		if !ok {
+			return jwtAuth.keys.signing.public, nil
+		}
+		key, ok := jwtAuth.keys.verifying[kid]
+		if !ok {
+			return nil, ErrUnknownKey
+		}
+		return key, nil
 	})
-	if err != nil {
+	if errors.Is(err, ErrUnknownKey) {
+		return nil, ErrUnknownKey
+	} else if err != nil {
 		return nil, ErrTokenMalformed
 	}
 	if !token.Valid {
 		return nil, ErrTokenInvalid
 	}
+	if claims := tokenClaims(token); jwtAuth.revocations != nil {
+		// Tokens issued before tokens had identifiers can't be revoked, they expire on their own
+		if (claims.ID != "" && jwtAuth.revocations.IsRevoked(claims.ID)) || (claims.SessionId != "" && jwtAuth.revocations.IsRevoked(claims.SessionId)) {
+			return nil, ErrTokenRevoked
+		}
+	}
 	return token, nil
 }
 
-// IssueToken generates a new token for a given event source.
-func (jwtAuth *JWTAuthority) IssueToken(requestee string) (string, error) {
+// IssueToken generates a new token for a given event source in the session, allowing the scopes within the binding.
+func (jwtAuth *JWTAuthority) IssueToken(requestee string, scopes []string, binding access.Binding, sessionId string) (string, error) {
+	now := time.Now()
 	claims := eventSourceClaims{
 		requestee,
+		scopes,
+		binding,
+		sessionId,
 		jwt.RegisteredClaims{
-			// TODO:
-			//  - tokens shouldn't last this long for security concerns (replay attacks, hijacking etc.)
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(30 * time.Minute)),
+			// Short-lived, clients keep sessions alive with refresh tokens instead
+			ExpiresAt: jwt.NewNumericDate(now.Add(jwtAuth.ttl)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        eventid.New(now),
 		},
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
-	return token.SignedString(jwtAuth.privateKey)
+	jwtAuth.mu.RLock()
+	signing := jwtAuth.keys.signing
+	jwtAuth.mu.RUnlock()
+	token.Header["kid"] = signing.id
+	return token.SignedString(signing.private)
+}
+
+// tokenClaims returns the claims of a validated token.
+func tokenClaims(token *jwt.Token) *eventSourceClaims {
+	claims, ok := token.Claims.(*eventSourceClaims)
+	if !ok {
+		return &eventSourceClaims{}
+	}
+	return claims
 }
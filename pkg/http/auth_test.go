@@ -0,0 +1,69 @@
+package http
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/access"
+)
+
+// revocationSet is a RevocationList of fixed identifiers.
+type revocationSet map[string]bool
+
+// IsRevoked reports whether the identifier is in the set.
+func (set revocationSet) IsRevoked(id string) bool {
+	return set[id]
+}
+
+// TestValidateToken rejects tokens with a revoked identifier or session.
+func TestValidateToken(t *testing.T) {
+	dir := t.TempDir()
+	privateKeyPath, publicKeyPath := writeKeyPair(t, dir, "jwt")
+	revoked := revocationSet{}
+	jwtAuth, err := NewJWTAuthority(privateKeyPath, publicKeyPath, time.Hour, revoked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issue := func(sessionId string) string {
+		token, err := jwtAuth.IssueToken("alice", []string{access.ScopeQuery}, access.Binding{EntityIds: []string{"plex001"}}, sessionId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid, inSession, inRevokedSession, revokedToken := issue(""), issue("session-1"), issue("session-2"), issue("")
+	token, err := jwtAuth.ValidateToken(revokedToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked[tokenClaims(token).ID] = true
+	revoked["session-2"] = true
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"valid", valid, nil},
+		{"session", inSession, nil},
+		{"revoked session", inRevokedSession, ErrTokenRevoked},
+		{"revoked token", revokedToken, ErrTokenRevoked},
+		{"empty", "", ErrTokenEmpty},
+		{"malformed", "not.a.token", ErrTokenMalformed},
+		{"tampered", valid[:len(valid)-4] + "AAAA", ErrTokenMalformed},
+	}
+	for _, test := range tests {
+		token, err := jwtAuth.ValidateToken(test.token)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		claims := tokenClaims(token)
+		if claims.IssuedTo != "alice" || claims.ID == "" || len(claims.Scopes) != 1 || len(claims.EntityIds) != 1 {
+			t.Errorf("%s: unexpected claims %+v", test.name, claims)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/influxdb"
+	"golang.org/x/sync/singleflight"
+)
+
+// fieldTypesRetryInterval is how long events of an entity type are let through unchecked after its stored field
+// types couldn't be read, before reading them is tried again.
+const fieldTypesRetryInterval time.Duration = 30 * time.Second
+
+// loadFailure is a failed attempt to read stored field types.
+type loadFailure struct {
+	// err is the error reading the field types.
+	err error
+	// at is the time of the attempt.
+	at time.Time
+}
+
+// fieldTypeGuard detects detail values with a different type than values of the same field already stored for the
+// entity type. InfluxDB rejects such writes (field type conflict), with asynchronous writes the whole batch would be lost.
+type fieldTypeGuard struct {
+	// mu guards known and failures.
+	mu sync.Mutex
+	// loads reads stored field types of an entity type once for concurrent events.
+	loads singleflight.Group
+	// db is the storage backend existing field types are read from.
+	db EventStore
+	// known contains field types by entity type and field name, loaded once per entity type and extended with
+	// types of stored events.
+	known map[string]map[string]map[string]bool
+	// failures contains the latest failed load by entity type, so the storage backend isn't queried for every event.
+	failures map[string]loadFailure
+	// flatten checks values nested inside details as separate fields, the way they are stored.
+	flatten bool
+	// tags contains detail keys stored as tags, which take values of any type.
+	tags map[string]bool
+}
+
+// newFieldTypeGuard returns a guard which reads existing field types from the storage backend.
+func newFieldTypeGuard(db EventStore, flatten bool) *fieldTypeGuard {
+	g := &fieldTypeGuard{
+		db:       db,
+		known:    make(map[string]map[string]map[string]bool),
+		failures: make(map[string]loadFailure),
+		flatten:  flatten,
+		tags:     make(map[string]bool),
+	}
+	if checker, ok := db.(eventChecker); ok {
+		for _, key := range checker.TagKeys() {
+			g.tags[key] = true
+		}
+	}
+	return g
+}
+
+// check returns a problem for each detail value conflicting with the stored type of its field. Integers of fields
+// stored as floats are converted to floats, so clients don't have to write "4.0". When stored types can't be read
+// the event is let through, the storage backend reports conflicts itself.
+func (g *fieldTypeGuard) check(eventData *influxdb.BasicEvent) []influxdb.ModelError {
+	if eventData.EntityType == "" {
+		// Not a measurement, the storage backend rejects the event anyway
+		return nil
+	}
+	if err := g.load(eventData.EntityType); err != nil {
+		return nil
+	}
+	details := g.fields(eventData.EventDetails)
+	keys := make([]string, 0, len(details))
+	for key := range details {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	known := g.known[eventData.EntityType]
+	problems := make([]influxdb.ModelError, 0)
+	widened := make(map[string]bool)
+	for _, key := range keys {
+		fieldType := influxdb.FieldType(details[key])
+		types, ok := known[key]
+		// Tag values are stored as strings (see influxdb.TagValue)
+		if fieldType == "" || g.tags[key] || !ok || types[fieldType] {
+			continue
+		}
+		if types[influxdb.FieldTypeFloat] && (fieldType == influxdb.FieldTypeInteger || fieldType == influxdb.FieldTypeUnsigned) {
+			widened[key] = true
+			continue
+		}
+		problems = append(problems, influxdb.ModelError{
+			Field:   "details." + key,
+			Message: fmt.Sprintf("field type conflict, stored values are %s but got %s", storedTypes(types), fieldType),
+		})
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	if len(widened) > 0 {
+		g.widen(eventData.EventDetails, widened)
+	}
+	return nil
+}
+
+// record adds types of stored events to the known field types, so later events have to use the same types.
+func (g *fieldTypeGuard) record(events []influxdb.BasicEvent) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, eventData := range events {
+		known, ok := g.known[eventData.EntityType]
+		if !ok {
+			// Loaded with the first checked event of the entity type, including these
+			continue
+		}
+		for key, value := range g.fields(eventData.EventDetails) {
+			fieldType := influxdb.FieldType(value)
+			if fieldType == "" || g.tags[key] {
+				continue
+			}
+			if known[key] == nil {
+				known[key] = make(map[string]bool)
+			}
+			known[key][fieldType] = true
+		}
+	}
+}
+
+// load reads stored field types of the entity type from the storage backend, unless they are known already. A failed
+// load is repeated after fieldTypesRetryInterval, the error is returned until then.
+func (g *fieldTypeGuard) load(entityType string) error {
+	g.mu.Lock()
+	_, ok := g.known[entityType]
+	failure, failed := g.failures[entityType]
+	g.mu.Unlock()
+	if ok {
+		return nil
+	} else if failed && time.Since(failure.at) < fieldTypesRetryInterval {
+		return failure.err
+	}
+	_, err, _ := g.loads.Do(entityType, func() (any, error) {
+		fields, err := g.db.DetailFields(entityType, time.Unix(0, math.MinInt64), time.Unix(0, math.MaxInt64))
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if err != nil {
+			log.Printf("[WARNING] Can't read stored field types of %q: %s\n", entityType, err)
+			g.failures[entityType] = loadFailure{err, time.Now()}
+			return nil, err
+		}
+		if _, ok := g.known[entityType]; ok {
+			// Loaded by an earlier call, which finished before this one started
+			return nil, nil
+		}
+		known := make(map[string]map[string]bool, len(fields))
+		for _, field := range fields {
+			known[field.Name] = make(map[string]bool, len(field.Types))
+			for _, fieldType := range field.Types {
+				known[field.Name][fieldType] = true
+			}
+		}
+		g.known[entityType] = known
+		delete(g.failures, entityType)
+		return nil, nil
+	})
+	return err
+}
+
+// fields returns the detail values the way they are stored as fields.
+func (g *fieldTypeGuard) fields(details map[string]any) map[string]any {
+	if g.flatten {
+		return influxdb.FlattenDetails(details)
+	}
+	return details
+}
+
+// widen replaces integer literals of the fields with float literals, so they are stored as floats.
+func (g *fieldTypeGuard) widen(details map[string]any, fields map[string]bool) {
+	for key, value := range details {
+		if g.flatten {
+			details[key] = widenValue(key, value, fields)
+		} else if number, ok := value.(json.Number); ok && fields[key] {
+			details[key] = json.Number(number.String() + ".0")
+		}
+	}
+}
+
+// widenValue returns the value with integer literals of the fields (by flattened path) replaced with float literals.
+func widenValue(path string, value any, fields map[string]bool) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, nested := range v {
+			v[key] = widenValue(path+influxdb.DetailsSeparator+key, nested, fields)
+		}
+	case []any:
+		for i, nested := range v {
+			v[i] = widenValue(fmt.Sprintf("%s%s%d", path, influxdb.DetailsSeparator, i), nested, fields)
+		}
+	case json.Number:
+		if fields[path] {
+			return json.Number(v.String() + ".0")
+		}
+	}
+	return value
+}
+
+// storedTypes lists field types in alphabetical order, e.g. "float or integer".
+func storedTypes(types map[string]bool) string {
+	list := make([]string, 0, len(types))
+	for fieldType := range types {
+		list = append(list, fieldType)
+	}
+	sort.Strings(list)
+	result := list[0]
+	for _, fieldType := range list[1:] {
+		result += " or " + fieldType
+	}
+	return result
+}
@@ -0,0 +1,231 @@
+package http
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	// privateKeyExtension marks key files in a key directory which can sign tokens.
+	privateKeyExtension string = ".key"
+	// publicKeyExtension marks key files in a key directory which only verify tokens (e.g. of a retired key).
+	publicKeyExtension string = ".pub"
+	// jwksMaxAge is how long other services may cache the published keys. New keys should be published at least as
+	// long before they sign tokens.
+	jwksMaxAge time.Duration = 5 * time.Minute
+)
+
+// signingKey is an Ed25519 key pair tokens are signed with.
+type signingKey struct {
+	// id is the key identifier, set as the "kid" header of signed tokens.
+	id string
+	// private signs tokens.
+	private ed25519.PrivateKey
+	// public verifies tokens.
+	public ed25519.PublicKey
+}
+
+// keySet contains the keys of a JWT authority.
+type keySet struct {
+	// signing signs issued tokens.
+	signing signingKey
+	// verifying contains the public keys tokens are accepted from by key identifier, including the signing key.
+	verifying map[string]ed25519.PublicKey
+}
+
+// jwk is a public key in the JSON Web Key format (RFC 8037).
+type jwk struct {
+	// Kty is the key type, always "OKP" for Ed25519 keys.
+	Kty string `json:"kty"`
+	// Crv is the curve of the key.
+	Crv string `json:"crv"`
+	// X is the base64url encoded public key.
+	X string `json:"x"`
+	// Kid is the key identifier tokens name in their "kid" header.
+	Kid string `json:"kid"`
+	// Alg is the signature algorithm the key is used with.
+	Alg string `json:"alg"`
+	// Use is the intended use of the key, always "sig".
+	Use string `json:"use"`
+}
+
+// jwkSet is the response of "/.well-known/jwks.json".
+type jwkSet struct {
+	// Keys contains the keys tokens are accepted from, ordered by key identifier.
+	Keys []jwk `json:"keys"`
+}
+
+// loadKeyPair reads a single Ed25519 key pair in PEM format. The key identifier is the JWK thumbprint (RFC 7638) of
+// the public key, so it only changes with the key.
+func loadKeyPair(privateKeyFilePath, publicKeyFilePath string) (keySet, error) {
+	private, err := readPrivateKey(privateKeyFilePath)
+	if err != nil {
+		return keySet{}, err
+	}
+	public, err := readPublicKey(publicKeyFilePath)
+	if err != nil {
+		return keySet{}, err
+	}
+	if !public.Equal(private.Public()) {
+		return keySet{}, fmt.Errorf("%s: public key doesn't match the private key", publicKeyFilePath)
+	}
+	id := thumbprint(public)
+	return keySet{signingKey{id, private, public}, map[string]ed25519.PublicKey{id: public}}, nil
+}
+
+// loadKeyDir reads Ed25519 keys in PEM format from a directory, the file name without extension is the key identifier.
+// Private keys ("<kid>.key") sign and verify tokens, public keys ("<kid>.pub") only verify them. The private key with
+// the greatest identifier signs tokens, so date based identifiers (e.g. "2023-02-05") rotate keys when added.
+func loadKeyDir(keyDir string) (keySet, error) {
+	entries, err := os.ReadDir(keyDir)
+	if err != nil {
+		return keySet{}, err
+	}
+	keys := keySet{verifying: make(map[string]ed25519.PublicKey)}
+	for _, entry := range entries {
+		path := filepath.Join(keyDir, entry.Name())
+		extension := filepath.Ext(entry.Name())
+		id := strings.TrimSuffix(entry.Name(), extension)
+		if entry.IsDir() || id == "" {
+			continue
+		}
+		switch extension {
+		case privateKeyExtension:
+			private, err := readPrivateKey(path)
+			if err != nil {
+				return keySet{}, err
+			}
+			public := private.Public().(ed25519.PublicKey)
+			keys.verifying[id] = public
+			if id > keys.signing.id {
+				keys.signing = signingKey{id, private, public}
+			}
+		case publicKeyExtension:
+			// The private key of a pair is read instead
+			if _, err := os.Stat(strings.TrimSuffix(path, publicKeyExtension) + privateKeyExtension); err == nil {
+				continue
+			}
+			public, err := readPublicKey(path)
+			if err != nil {
+				return keySet{}, err
+			}
+			keys.verifying[id] = public
+		}
+	}
+	if keys.signing.private == nil {
+		return keySet{}, fmt.Errorf("%s: no private key (*%s) to sign tokens with", keyDir, privateKeyExtension)
+	}
+	return keys, nil
+}
+
+// readPrivateKey reads an Ed25519 private key in PEM format.
+func readPrivateKey(path string) (ed25519.PrivateKey, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := jwt.ParseEdPrivateKeyFromPEM(content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: expected an Ed25519 private key", path)
+	}
+	return private, nil
+}
+
+// readPublicKey reads an Ed25519 public key in PEM format.
+func readPublicKey(path string) (ed25519.PublicKey, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := jwt.ParseEdPublicKeyFromPEM(content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: expected an Ed25519 public key", path)
+	}
+	return public, nil
+}
+
+// thumbprint returns the JWK thumbprint (RFC 7638) of an Ed25519 public key.
+func thumbprint(public ed25519.PublicKey) string {
+	// Members of the key in lexical order, without whitespace
+	canonical := fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":"%s"}`, base64.RawURLEncoding.EncodeToString(public))
+	hash := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// Reload reads the keys from disk again. The keys in use are kept when they can't be read.
+func (jwtAuth *JWTAuthority) Reload() error {
+	keys, err := jwtAuth.load()
+	if err != nil {
+		return err
+	}
+	jwtAuth.mu.Lock()
+	defer jwtAuth.mu.Unlock()
+	if keys.signing.id != jwtAuth.keys.signing.id {
+		log.Printf("Signing tokens with JWT key %s\n", keys.signing.id)
+	}
+	jwtAuth.keys = keys
+	return nil
+}
+
+// watch reloads the keys every interval until the context is done, so keys can be rotated without a restart.
+func (jwtAuth *JWTAuthority) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := jwtAuth.Reload(); err != nil {
+				log.Printf("[WARNING] Can't reload JWT keys, keeping the current ones: %s\n", err)
+			}
+		}
+	}
+}
+
+// publicKeys returns the keys tokens are accepted from as a JWK set.
+func (jwtAuth *JWTAuthority) publicKeys() jwkSet {
+	jwtAuth.mu.RLock()
+	defer jwtAuth.mu.RUnlock()
+	set := jwkSet{Keys: make([]jwk, 0, len(jwtAuth.keys.verifying))}
+	for id, public := range jwtAuth.keys.verifying {
+		set.Keys = append(set.Keys, jwk{Kty: "OKP", Crv: "Ed25519", X: base64.RawURLEncoding.EncodeToString(public), Kid: id, Alg: "EdDSA", Use: "sig"})
+	}
+	sort.Slice(set.Keys, func(i, j int) bool {
+		return set.Keys[i].Kid < set.Keys[j].Kid
+	})
+	return set
+}
+
+// jwksHandler handles the "/.well-known/jwks.json" endpoint requests, which publishes the keys tokens are verified
+// with, so other services can verify tokens on their own.
+func (server *Server) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[%s] %s\n", r.Method, r.URL.Path)
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwksMaxAge.Seconds())))
+		jsonResponse(w, http.StatusOK, server.jwtAuth.publicKeys())
+	default:
+		server.methodNotAllowed(w)
+	}
+}
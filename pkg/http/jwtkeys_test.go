@@ -0,0 +1,178 @@
+package http
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/rubinda/logtopus/pkg/access"
+)
+
+// TestLoadKeyDir makes sure the private key with the greatest identifier signs tokens and public keys only verify them.
+func TestLoadKeyDir(t *testing.T) {
+	dir := t.TempDir()
+	writeKeyPair(t, dir, "2023-01-01")
+	writeKeyPair(t, dir, "2023-06-01")
+	_, retired := writeKeyPair(t, dir, "2022-01-01")
+	if err := os.Remove(filepath.Join(dir, "2022-01-01"+privateKeyExtension)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "archive"+privateKeyExtension), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "README"), []byte("keys"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := loadKeyDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.signing.id != "2023-06-01" {
+		t.Errorf("expected 2023-06-01 to sign tokens, got %s", keys.signing.id)
+	}
+	if len(keys.verifying) != 3 {
+		t.Errorf("expected 3 verifying keys, got %d", len(keys.verifying))
+	}
+	public, err := readPublicKey(retired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !public.Equal(keys.verifying["2022-01-01"]) {
+		t.Errorf("expected the retired public key to verify tokens")
+	}
+
+	empty := t.TempDir()
+	writeKeyPair(t, empty, "2023-01-01")
+	if err := os.Remove(filepath.Join(empty, "2023-01-01"+privateKeyExtension)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadKeyDir(empty); err == nil {
+		t.Errorf("expected an error without a private key")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "2024-01-01"+privateKeyExtension), []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadKeyDir(dir); err == nil {
+		t.Errorf("expected an error for a malformed key")
+	}
+	if _, err := loadKeyDir(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("expected an error for a missing directory")
+	}
+}
+
+// TestReload rotates keys while tokens of earlier keys stay valid, and keeps the keys in use when reloading fails.
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	writeKeyPair(t, dir, "2023-01-01")
+	jwtAuth, err := NewJWTAuthorityFromDir(dir, time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issue := func() string {
+		token, err := jwtAuth.IssueToken("alice", nil, access.Binding{}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	kid := func(tokenStr string) string {
+		token, _, err := jwt.NewParser().ParseUnverified(tokenStr, &eventSourceClaims{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := token.Header["kid"].(string)
+		return id
+	}
+	old := issue()
+	writeKeyPair(t, dir, "2023-06-01")
+	if err := jwtAuth.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	rotated := issue()
+	if kid(old) != "2023-01-01" || kid(rotated) != "2023-06-01" {
+		t.Errorf("expected tokens signed with 2023-01-01 and 2023-06-01, got %s and %s", kid(old), kid(rotated))
+	}
+	for _, token := range []string{old, rotated} {
+		if _, err := jwtAuth.ValidateToken(token); err != nil {
+			t.Errorf("%s: expected the token to be valid, got %v", kid(token), err)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "2024-01-01"+privateKeyExtension), []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := jwtAuth.Reload(); err == nil {
+		t.Errorf("expected an error for a malformed key")
+	}
+	if kid(issue()) != "2023-06-01" {
+		t.Errorf("expected the keys in use to be kept")
+	}
+	if _, err := jwtAuth.ValidateToken(old); err != nil {
+		t.Errorf("expected the keys in use to be kept, got %v", err)
+	}
+
+	// Tokens of removed keys aren't accepted anymore
+	for _, name := range []string{"2024-01-01" + privateKeyExtension, "2023-01-01" + privateKeyExtension, "2023-01-01" + publicKeyExtension} {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := jwtAuth.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jwtAuth.ValidateToken(old); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected %v, got %v", ErrUnknownKey, err)
+	}
+	if _, err := jwtAuth.ValidateToken(rotated); err != nil {
+		t.Errorf("expected the token to be valid, got %v", err)
+	}
+}
+
+// TestJWKS publishes the keys tokens are verified with.
+func TestJWKS(t *testing.T) {
+	s := newTestServer(t)
+	public, err := readPublicKey(filepath.Join(s.dir, "jwt"+publicKeyExtension))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") == "" {
+		t.Fatalf("expected a cacheable response, got %d: %v", w.Code, w.Header())
+	}
+	var set jwkSet
+	if err := json.Unmarshal(w.Body.Bytes(), &set); err != nil {
+		t.Fatal(err)
+	}
+	expected := jwk{Kty: "OKP", Crv: "Ed25519", X: base64.RawURLEncoding.EncodeToString(public), Kid: thumbprint(public), Alg: "EdDSA", Use: "sig"}
+	if len(set.Keys) != 1 || set.Keys[0] != expected {
+		t.Errorf("expected %+v, got %+v", expected, set.Keys)
+	}
+
+	// Keys are listed by identifier
+	dir := t.TempDir()
+	for _, name := range []string{"2023-06-01", "2022-01-01", "2023-01-01"} {
+		writeKeyPair(t, dir, name)
+	}
+	jwtAuth, err := NewJWTAuthorityFromDir(dir, time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := jwtAuth.publicKeys().Keys
+	if len(keys) != 3 || keys[0].Kid != "2022-01-01" || keys[1].Kid != "2023-01-01" || keys[2].Kid != "2023-06-01" {
+		t.Errorf("expected keys ordered by identifier, got %+v", keys)
+	}
+
+	w = httptest.NewRecorder()
+	s.handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/.well-known/jwks.json", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: expected status %d, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+}
@@ -1,28 +1,144 @@
 package http
 
-import "net/http"
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
 
-// authMiddleware ensures a valid token is present before handing the request over to the next handler.
-// TODO:
-//   - based on use case (e.g. IoT devices) a perhaps better approach would be to authenticate each such device with a secret
-//     instead of requiring the device to request an expirable token.
-func authMiddleware(jwtAuth *JWTAuthority, endpointHandler func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	"github.com/rubinda/logtopus/pkg/access"
+)
+
+// apiKeyScheme is the "Authorization" header scheme of API keys.
+const apiKeyScheme string = "ApiKey"
+
+// principal is the identity a request was authenticated as.
+type principal struct {
+	// Name is the username of a token or the event source of an API key.
+	Name string
+	// Scopes are the scopes the credentials allow.
+	Scopes []string
+	// Binding limits the credentials to events of some entity types or entities.
+	Binding access.Binding
+	// Expiry is the time the credential stops being accepted, zero when it doesn't expire.
+	Expiry time.Time
+}
+
+// principalKey is the request context key of the authenticated principal.
+type principalKey struct{}
+
+// requestPrincipal returns the principal a request was authorized for.
+func requestPrincipal(r *http.Request) principal {
+	identity, _ := r.Context().Value(principalKey{}).(principal)
+	return identity
+}
+
+// policy describes which credentials may access a route.
+type policy struct {
+	// read is the scope required for GET requests.
+	read string
+	// write is the scope required for requests with other methods.
+	write string
+	// allEntities rejects credentials bound to entities, for routes which can't limit their response to them.
+	allEntities bool
+}
+
+// requires returns a policy requiring the scope for every request method.
+func requires(scope string) policy {
+	return policy{read: scope, write: scope}
+}
+
+// scope returns the scope required for the request.
+func (p policy) scope(r *http.Request) string {
+	if r.Method == http.MethodGet {
+		return p.read
+	}
+	return p.write
+}
+
+// authorize ensures the request has valid credentials (a token of an enabled user or an API key) which satisfy the
+// policy, before handing the request over to the next handler. The principal is available with requestPrincipal.
+func (server *Server) authorize(p policy, endpointHandler func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Header["Token"] == nil {
-			jsonResponse(w, http.StatusUnauthorized, errResponse{ErrTokenMissing.Error(), nil})
+		identity, ok := server.authenticateRequest(w, r)
+		if !ok {
 			return
 		}
-		if jwtAuth == nil {
-			jsonResponse(w, http.StatusInternalServerError, errResponse{"Can't authenticate your request, please contact an administrator.", nil})
+		if !access.HasScope(identity.Scopes, p.scope(r)) {
+			jsonResponse(w, http.StatusForbidden, errResponse{ErrScopeRequired.Error(), map[string]string{"scope": p.scope(r)}})
 			return
 		}
-		_, err := jwtAuth.ValidateToken(r.Header["Token"][0])
-		if err != nil {
-			jsonResponse(w, http.StatusUnauthorized, errResponse{err.Error(), nil})
+		if p.allEntities && identity.Binding.Bound() {
+			jsonResponse(w, http.StatusForbidden, errResponse{ErrBindingNotAllowed.Error(), nil})
 			return
 		}
-
 		// All ok, continue with the handler stack
-		endpointHandler(w, r)
+		endpointHandler(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, identity)))
 	})
 }
+
+// authenticateRequest validates the API key in the "Authorization" header or else the "Token" header, responding
+// with an error when the request can't be authenticated.
+func (server *Server) authenticateRequest(w http.ResponseWriter, r *http.Request) (principal, bool) {
+	if authorization := r.Header.Get("Authorization"); authorization != "" {
+		identity, err := server.authenticateKey(authorization)
+		if err != nil {
+			jsonResponse(w, http.StatusUnauthorized, errResponse{err.Error(), nil})
+			return principal{}, false
+		}
+		return identity, true
+	}
+	if r.Header["Token"] == nil {
+		jsonResponse(w, http.StatusUnauthorized, errResponse{ErrTokenMissing.Error(), nil})
+		return principal{}, false
+	}
+	if server.jwtAuth == nil {
+		jsonResponse(w, http.StatusInternalServerError, errResponse{"Can't authenticate your request, please contact an administrator.", nil})
+		return principal{}, false
+	}
+	identity, err := server.authenticateToken(r.Header["Token"][0])
+	if err != nil {
+		jsonResponse(w, http.StatusUnauthorized, errResponse{err.Error(), nil})
+		return principal{}, false
+	}
+	return identity, true
+}
+
+// authenticateToken validates the token and returns the user it was issued to. Tokens of disabled or deleted users
+// are rejected, and tokens only keep scopes the user still has, so changes apply before tokens expire.
+func (server *Server) authenticateToken(tokenStr string) (principal, error) {
+	token, err := server.jwtAuth.ValidateToken(tokenStr)
+	if err != nil {
+		return principal{}, err
+	}
+	claims := tokenClaims(token)
+	user, err := server.users.Get(claims.IssuedTo)
+	if err != nil || user.Disabled {
+		return principal{}, ErrUserDisabled
+	}
+	identity := principal{Name: user.Username, Scopes: user.Scopes, Binding: claims.Binding}
+	if claims.Scopes != nil {
+		identity.Scopes = access.Intersect(claims.Scopes, user.Scopes)
+	}
+	if claims.ExpiresAt != nil {
+		identity.Expiry = claims.ExpiresAt.Time
+	}
+	return identity, nil
+}
+
+// authenticateKey validates an "Authorization" header with an API key and returns the event source of the key.
+func (server *Server) authenticateKey(authorization string) (principal, error) {
+	scheme, key, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, apiKeyScheme) {
+		return principal{}, ErrAuthorizationScheme
+	}
+	apiKey, err := server.apiKeys.Authenticate(strings.TrimSpace(key), time.Now())
+	if err != nil {
+		return principal{}, err
+	}
+	identity := principal{Name: apiKey.Source, Scopes: apiKey.Scopes, Binding: apiKey.Binding}
+	if apiKey.ExpiresAt != nil {
+		identity.Expiry = *apiKey.ExpiresAt
+	}
+	return identity, nil
+}
@@ -0,0 +1,119 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/access"
+	"github.com/rubinda/logtopus/pkg/influxdb"
+)
+
+// TestAuthorize checks the scopes and bindings required by the routes.
+func TestAuthorize(t *testing.T) {
+	s := newTestServer(t)
+	if _, _, err := s.users.Create("viewer", testPassword, []string{access.ScopeQuery}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.users.Create("former", testPassword, access.AllScopes); err != nil {
+		t.Fatal(err)
+	}
+	former := s.token(t, "former", access.Binding{})
+	disabled := true
+	if _, _, err := s.users.Update("former", &disabled, nil); err != nil {
+		t.Fatal(err)
+	}
+	_, ingestKey, _, err := s.apiKeys.Create("sensor-1", nil, access.Binding{}, nil, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, boundKey, _, err := s.apiKeys.Create("sensor-2", []string{access.ScopeIngest, access.ScopeQuery}, access.Binding{EntityTypes: []string{"mediaServer"}}, nil, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduced, err := s.jwtAuth.IssueToken("admin", []string{access.ScopeQuery}, access.Binding{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials := map[string]string{
+		"admin":    "Token " + s.token(t, "admin", access.Binding{}),
+		"bound":    "Token " + s.token(t, "admin", access.Binding{EntityIds: []string{"plex001"}}),
+		"reduced":  "Token " + reduced,
+		"agent":    "Token " + s.token(t, "agent", access.Binding{}),
+		"viewer":   "Token " + s.token(t, "viewer", access.Binding{}),
+		"former":   "Token " + former,
+		"forged":   "Token " + s.token(t, "viewer", access.Binding{})[:20] + "x",
+		"key":      "Authorization " + apiKeyScheme + " " + ingestKey,
+		"bearer":   "Authorization Bearer " + ingestKey,
+		"unknown":  "Authorization " + apiKeyScheme + " ltk_unknown_00",
+		"boundKey": "Authorization " + apiKeyScheme + " " + boundKey,
+		"none":     "",
+	}
+	event := `{"entityId": "plex001", "entityType": "mediaServer", "eventType": "downtime"}`
+	tests := []struct {
+		credentials string
+		method      string
+		path        string
+		body        string
+		status      int
+	}{
+		{"admin", http.MethodPost, "/events", event, http.StatusOK},
+		{"agent", http.MethodPost, "/events", event, http.StatusOK},
+		{"key", http.MethodPost, "/events", event, http.StatusOK},
+		{"boundKey", http.MethodPost, "/events", event, http.StatusOK},
+		{"bound", http.MethodPost, "/events", `{"entityId": "plex002", "entityType": "mediaServer", "eventType": "downtime"}`, http.StatusBadRequest},
+		{"viewer", http.MethodPost, "/events", event, http.StatusForbidden},
+		{"reduced", http.MethodPost, "/events", event, http.StatusForbidden},
+		{"former", http.MethodPost, "/events", event, http.StatusUnauthorized},
+		{"forged", http.MethodPost, "/events", event, http.StatusUnauthorized},
+		{"bearer", http.MethodPost, "/events", event, http.StatusUnauthorized},
+		{"unknown", http.MethodPost, "/events", event, http.StatusUnauthorized},
+		{"none", http.MethodPost, "/events", event, http.StatusUnauthorized},
+		{"admin", http.MethodPost, "/query/events", "", http.StatusOK},
+		{"viewer", http.MethodPost, "/query/events", "", http.StatusOK},
+		{"bound", http.MethodPost, "/query/events", "", http.StatusOK},
+		{"agent", http.MethodPost, "/query/events", "", http.StatusForbidden},
+		{"key", http.MethodPost, "/query/events", "", http.StatusForbidden},
+		{"agent", http.MethodPost, "/query/aggregate", `{"_aggregate": "count"}`, http.StatusForbidden},
+		{"viewer", http.MethodGet, "/schema/entityTypes", "", http.StatusOK},
+		{"bound", http.MethodGet, "/schema/entityTypes", "", http.StatusForbidden},
+		{"boundKey", http.MethodGet, "/schema/fields?entityType=mediaServer", "", http.StatusForbidden},
+		{"viewer", http.MethodGet, "/schemas", "", http.StatusOK},
+		{"viewer", http.MethodPut, "/schemas", "{}", http.StatusForbidden},
+		{"admin", http.MethodGet, "/admin/users", "", http.StatusOK},
+		{"bound", http.MethodGet, "/admin/users", "", http.StatusOK},
+		{"reduced", http.MethodGet, "/admin/users", "", http.StatusForbidden},
+		{"agent", http.MethodGet, "/admin/users", "", http.StatusForbidden},
+		{"viewer", http.MethodGet, "/admin/apikeys", "", http.StatusForbidden},
+		{"key", http.MethodGet, "/admin/apikeys", "", http.StatusForbidden},
+		{"boundKey", http.MethodGet, "/status/writes", "", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, apiBasePath+test.path, strings.NewReader(test.body))
+		if header, value, ok := strings.Cut(credentials[test.credentials], " "); ok {
+			r.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		s.handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s %s as %s: expected status %d, got %d: %s", test.method, test.path, test.credentials, test.status, w.Code, w.Body)
+		}
+	}
+
+	// Bound credentials only read events within their binding
+	if w := s.request(t, http.MethodPost, "/events", s.token(t, "agent", access.Binding{}), `{"entityId": "plex002", "entityType": "mediaServer", "eventType": "downtime"}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	var result influxdb.QueryResult
+	s.request(t, http.MethodPost, "/query/events", strings.TrimPrefix(credentials["bound"], "Token "), `{"$or": [{"entityId": "plex002"}, {"eventType": "downtime"}]}`, &result)
+	if len(result.Events) == 0 {
+		t.Errorf("expected events of plex001, got none")
+	}
+	for _, event := range result.Events {
+		if event.EntityId != "plex001" {
+			t.Errorf("expected only events of plex001, got %s", event.EntityId)
+		}
+	}
+}
@@ -1,8 +1,31 @@
 package http
 
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/access"
+	"github.com/rubinda/logtopus/pkg/apikeys"
+	"github.com/rubinda/logtopus/pkg/influxdb"
+	"github.com/rubinda/logtopus/pkg/schemaregistry"
+	"github.com/rubinda/logtopus/pkg/userstore"
+)
+
 const (
 	// errBadRequestBody is the response message to invalid data in client requests.
 	errBadRequestBody string = "bad request body"
+	// errStoringEvents is the response message when the storage backend fails to write events.
+	errStoringEvents string = "failed to store events"
+	// errEventNotFound is the response message when no event has the requested event ID.
+	errEventNotFound string = "event not found"
+	// errEventPending is the response message when an event with the same event ID is still being stored.
+	errEventPending string = "an event with the same ID is being stored, retry later"
+	// errSavingUsers is the response message when the user store can't be persisted.
+	errSavingUsers string = "failed to save users"
+	// errSavingAPIKeys is the response message when the API key store can't be persisted.
+	errSavingAPIKeys string = "failed to save API keys"
+	// errSavingSessions is the response message when the session store can't be persisted.
+	errSavingSessions string = "failed to save sessions"
 )
 
 // errResponse is a wrapper for returning JSON error messages.
@@ -12,3 +35,182 @@ type errResponse struct {
 	// Details contains further (optional) information about the error.
 	Details any `json:"details,omitempty"`
 }
+
+// eventResponse is the response to a single stored event.
+type eventResponse struct {
+	// EventId identifies the stored event (given by the client or generated).
+	EventId string `json:"eventId"`
+	// Duplicate is true when an event with the same ID was already accepted, it isn't stored again.
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+// batchItemResult is the outcome for a single event in a batch request.
+type batchItemResult struct {
+	// Index is the position of the event in the request array.
+	Index int `json:"index"`
+	// Accepted is true when the event was stored.
+	Accepted bool `json:"accepted"`
+	// EventId identifies the event (given by the client or generated), set unless the event was rejected.
+	EventId string `json:"eventId,omitempty"`
+	// Duplicate is true when an event with the same ID was already accepted, it isn't stored again.
+	Duplicate bool `json:"duplicate,omitempty"`
+	// Problems lists the reasons an event was rejected.
+	Problems []influxdb.ModelError `json:"problems,omitempty"`
+}
+
+// batchResponse is the response to a batch of events.
+type batchResponse struct {
+	// Accepted is the number of stored events.
+	Accepted int `json:"accepted"`
+	// Rejected is the number of events which failed validation.
+	Rejected int `json:"rejected"`
+	// Duplicates is the number of events which were already accepted before.
+	Duplicates int `json:"duplicates"`
+	// Results contains an entry for each event in the request, in the same order.
+	Results []batchItemResult `json:"results"`
+}
+
+// streamLineError describes a rejected line in a NDJSON stream.
+type streamLineError struct {
+	// Line is the (1-based) line number in the request body.
+	Line int `json:"line"`
+	// Problems lists the reasons the line was rejected.
+	Problems []influxdb.ModelError `json:"problems"`
+}
+
+// streamResponse is the response to a NDJSON stream of events.
+type streamResponse struct {
+	// Accepted is the number of stored events.
+	Accepted int `json:"accepted"`
+	// Rejected is the number of lines which failed decoding or validation.
+	Rejected int `json:"rejected"`
+	// Duplicates is the number of events which were already accepted before.
+	Duplicates int `json:"duplicates"`
+	// Errors contains details about rejected lines (limited to maxReportedLineErrors entries).
+	Errors []streamLineError `json:"errors"`
+}
+
+// schemaValuesResponse is the response to a listing of distinct attribute values.
+type schemaValuesResponse struct {
+	// Values contains distinct values in alphabetical order.
+	Values []string `json:"values"`
+}
+
+// schemaFieldsResponse is the response to a listing of detail fields.
+type schemaFieldsResponse struct {
+	// Fields contains detail field keys and their types, ordered by key.
+	Fields []influxdb.DetailField `json:"fields"`
+}
+
+// schemaListResponse is the response to a listing of registered schemas.
+type schemaListResponse struct {
+	// Schemas contains registrations ordered by event type and entity type.
+	Schemas []schemaregistry.Registration `json:"schemas"`
+}
+
+// tokenResponse is the response to a login or a refreshed session.
+type tokenResponse struct {
+	// Token is the access token other endpoints are authenticated with.
+	Token string `json:"token"`
+	// ExpiresIn is the number of seconds the access token is valid for.
+	ExpiresIn int `json:"expiresIn"`
+	// RefreshToken is exchanged for a new access token (and refresh token) on "/auth/refresh".
+	RefreshToken string `json:"refreshToken"`
+	// RefreshExpiresAt is the time the refresh token stops being accepted.
+	RefreshExpiresAt time.Time `json:"refreshExpiresAt"`
+}
+
+// refreshRequest is the request body for refreshing a session.
+type refreshRequest struct {
+	// RefreshToken is the latest refresh token of the session.
+	RefreshToken string `json:"refreshToken"`
+}
+
+// createUserRequest is the request body for creating a user.
+type createUserRequest struct {
+	// Username identifies the user when logging in.
+	Username string `json:"username"`
+	// Password is the initial password of the user.
+	Password string `json:"password"`
+	// Scopes are the scopes of tokens issued to the user, userstore.DefaultScopes when empty.
+	Scopes []string `json:"scopes"`
+}
+
+// updateUserRequest is the request body for changing a user.
+type updateUserRequest struct {
+	// Disabled disables (or enables) the user.
+	Disabled *bool `json:"disabled"`
+	// Scopes replaces the scopes of the user.
+	Scopes []string `json:"scopes"`
+}
+
+// userListResponse is the response to a listing of users.
+type userListResponse struct {
+	// Users contains users ordered by username.
+	Users []userstore.User `json:"users"`
+}
+
+// createAPIKeyRequest is the request body for minting an API key.
+type createAPIKeyRequest struct {
+	// Source is the name of the event source (e.g. a device) the key is for.
+	Source string `json:"source"`
+	// Scopes are the scopes the key allows, apikeys.DefaultScopes when empty.
+	Scopes []string `json:"scopes"`
+	// Binding limits the key to events of some entity types or entities.
+	access.Binding
+	// ExpiresAt is the time the key stops being accepted, the key doesn't expire when nil.
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+// createAPIKeyResponse is the response to a minted API key.
+type createAPIKeyResponse struct {
+	apikeys.Key
+	// APIKey is the API key itself, it is only shown once.
+	APIKey string `json:"key"`
+}
+
+// apiKeyListResponse is the response to a listing of API keys.
+type apiKeyListResponse struct {
+	// Keys contains keys (without secrets) ordered by creation.
+	Keys []apikeys.Key `json:"keys"`
+}
+
+// Types of WebSocket messages.
+const (
+	wsSubscribe    string = "subscribe"
+	wsUnsubscribe  string = "unsubscribe"
+	wsSubscribed   string = "subscribed"
+	wsUnsubscribed string = "unsubscribed"
+	wsEvent        string = "event"
+	wsLive         string = "live"
+	wsDropped      string = "dropped"
+	wsError        string = "error"
+)
+
+// wsClientMessage is a message sent by a WebSocket client.
+type wsClientMessage struct {
+	// Type is wsSubscribe or wsUnsubscribe.
+	Type string `json:"type"`
+	// Id is the client chosen identifier of the subscription.
+	Id string `json:"id"`
+	// Filter contains conditions for events (same as accepted by "/query/events" without time range and pagination).
+	Filter json.RawMessage `json:"filter,omitempty"`
+	// Since is the time stored events are backfilled from, before live events are delivered (same formats as "_timeFrom").
+	Since any `json:"since,omitempty"`
+}
+
+// wsServerMessage is a message sent to a WebSocket client.
+type wsServerMessage struct {
+	// Type is one of the ws* message types.
+	Type string `json:"type"`
+	// Id is the identifier of the subscription the message belongs to.
+	Id string `json:"id,omitempty"`
+	// Event contains a matching event.
+	Event *influxdb.BasicEvent `json:"event,omitempty"`
+	// Dropped is the total number of events dropped for the subscription, because the client didn't keep up.
+	Dropped uint64 `json:"dropped,omitempty"`
+	// Message contains an error description.
+	Message string `json:"message,omitempty"`
+	// Details contains further (optional) information about the error.
+	Details []influxdb.ModelError `json:"details,omitempty"`
+}
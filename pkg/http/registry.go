@@ -0,0 +1,60 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/rubinda/logtopus/pkg/schemaregistry"
+)
+
+// schemasHandler handles the "/schemas" API endpoint requests.
+func (server *Server) schemasHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[%s] %s\n", r.Method, r.URL.Path)
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, http.StatusOK, schemaListResponse{server.schemas.List()})
+	case http.MethodPost:
+		server.handleSchemasPost(w, r)
+	case http.MethodDelete:
+		server.handleSchemasDelete(w, r)
+	default:
+		server.methodNotAllowed(w)
+	}
+}
+
+// handleSchemasPost registers (or replaces) the schema for an event type.
+func (server *Server) handleSchemasPost(w http.ResponseWriter, r *http.Request) {
+	var registration schemaregistry.Registration
+	if err := json.NewDecoder(r.Body).Decode(&registration); err != nil {
+		jsonResponse(w, http.StatusBadRequest, errResponse{err.Error(), nil})
+		return
+	}
+	registration, problems, err := server.schemas.Register(registration)
+	if len(problems) > 0 {
+		jsonResponse(w, http.StatusBadRequest, errResponse{errBadRequestBody, problems})
+		return
+	}
+	if err != nil {
+		log.Printf("[WARNING] Can't save schema registry: %s\n", err)
+		jsonResponse(w, http.StatusInternalServerError, errResponse{"failed to save schema", nil})
+		return
+	}
+	jsonResponse(w, http.StatusOK, registration)
+}
+
+// handleSchemasDelete removes the schema given by the "eventType" and (optional) "entityType" URL parameters.
+func (server *Server) handleSchemasDelete(w http.ResponseWriter, r *http.Request) {
+	err := server.schemas.Remove(r.URL.Query().Get("eventType"), r.URL.Query().Get("entityType"))
+	if errors.Is(err, schemaregistry.ErrNotFound) {
+		jsonResponse(w, http.StatusNotFound, errResponse{err.Error(), nil})
+		return
+	}
+	if err != nil {
+		log.Printf("[WARNING] Can't save schema registry: %s\n", err)
+		jsonResponse(w, http.StatusInternalServerError, errResponse{"failed to save schema", nil})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
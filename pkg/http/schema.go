@@ -0,0 +1,76 @@
+package http
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/influxdb"
+)
+
+// schemaValuesHandler returns a handler for the "/schema/*" endpoints listing distinct values of given attribute
+// (entityType, eventType or entityId).
+func (server *Server) schemaValuesHandler(field string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("[%s] %s\n", r.Method, r.URL.Path)
+		switch r.Method {
+		case http.MethodGet:
+			server.handleSchemaValuesGet(w, r, field)
+		default:
+			server.methodNotAllowed(w)
+		}
+	}
+}
+
+// handleSchemaValuesGet handles GET requests listing distinct attribute values.
+func (server *Server) handleSchemaValuesGet(w http.ResponseWriter, r *http.Request, field string) {
+	start, stop, err := schemaTimeRange(r)
+	if err != nil {
+		queryErrorResponse(w, err)
+		return
+	}
+	values, err := server.db.DistinctValues(field, start, stop)
+	if err != nil {
+		queryErrorResponse(w, err)
+		return
+	}
+	jsonResponse(w, http.StatusOK, schemaValuesResponse{values})
+}
+
+// schemaFieldsHandler handles the "/schema/fields" API endpoint requests.
+func (server *Server) schemaFieldsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[%s] %s\n", r.Method, r.URL.Path)
+	switch r.Method {
+	case http.MethodGet:
+		server.handleSchemaFieldsGet(w, r)
+	default:
+		server.methodNotAllowed(w)
+	}
+}
+
+// handleSchemaFieldsGet handles GET requests on the "/schema/fields" endpoint. Fields can be limited to an entity type
+// with the "entityType" URL parameter.
+func (server *Server) handleSchemaFieldsGet(w http.ResponseWriter, r *http.Request) {
+	start, stop, err := schemaTimeRange(r)
+	if err != nil {
+		queryErrorResponse(w, err)
+		return
+	}
+	fields, err := server.db.DetailFields(r.URL.Query().Get(influxdb.MeasurementFieldName), start, stop)
+	if err != nil {
+		queryErrorResponse(w, err)
+		return
+	}
+	jsonResponse(w, http.StatusOK, schemaFieldsResponse{fields})
+}
+
+// schemaTimeRange reads the optional "_timeFrom" and "_timeTo" URL parameters, same formats as in event queries.
+func schemaTimeRange(r *http.Request) (start, stop time.Time, err error) {
+	params := make(map[string]any)
+	for _, tag := range []string{influxdb.QueryRangeStartTag, influxdb.QueryRangeStopTag} {
+		if value := r.URL.Query().Get(tag); value != "" {
+			params[tag] = value
+		}
+	}
+	return influxdb.ParseTimeRange(params, time.Now())
+}
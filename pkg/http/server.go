@@ -3,45 +3,72 @@ package http
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/rubinda/logtopus/pkg/access"
+	"github.com/rubinda/logtopus/pkg/asyncstore"
+	"github.com/rubinda/logtopus/pkg/eventhub"
+	"github.com/rubinda/logtopus/pkg/eventid"
 	"github.com/rubinda/logtopus/pkg/influxdb"
+	"github.com/rubinda/logtopus/pkg/schemaregistry"
 	"golang.org/x/sync/errgroup"
 )
 
 const (
 	// apiBasePath contains the prefix for each API endpoint.
 	apiBasePath string = "/api/v1"
-)
-
-// TODO:
-//   - username and password for testing authentication, could be replaced with OAuth or similar.
-const (
-	authorizedUsername string = "johnnyHotbody"
-	authorizedPassword string = "me-llamo-johnny"
+	// idempotencyKeyHeader carries the event ID of events sent without one, so retried requests aren't stored twice.
+	idempotencyKeyHeader string = "Idempotency-Key"
+	// maxBatchBodySize is the largest accepted "/events/batch" request body in bytes, larger uploads can be streamed.
+	maxBatchBodySize int64 = 10 << 20
+	// eventLookupWindow is the time range around the time in an event ID (a ULID) searched first for the event.
+	eventLookupWindow time.Duration = time.Hour
 )
 
 // Configuration contains required parameters to start a HTTP(S) server.
 type Configuration struct {
-	// DB is an InfluxDB client.
-	DB *influxdb.Client
+	// DB is a storage backend for events (e.g. an InfluxDB client).
+	DB EventStore
+	// Users contains the accounts which can request tokens.
+	Users UserStore
+	// APIKeys contains the keys event sources authenticate with instead of tokens.
+	APIKeys APIKeyStore
+	// Sessions contains refresh tokens of logged in users and revoked tokens.
+	Sessions SessionStore
+	// AccessTokenTTL is how long issued tokens are valid.
+	AccessTokenTTL time.Duration
 	// Address contains the IP address and port the HTTP(S) server  listens on
 	Address string
 	// JWTKeyPath is a path to a private KEY (Ed25519) in PEM format.
 	JWTKeyPath string
 	// JWTKeyPath is a path to the public key pair.
 	JWTPubKeyPath string
+	// JWTKeyDir is a directory with multiple keys (see loadKeyDir), used instead of JWTKeyPath and JWTPubKeyPath.
+	JWTKeyDir string
+	// JWTKeyReloadInterval is how often keys are read from disk again, zero disables reloading.
+	JWTKeyReloadInterval time.Duration
 	// CAKeyPath contains the path to a private server key (TLS)
 	CAKeyPath string
 	// CACertPath contains the path to a server certificate (TLS)
 	CACertPath string
+	// Schemas contains JSON Schemas event details are validated against, an empty registry is used when nil.
+	Schemas *schemaregistry.Registry
+	// FlattenDetails should match the storage backend setting, nested details are then checked as separate fields.
+	FlattenDetails bool
+	// Timestamps configures how event timestamps are read and which are accepted.
+	Timestamps influxdb.TimestampPolicy
+	// DedupWindow is how long event IDs are remembered to recognize duplicates, zero disables deduplication.
+	DedupWindow time.Duration
 }
 
 // Server contains methods to handle HTTP requests.
@@ -49,29 +76,45 @@ type Server struct {
 	// instance is the standard http implementation of a http server.
 	instance *http.Server
 	// db contains methods for database interaction.
-	db *influxdb.Client
+	db EventStore
+	// users contains the accounts which can request tokens.
+	users UserStore
+	// apiKeys contains the keys event sources authenticate with instead of tokens.
+	apiKeys APIKeyStore
+	// sessions contains refresh tokens of logged in users and revoked tokens.
+	sessions SessionStore
 	// jwtAuth contains methods for token (authentication) management.
 	jwtAuth *JWTAuthority
+	// hub distributes stored events to live subscribers.
+	hub *eventhub.Hub
+	// schemas validates event details of registered event types.
+	schemas *schemaregistry.Registry
+	// fieldTypes detects detail values conflicting with types of stored values.
+	fieldTypes *fieldTypeGuard
+	// flattenDetails rejects detail keys which can't be stored flattened.
+	flattenDetails bool
+	// timestamps configures how event timestamps are read and which are accepted.
+	timestamps influxdb.TimestampPolicy
+	// dedup remembers IDs of recently accepted events, so retries are recognized as duplicates.
+	dedup *eventid.Window
+	// notifier is set when the storage backend stores events after accepting them, it reports their writes.
+	notifier writeNotifier
 }
 
 // ListenAndServe creates a new HTTP(S) server with the given parameters and starts listening for incoming connections.
 func ListenAndServe(c Configuration) {
-	// Initialize a new authentication handler
-	jwtAuth, err := NewJWTAuthority(c.JWTKeyPath, c.JWTPubKeyPath)
+	server, err := newServer(c)
 	if err != nil {
 		log.Fatal("can't create a JWT Authority: ", err)
 	}
-	server := &Server{db: c.DB, jwtAuth: jwtAuth}
-	mux := http.NewServeMux()
-	mux.HandleFunc(apiBasePath+"/auth", server.authHandler)
-	mux.HandleFunc(apiBasePath+"/events", authMiddleware(jwtAuth, server.eventsHandler))
-	mux.HandleFunc(apiBasePath+"/query/events", authMiddleware(jwtAuth, server.eventsQueryHandler))
 	server.instance = &http.Server{
 		Addr:         c.Address,
-		Handler:      mux,
+		Handler:      server.routes(),
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
 	}
+	// Live subscriptions never become idle, end them so shutdown can complete
+	server.instance.RegisterOnShutdown(server.hub.Close)
 	ctx, cancel := context.WithCancel(context.Background())
 	// Listens for shutdown signals (CTRL-C)
 	go func() {
@@ -80,6 +123,9 @@ func ListenAndServe(c Configuration) {
 		<-osSignals
 		cancel()
 	}()
+	if c.JWTKeyReloadInterval > 0 {
+		go server.jwtAuth.watch(ctx, c.JWTKeyReloadInterval)
+	}
 	g, gCtx := errgroup.WithContext(ctx)
 	g.Go(func() error {
 		log.Printf("Server listening on https://%s\n", server.instance.Addr)
@@ -96,10 +142,69 @@ func ListenAndServe(c Configuration) {
 	}
 }
 
+// newServer returns a server with the given parameters, without listening for connections.
+func newServer(c Configuration) (*Server, error) {
+	// Initialize a new authentication handler
+	var jwtAuth *JWTAuthority
+	var err error
+	if c.JWTKeyDir != "" {
+		jwtAuth, err = NewJWTAuthorityFromDir(c.JWTKeyDir, c.AccessTokenTTL, c.Sessions)
+	} else {
+		jwtAuth, err = NewJWTAuthority(c.JWTKeyPath, c.JWTPubKeyPath, c.AccessTokenTTL, c.Sessions)
+	}
+	if err != nil {
+		return nil, err
+	}
+	schemas := c.Schemas
+	if schemas == nil {
+		schemas = schemaregistry.New()
+	}
+	server := &Server{db: c.DB, users: c.Users, apiKeys: c.APIKeys, sessions: c.Sessions, jwtAuth: jwtAuth, hub: eventhub.New(tailBufferSize), schemas: schemas, flattenDetails: c.FlattenDetails, timestamps: c.Timestamps, dedup: eventid.NewWindow(c.DedupWindow)}
+	server.fieldTypes = newFieldTypeGuard(server.db, c.FlattenDetails)
+	if notifier, ok := server.db.(writeNotifier); ok {
+		notifier.Notify(server.eventsStored, server.eventsDropped)
+		server.notifier = notifier
+	}
+	return server, nil
+}
+
+// routes returns the handler of all API endpoints.
+func (server *Server) routes() http.Handler {
+	// Listings of schema values span all entities, so they can't be limited to the entities of bound credentials
+	listsEntities := policy{read: access.ScopeQuery, write: access.ScopeQuery, allEntities: true}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/jwks.json", server.jwksHandler)
+	mux.HandleFunc(apiBasePath+"/auth", server.authHandler)
+	mux.HandleFunc(apiBasePath+"/auth/refresh", server.refreshHandler)
+	mux.HandleFunc(apiBasePath+"/auth/logout", server.logoutHandler)
+	mux.HandleFunc(apiBasePath+"/events", server.authorize(requires(access.ScopeIngest), server.eventsHandler))
+	mux.HandleFunc(apiBasePath+"/events/", server.authorize(requires(access.ScopeQuery), server.eventHandler))
+	mux.HandleFunc(apiBasePath+"/events/batch", server.authorize(requires(access.ScopeIngest), server.eventsBatchHandler))
+	mux.HandleFunc(apiBasePath+"/events/stream", server.authorize(requires(access.ScopeIngest), server.eventsStreamHandler))
+	mux.HandleFunc(apiBasePath+"/events/tail", server.authorize(requires(access.ScopeQuery), server.eventsTailHandler))
+	// Authenticates on its own, since browsers can't send the token header with WebSocket requests
+	mux.HandleFunc(apiBasePath+"/events/subscribe", server.eventsSubscribeHandler)
+	mux.HandleFunc(apiBasePath+"/query/events", server.authorize(requires(access.ScopeQuery), server.eventsQueryHandler))
+	mux.HandleFunc(apiBasePath+"/query/aggregate", server.authorize(requires(access.ScopeQuery), server.aggregateQueryHandler))
+	mux.HandleFunc(apiBasePath+"/schema/entityTypes", server.authorize(listsEntities, server.schemaValuesHandler(influxdb.MeasurementFieldName)))
+	mux.HandleFunc(apiBasePath+"/schema/eventTypes", server.authorize(listsEntities, server.schemaValuesHandler(influxdb.EventTypeFieldName)))
+	mux.HandleFunc(apiBasePath+"/schema/entityIds", server.authorize(listsEntities, server.schemaValuesHandler(influxdb.EntityIdFieldName)))
+	mux.HandleFunc(apiBasePath+"/schema/fields", server.authorize(listsEntities, server.schemaFieldsHandler))
+	mux.HandleFunc(apiBasePath+"/schemas", server.authorize(policy{read: access.ScopeQuery, write: access.ScopeAdmin, allEntities: true}, server.schemasHandler))
+	mux.HandleFunc(apiBasePath+"/admin/users", server.authorize(requires(access.ScopeAdmin), server.usersHandler))
+	mux.HandleFunc(apiBasePath+"/admin/users/", server.authorize(requires(access.ScopeAdmin), server.userHandler))
+	mux.HandleFunc(apiBasePath+"/admin/apikeys", server.authorize(requires(access.ScopeAdmin), server.apiKeysHandler))
+	mux.HandleFunc(apiBasePath+"/admin/apikeys/", server.authorize(requires(access.ScopeAdmin), server.apiKeyHandler))
+	mux.HandleFunc(apiBasePath+"/status/writes", server.authorize(requires(access.ScopeAdmin), server.writeStatusHandler))
+	return mux
+}
+
 // Shutdown gracefully terminates the http server and open DB connections.
+// Requests in progress are finished before the DB is disconnected, so no accepted events are lost.
 func (server *Server) Shutdown() error {
+	err := server.instance.Shutdown(context.Background())
 	server.db.Disconnect()
-	return server.instance.Shutdown(context.Background())
+	return err
 }
 
 // authHandler authenticates an entity and responds with a token.
@@ -110,22 +215,36 @@ func (server *Server) authHandler(w http.ResponseWriter, r *http.Request) {
 		loginInfo := struct {
 			User string `json:"user"`
 			Pass string `json:"pass"`
+			// Scopes limits the token to some of the user's scopes.
+			Scopes []string `json:"scopes"`
+			// Binding limits the token to events of some entity types or entities.
+			access.Binding
 		}{}
 		err := json.NewDecoder(r.Body).Decode(&loginInfo)
 		if err != nil {
 			jsonResponse(w, http.StatusBadRequest, errResponse{err.Error(), nil})
 			return
 		}
-		if loginInfo.User != authorizedUsername || loginInfo.Pass != authorizedPassword {
+		user, err := server.users.Authenticate(loginInfo.User, loginInfo.Pass)
+		if err != nil {
 			jsonResponse(w, http.StatusUnauthorized, errResponse{"Invalid username / password combination", nil})
 			return
 		}
-		token, err := server.jwtAuth.IssueToken(loginInfo.User)
+		scopes := user.Scopes
+		if len(loginInfo.Scopes) > 0 {
+			if problems := access.ValidateScopes(loginInfo.Scopes, user.Scopes, "scopes"); len(problems) > 0 {
+				jsonResponse(w, http.StatusBadRequest, errResponse{errBadRequestBody, problems})
+				return
+			}
+			scopes = loginInfo.Scopes
+		}
+		session, refreshToken, err := server.sessions.Start(user.Username, scopes, loginInfo.Binding, time.Now())
 		if err != nil {
-			jsonResponse(w, http.StatusInternalServerError, errResponse{"An error occurred while issuing your token. Please contact an administrator.", nil})
+			log.Printf("[WARNING] Can't save session store: %s\n", err)
+			jsonResponse(w, http.StatusInternalServerError, errResponse{errSavingSessions, nil})
 			return
 		}
-		jsonResponse(w, http.StatusOK, map[string]string{"token": token})
+		server.issueTokens(w, session, refreshToken)
 	default:
 		server.methodNotAllowed(w)
 	}
@@ -151,20 +270,261 @@ func (server *Server) handleEventsPost(w http.ResponseWriter, r *http.Request) {
 		jsonResponse(w, http.StatusBadRequest, errResponse{err.Error(), nil})
 		return
 	}
+	if eventData.EventId == "" {
+		eventData.EventId = r.Header.Get(idempotencyKeyHeader)
+	}
 	// Ensure required fields
-	if problems := eventData.Validate(); len(problems) > 0 {
+	if problems := server.validateEvent(&eventData, requestPrincipal(r).Binding); len(problems) > 0 {
 		jsonResponse(w, http.StatusBadRequest, errResponse{errBadRequestBody, problems})
 		return
 	}
+	scope := requestPrincipal(r).Name
+	switch server.dedup.Reserve(scope, eventData.EventId, time.Now()) {
+	case eventid.Stored:
+		// A retry of an accepted event, which is already stored
+		jsonResponse(w, http.StatusOK, eventResponse{eventData.EventId, true})
+		return
+	case eventid.Pending:
+		// The first attempt may still fail, the retry can't be acknowledged yet
+		w.Header().Set("Retry-After", "1")
+		jsonResponse(w, http.StatusConflict, errResponse{errEventPending, nil})
+		return
+	}
 	// Store into database
-	err = server.db.StoreEvent(eventData)
+	err = server.storeEvents(scope, eventData)
 	if err != nil {
-		jsonResponse(w, http.StatusBadRequest, errResponse{err.Error(), nil})
+		server.dedup.Release(scope, eventData.EventId)
+		storeErrorResponse(w, err, http.StatusBadRequest)
 		return
 	}
+	server.accepted(scope, eventData)
 	// If we use non-blocking writing to the database (InfluxDB recommends batching for better performance),
 	// the write operation status can't be determined at the time of the request.
-	w.WriteHeader(http.StatusOK)
+	jsonResponse(w, http.StatusOK, eventResponse{eventData.EventId, false})
+}
+
+// eventHandler handles the "/events/{id}" API endpoint requests.
+func (server *Server) eventHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[%s] %s\n", r.Method, r.URL.Path)
+	switch r.Method {
+	case http.MethodGet:
+		server.handleEventGet(w, r)
+	default:
+		server.methodNotAllowed(w)
+	}
+}
+
+// handleEventGet handles the GET request on the "/events/{id}" endpoint, returning the event with the event ID.
+func (server *Server) handleEventGet(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, apiBasePath+"/events/")
+	if id == "" || strings.Contains(id, "/") {
+		jsonResponse(w, http.StatusNotFound, errResponse{errEventNotFound, nil})
+		return
+	}
+	binding := requestPrincipal(r).Binding
+	var events []influxdb.BasicEvent
+	// Generated IDs contain the receive time, which is usually close to the timestamp of the event
+	if generated, ok := eventid.Time(id); ok {
+		result, err := server.db.QueryEvents(binding.Restrict(eventQuery(id, generated.Add(-eventLookupWindow), generated.Add(eventLookupWindow))))
+		if err != nil {
+			queryErrorResponse(w, err)
+			return
+		}
+		events = result.Events
+	}
+	if len(events) == 0 {
+		// Events are looked up regardless of their timestamp
+		result, err := server.db.QueryEvents(binding.Restrict(eventQuery(id, time.Unix(0, math.MinInt64), time.Unix(0, math.MaxInt64))))
+		if err != nil {
+			queryErrorResponse(w, err)
+			return
+		}
+		events = result.Events
+	}
+	if len(events) == 0 {
+		jsonResponse(w, http.StatusNotFound, errResponse{errEventNotFound, nil})
+		return
+	}
+	jsonResponse(w, http.StatusOK, events[0])
+}
+
+// eventQuery returns query fields of the event with the event ID and a timestamp in the time range.
+func eventQuery(id string, start, stop time.Time) map[string]any {
+	return map[string]any{
+		influxdb.EventIdFieldName:   id,
+		influxdb.QueryRangeStartTag: start.UTC().Format(time.RFC3339Nano),
+		influxdb.QueryRangeStopTag:  stop.UTC().Format(time.RFC3339Nano),
+		influxdb.QueryLimitTag:      float64(1),
+	}
+}
+
+// validateEvent records the receive time, assigns an event ID when there is none and checks the timestamp, required
+// fields, the entity against the binding of the credentials, the registered schema of event details, types of
+// detail values against stored values and whether the storage backend can store the event. Schema violations of event types in warn mode are only logged.
+func (server *Server) validateEvent(eventData *influxdb.BasicEvent, binding access.Binding) []influxdb.ModelError {
+	now := time.Now()
+	eventData.ReceivedAt = now.UTC()
+	if eventData.EventId == "" {
+		eventData.EventId = eventid.New(now)
+	}
+	problems := eventData.ApplyTimestampPolicy(server.timestamps, now)
+	problems = append(problems, eventData.Validate()...)
+	problems = append(problems, binding.Check(eventData.EntityType, eventData.EntityId)...)
+	if server.flattenDetails {
+		problems = append(problems, influxdb.DetailKeyProblems(eventData.EventDetails)...)
+	}
+	mode, violations := server.schemas.Validate(*eventData)
+	switch {
+	case len(violations) == 0:
+	case mode == schemaregistry.ModeEnforce:
+		problems = append(problems, violations...)
+	case mode == schemaregistry.ModeWarn:
+		log.Printf("[WARNING] Event of type %q (entity %q) violates its schema: %v\n", eventData.EventType, eventData.EntityId, violations)
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	if problems := server.fieldTypes.check(eventData); len(problems) > 0 {
+		return problems
+	}
+	return server.storeProblems(*eventData)
+}
+
+// storeProblems returns a problem when the storage backend can't store the event (e.g. a promoted tag would exceed
+// its cardinality limit), so it's reported before asynchronous writes accept the event.
+func (server *Server) storeProblems(eventData influxdb.BasicEvent) []influxdb.ModelError {
+	checker, ok := server.db.(eventChecker)
+	if !ok {
+		return nil
+	}
+	if err := checker.CheckEvent(eventData); err != nil {
+		return []influxdb.ModelError{{Field: "", Message: err.Error()}}
+	}
+	return nil
+}
+
+// eventsBatchHandler handles the "/events/batch" API endpoint requests.
+func (server *Server) eventsBatchHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[%s] %s\n", r.Method, r.URL.Path)
+	switch r.Method {
+	case http.MethodPost:
+		server.handleEventsBatchPost(w, r)
+	default:
+		server.methodNotAllowed(w)
+	}
+}
+
+// handleEventsBatchPost handles the POST request on the "/events/batch" endpoint. Valid events are stored with a single
+// write, invalid ones are reported by their index so clients can retry only the failures.
+func (server *Server) handleEventsBatchPost(w http.ResponseWriter, r *http.Request) {
+	var rawEvents []json.RawMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBodySize)).Decode(&rawEvents); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			jsonResponse(w, http.StatusRequestEntityTooLarge, errResponse{err.Error(), "use /events/stream for larger uploads"})
+			return
+		}
+		jsonResponse(w, http.StatusBadRequest, errResponse{err.Error(), nil})
+		return
+	}
+	if len(rawEvents) == 0 {
+		jsonResponse(w, http.StatusBadRequest, errResponse{errBadRequestBody, "no events given"})
+		return
+	}
+	idempotencyKey := r.Header.Get(idempotencyKeyHeader)
+	identity := requestPrincipal(r)
+	response := batchResponse{Results: make([]batchItemResult, len(rawEvents))}
+	validEvents := make([]influxdb.BasicEvent, 0, len(rawEvents))
+	for i, rawEvent := range rawEvents {
+		response.Results[i].Index = i
+		var eventData influxdb.BasicEvent
+		if err := json.Unmarshal(rawEvent, &eventData); err != nil {
+			response.Results[i].Problems = []influxdb.ModelError{decodeProblem(err)}
+			response.Rejected++
+			continue
+		}
+		if eventData.EventId == "" && idempotencyKey != "" {
+			eventData.EventId = fmt.Sprintf("%s-%d", idempotencyKey, i)
+		}
+		if problems := server.validateEvent(&eventData, identity.Binding); len(problems) > 0 {
+			response.Results[i].Problems = problems
+			response.Rejected++
+			continue
+		}
+		response.Results[i].EventId = eventData.EventId
+		switch server.dedup.Reserve(identity.Name, eventData.EventId, time.Now()) {
+		case eventid.Stored:
+			response.Results[i].Duplicate = true
+			response.Duplicates++
+			continue
+		case eventid.Pending:
+			response.Results[i].Problems = []influxdb.ModelError{{Field: influxdb.EventIdFieldName, Message: errEventPending}}
+			response.Rejected++
+			continue
+		}
+		response.Results[i].Accepted = true
+		validEvents = append(validEvents, eventData)
+	}
+	if response.Rejected == len(rawEvents) {
+		jsonResponse(w, http.StatusBadRequest, errResponse{errBadRequestBody, response})
+		return
+	}
+	if len(validEvents) > 0 {
+		if err := server.storeEvents(identity.Name, validEvents...); err != nil {
+			server.dedup.Release(identity.Name, eventIds(validEvents)...)
+			storeErrorResponse(w, err, http.StatusInternalServerError)
+			return
+		}
+		server.accepted(identity.Name, validEvents...)
+	}
+	response.Accepted = len(validEvents)
+	status := http.StatusOK
+	if response.Rejected > 0 {
+		status = http.StatusMultiStatus
+	}
+	jsonResponse(w, status, response)
+}
+
+// storeEvents passes events posted with the credentials of scope to the storage backend. Asynchronous backends are
+// told the scope, so their writes are acknowledged to its reservations (see eventsStored).
+func (server *Server) storeEvents(scope string, events ...influxdb.BasicEvent) error {
+	if server.notifier != nil {
+		return server.notifier.StoreEventsFrom(scope, events)
+	} else if len(events) == 1 {
+		return server.db.StoreEvent(events[0])
+	}
+	return server.db.StoreEvents(events)
+}
+
+// accepted is called after the storage backend accepted events of the scope. Synchronous backends have stored them
+// already, asynchronous ones report it once they are written (see eventsStored).
+func (server *Server) accepted(scope string, events ...influxdb.BasicEvent) {
+	if server.notifier == nil {
+		server.eventsStored(scope, events)
+	}
+}
+
+// eventsStored is called once events posted with the credentials of scope were stored, retries of them are
+// acknowledged as duplicates from now on and later events have to use the same field types. The events are published
+// to live subscribers, which only see events that can also be queried.
+func (server *Server) eventsStored(scope string, events []influxdb.BasicEvent) {
+	server.dedup.Commit(scope, eventIds(events)...)
+	server.fieldTypes.record(events)
+	server.hub.Publish(events...)
+}
+
+// eventsDropped is called when an asynchronous write drops events of the scope, so retries of them are stored.
+func (server *Server) eventsDropped(scope string, events []influxdb.BasicEvent) {
+	server.dedup.Release(scope, eventIds(events)...)
+}
+
+// eventIds returns the event IDs of the events.
+func eventIds(events []influxdb.BasicEvent) []string {
+	ids := make([]string, len(events))
+	for i, event := range events {
+		ids[i] = event.EventId
+	}
+	return ids
 }
 
 // eventsQueryHandler handles the "/query/events" API endpoint requests.
@@ -185,14 +545,88 @@ func (server *Server) handleEventsQueryPost(w http.ResponseWriter, r *http.Reque
 		jsonResponse(w, http.StatusBadRequest, errResponse{err.Error(), nil})
 		return
 	}
-	res, err := server.db.QueryEvents(queryFields)
+	res, err := server.db.QueryEvents(requestPrincipal(r).Binding.Restrict(queryFields))
+	if err != nil {
+		queryErrorResponse(w, err)
+		return
+	}
+	jsonResponse(w, http.StatusOK, res)
+}
+
+// aggregateQueryHandler handles the "/query/aggregate" API endpoint requests.
+func (server *Server) aggregateQueryHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[%s] %s\n", r.Method, r.URL.Path)
+	switch r.Method {
+	case http.MethodPost:
+		server.handleAggregateQueryPost(w, r)
+	default:
+		server.methodNotAllowed(w)
+	}
+}
+
+// handleAggregateQueryPost handles POST requests on the "/query/aggregate" endpoint.
+func (server *Server) handleAggregateQueryPost(w http.ResponseWriter, r *http.Request) {
+	var queryFields map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&queryFields); err != nil && err != io.EOF {
+		jsonResponse(w, http.StatusBadRequest, errResponse{err.Error(), nil})
+		return
+	}
+	res, err := server.db.AggregateEvents(requestPrincipal(r).Binding.Restrict(queryFields))
 	if err != nil {
-		jsonResponse(w, http.StatusInternalServerError, errResponse{err.Error(), nil})
+		queryErrorResponse(w, err)
 		return
 	}
 	jsonResponse(w, http.StatusOK, res)
 }
 
+// writeStatusHandler handles the "/status/writes" API endpoint requests.
+func (server *Server) writeStatusHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[%s] %s\n", r.Method, r.URL.Path)
+	switch r.Method {
+	case http.MethodGet:
+		reporter, ok := server.db.(writeStatsReporter)
+		if !ok {
+			jsonResponse(w, http.StatusNotFound, errResponse{"asynchronous writes are not enabled", nil})
+			return
+		}
+		jsonResponse(w, http.StatusOK, reporter.Stats())
+	default:
+		server.methodNotAllowed(w)
+	}
+}
+
+// queryErrorResponse writes a query error to the client. Problems with the query payload are reported as bad requests.
+func queryErrorResponse(w http.ResponseWriter, err error) {
+	var queryErr *influxdb.QueryError
+	if errors.As(err, &queryErr) {
+		jsonResponse(w, http.StatusBadRequest, errResponse{influxdb.ErrInvalidQuery.Error(), queryErr.Problems})
+		return
+	}
+	jsonResponse(w, http.StatusInternalServerError, errResponse{err.Error(), nil})
+}
+
+// storeErrorResponse writes a storage backend error to the client. A full write buffer is reported as temporary
+// unavailability, events the backend refuses (e.g. an exceeded tag cardinality limit) as a bad request, other errors
+// with the given status.
+func storeErrorResponse(w http.ResponseWriter, err error, status int) {
+	if errors.Is(err, asyncstore.ErrBufferFull) || errors.Is(err, asyncstore.ErrClosed) {
+		w.Header().Set("Retry-After", "1")
+		status = http.StatusServiceUnavailable
+	} else if influxdb.IsPermanent(err) {
+		status = http.StatusBadRequest
+	}
+	jsonResponse(w, status, errResponse{err.Error(), nil})
+}
+
+// decodeProblem converts a JSON decoding error to a ModelError, naming the offending field when known.
+func decodeProblem(err error) influxdb.ModelError {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return influxdb.ModelError{Field: typeErr.Field, Message: fmt.Sprintf("expected %s, got %s", typeErr.Type, typeErr.Value)}
+	}
+	return influxdb.ModelError{Field: "", Message: err.Error()}
+}
+
 // methodNotAllowed writes the equally named HTTP status to given ResponseWriter.
 func (server *Server) methodNotAllowed(w http.ResponseWriter) {
 	jsonResponse(w, http.StatusMethodNotAllowed, errResponse{http.StatusText(http.StatusMethodNotAllowed), nil})
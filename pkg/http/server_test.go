@@ -0,0 +1,246 @@
+package http
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/access"
+	"github.com/rubinda/logtopus/pkg/apikeys"
+	"github.com/rubinda/logtopus/pkg/influxdb"
+	"github.com/rubinda/logtopus/pkg/memstore"
+	"github.com/rubinda/logtopus/pkg/sessions"
+	"github.com/rubinda/logtopus/pkg/userstore"
+)
+
+// testPassword is the password of users created by newTestServer.
+const testPassword string = "correct horse battery"
+
+// testServer is a server with in-memory events and stores in a temporary directory.
+type testServer struct {
+	*Server
+	// handler serves the API endpoints.
+	handler http.Handler
+	// dir contains the store and key files.
+	dir string
+}
+
+// newTestServer returns a server storing events in memory, with an admin "admin" and an ingest-only user "agent".
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	dir := t.TempDir()
+	privateKeyPath, publicKeyPath := writeKeyPair(t, dir, "jwt")
+	users, err := userstore.Open(filepath.Join(dir, "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := apikeys.Open(filepath.Join(dir, "apikeys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionStore, err := sessions.Open(filepath.Join(dir, "sessions.json"), time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := newServer(Configuration{
+		DB:             memstore.New(),
+		Users:          users,
+		APIKeys:        keys,
+		Sessions:       sessionStore,
+		AccessTokenTTL: time.Hour,
+		JWTKeyPath:     privateKeyPath,
+		JWTPubKeyPath:  publicKeyPath,
+		DedupWindow:    time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for username, scopes := range map[string][]string{"admin": access.AllScopes, "agent": {access.ScopeIngest}} {
+		if _, problems, err := users.Create(username, testPassword, scopes); err != nil || len(problems) > 0 {
+			t.Fatalf("can't create %s: %v %v", username, err, problems)
+		}
+	}
+	return &testServer{Server: server, handler: server.routes(), dir: dir}
+}
+
+// token issues a token of the user.
+func (s *testServer) token(t *testing.T, username string, binding access.Binding) string {
+	t.Helper()
+	token, err := s.jwtAuth.IssueToken(username, nil, binding, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// request sends a request with the token (when not empty) and JSON body, and decodes the JSON response into result
+// (when not nil). Returns the response.
+func (s *testServer) request(t *testing.T, method, path, token, body string, result any) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, apiBasePath+path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Token", token)
+	}
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, r)
+	if result != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), result); err != nil {
+			t.Fatalf("%s %s: can't decode response %q: %s", method, path, w.Body.String(), err)
+		}
+	}
+	return w
+}
+
+// writeKeyPair writes a new Ed25519 key pair in PEM format to "<name>.key" and "<name>.pub" in the directory.
+func writeKeyPair(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privatePath, publicPath := filepath.Join(dir, name+privateKeyExtension), filepath.Join(dir, name+publicKeyExtension)
+	if err := os.WriteFile(privatePath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(publicPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return privatePath, publicPath
+}
+
+// TestEventsPost stores events on "/events" and checks validation and deduplication.
+func TestEventsPost(t *testing.T) {
+	s := newTestServer(t)
+	token := s.token(t, "agent", access.Binding{})
+	tests := []struct {
+		name      string
+		body      string
+		status    int
+		duplicate bool
+		problems  []string
+	}{
+		{"valid", `{"eventId": "e1", "entityId": "plex001", "entityType": "mediaServer", "eventType": "downtime", "details": {"severity": 4}}`, http.StatusOK, false, nil},
+		{"retry", `{"eventId": "e1", "entityId": "plex001", "entityType": "mediaServer", "eventType": "downtime", "details": {"severity": 4}}`, http.StatusOK, true, nil},
+		{"missing fields", `{"entityType": "mediaServer"}`, http.StatusBadRequest, false, []string{"entityId", "eventType"}},
+		{"reserved key", `{"entityId": "plex001", "entityType": "mediaServer", "eventType": "downtime", "details": {"eventId": "x"}}`, http.StatusBadRequest, false, []string{"details.eventId"}},
+		{"type conflict", `{"entityId": "plex001", "entityType": "mediaServer", "eventType": "downtime", "details": {"severity": "high"}}`, http.StatusBadRequest, false, []string{"details.severity"}},
+		{"widened", `{"entityId": "plex001", "entityType": "mediaServer", "eventType": "load", "details": {"load": 0.5}}`, http.StatusOK, false, nil},
+		{"integer of a float field", `{"entityId": "plex001", "entityType": "mediaServer", "eventType": "load", "details": {"load": 1}}`, http.StatusOK, false, nil},
+		{"malformed", `{"entityId": `, http.StatusBadRequest, false, nil},
+	}
+	for _, test := range tests {
+		var response struct {
+			eventResponse
+			Details []influxdb.ModelError `json:"details"`
+		}
+		w := s.request(t, http.MethodPost, "/events", token, test.body, &response)
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d: %s", test.name, test.status, w.Code, w.Body)
+			continue
+		}
+		if w.Code == http.StatusOK && (response.EventId == "" || response.Duplicate != test.duplicate) {
+			t.Errorf("%s: unexpected response %s", test.name, w.Body)
+		}
+		for i, field := range test.problems {
+			if i >= len(response.Details) || response.Details[i].Field != field {
+				t.Errorf("%s: expected a problem with %s, got %s", test.name, field, w.Body)
+			}
+		}
+	}
+	var result influxdb.QueryResult
+	s.request(t, http.MethodPost, "/query/events", s.token(t, "admin", access.Binding{}), `{"_timeFrom": "-1h"}`, &result)
+	if len(result.Events) != 3 {
+		t.Fatalf("expected 3 stored events, got %d", len(result.Events))
+	}
+	if load := result.Events[2].EventDetails["load"]; load != json.Number("1.0") && load != 1.0 {
+		t.Errorf("expected the integer to be stored as a float, got %v (%T)", load, load)
+	}
+	if w := s.request(t, http.MethodPost, "/events", "", tests[0].body, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("without a token: expected status %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+	if w := s.request(t, http.MethodGet, "/events", token, "", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: expected status %d, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+}
+
+// TestEventsQueryPost queries events stored in memory on "/query/events".
+func TestEventsQueryPost(t *testing.T) {
+	s := newTestServer(t)
+	ingest := s.token(t, "agent", access.Binding{})
+	for i, body := range []string{
+		`{"entityId": "plex001", "entityType": "mediaServer", "eventType": "downtime", "details": {"severity": 4, "region": "eu"}}`,
+		`{"entityId": "plex002", "entityType": "mediaServer", "eventType": "downtime", "details": {"severity": 2, "region": "us"}}`,
+		`{"entityId": "db001", "entityType": "database", "eventType": "restart", "details": {"severity": 5}}`,
+	} {
+		if w := s.request(t, http.MethodPost, "/events", ingest, body, nil); w.Code != http.StatusOK {
+			t.Fatalf("event %d: expected status %d, got %d: %s", i, http.StatusOK, w.Code, w.Body)
+		}
+	}
+	token := s.token(t, "admin", access.Binding{})
+	tests := []struct {
+		body     string
+		status   int
+		entities []string
+	}{
+		{``, http.StatusOK, []string{"plex001", "plex002", "db001"}},
+		{`{"entityType": "mediaServer"}`, http.StatusOK, []string{"plex001", "plex002"}},
+		{`{"severity": {"$gte": 4}, "_sort": "severity:desc"}`, http.StatusOK, []string{"db001", "plex001"}},
+		{`{"$or": [{"region": "us"}, {"eventType": "restart"}]}`, http.StatusOK, []string{"plex002", "db001"}},
+		{`{"region": {"$exists": false}}`, http.StatusOK, []string{"db001"}},
+		{`{"severity": {"$between": 1}}`, http.StatusBadRequest, nil},
+		{`{"_limit": 0}`, http.StatusBadRequest, nil},
+		{`[1]`, http.StatusBadRequest, nil},
+	}
+	for _, test := range tests {
+		var result influxdb.QueryResult
+		w := s.request(t, http.MethodPost, "/query/events", token, test.body, nil)
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d: %s", test.body, test.status, w.Code, w.Body)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		entities := make([]string, len(result.Events))
+		for i, event := range result.Events {
+			entities[i] = event.EntityId
+		}
+		if strings.Join(entities, ",") != strings.Join(test.entities, ",") {
+			t.Errorf("%s: expected %v, got %v", test.body, test.entities, entities)
+		}
+	}
+	// Pages continue after the last event
+	var page influxdb.QueryResult
+	s.request(t, http.MethodPost, "/query/events", token, `{"_limit": 2}`, &page)
+	if len(page.Events) != 2 || page.NextCursor == "" {
+		t.Fatalf("expected a first page of 2 events with a cursor, got %+v", page)
+	}
+	var last influxdb.QueryResult
+	s.request(t, http.MethodPost, "/query/events", token, `{"_limit": 2, "_cursor": "`+page.NextCursor+`"}`, &last)
+	if len(last.Events) != 1 || last.Events[0].EntityId != "db001" || last.NextCursor != "" {
+		t.Errorf("expected a last page with db001, got %+v", last)
+	}
+	if w := s.request(t, http.MethodPost, "/query/events", token, `{"_cursor": "`+page.NextCursor+`x"}`, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid cursor: expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
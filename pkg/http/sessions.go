@@ -0,0 +1,112 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/sessions"
+)
+
+// refreshHandler handles the "/auth/refresh" API endpoint requests.
+func (server *Server) refreshHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[%s] %s\n", r.Method, r.URL.Path)
+	switch r.Method {
+	case http.MethodPost:
+		server.handleRefreshPost(w, r)
+	default:
+		server.methodNotAllowed(w)
+	}
+}
+
+// handleRefreshPost exchanges a refresh token for a new access token and refresh token.
+func (server *Server) handleRefreshPost(w http.ResponseWriter, r *http.Request) {
+	var request refreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		jsonResponse(w, http.StatusBadRequest, errResponse{err.Error(), nil})
+		return
+	}
+	now := time.Now()
+	session, refreshToken, err := server.sessions.Refresh(request.RefreshToken, now)
+	if errors.Is(err, sessions.ErrInvalidToken) || errors.Is(err, sessions.ErrTokenReused) {
+		jsonResponse(w, http.StatusUnauthorized, errResponse{err.Error(), nil})
+		return
+	} else if err != nil {
+		log.Printf("[WARNING] Can't save session store: %s\n", err)
+		jsonResponse(w, http.StatusInternalServerError, errResponse{errSavingSessions, nil})
+		return
+	}
+	if user, err := server.users.Get(session.Username); err != nil || user.Disabled {
+		if err := server.sessions.Revoke(now, session.Id); err != nil {
+			log.Printf("[WARNING] Can't save session store: %s\n", err)
+		}
+		jsonResponse(w, http.StatusUnauthorized, errResponse{ErrUserDisabled.Error(), nil})
+		return
+	}
+	server.issueTokens(w, session, refreshToken)
+}
+
+// logoutHandler handles the "/auth/logout" API endpoint requests.
+func (server *Server) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[%s] %s\n", r.Method, r.URL.Path)
+	switch r.Method {
+	case http.MethodPost:
+		server.handleLogoutPost(w, r)
+	default:
+		server.methodNotAllowed(w)
+	}
+}
+
+// handleLogoutPost revokes the token in the "Token" header and ends its session, so neither the token, other
+// tokens of the session nor its refresh token are accepted anymore. Instead (or as well), the session of a refresh
+// token in the body is ended, so sessions can be ended after their tokens expired.
+func (server *Server) handleLogoutPost(w http.ResponseWriter, r *http.Request) {
+	var request refreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		jsonResponse(w, http.StatusBadRequest, errResponse{err.Error(), nil})
+		return
+	}
+	if r.Header["Token"] == nil && request.RefreshToken == "" {
+		jsonResponse(w, http.StatusUnauthorized, errResponse{ErrLogoutCredentials.Error(), nil})
+		return
+	}
+	now := time.Now()
+	if request.RefreshToken != "" {
+		err := server.sessions.End(request.RefreshToken, now)
+		if errors.Is(err, sessions.ErrInvalidToken) {
+			jsonResponse(w, http.StatusUnauthorized, errResponse{err.Error(), nil})
+			return
+		} else if err != nil {
+			log.Printf("[WARNING] Can't save session store: %s\n", err)
+			jsonResponse(w, http.StatusInternalServerError, errResponse{errSavingSessions, nil})
+			return
+		}
+	}
+	if r.Header["Token"] != nil {
+		token, err := server.jwtAuth.ValidateToken(r.Header["Token"][0])
+		if err != nil {
+			jsonResponse(w, http.StatusUnauthorized, errResponse{err.Error(), nil})
+			return
+		}
+		claims := tokenClaims(token)
+		if err := server.sessions.Revoke(now, claims.ID, claims.SessionId); err != nil {
+			log.Printf("[WARNING] Can't save session store: %s\n", err)
+			jsonResponse(w, http.StatusInternalServerError, errResponse{errSavingSessions, nil})
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// issueTokens responds with a new access token of the session and its refresh token.
+func (server *Server) issueTokens(w http.ResponseWriter, session sessions.Session, refreshToken string) {
+	token, err := server.jwtAuth.IssueToken(session.Username, session.Scopes, session.Binding, session.Id)
+	if err != nil {
+		jsonResponse(w, http.StatusInternalServerError, errResponse{"An error occurred while issuing your token. Please contact an administrator.", nil})
+		return
+	}
+	jsonResponse(w, http.StatusOK, tokenResponse{token, int(server.jwtAuth.ttl.Seconds()), refreshToken, session.ExpiresAt})
+}
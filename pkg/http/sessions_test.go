@@ -0,0 +1,81 @@
+package http
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/rubinda/logtopus/pkg/sessions"
+)
+
+// TestSessions logs in, rotates the refresh token and ends the session when a rotated token is reused.
+func TestSessions(t *testing.T) {
+	s := newTestServer(t)
+	if w := s.request(t, http.MethodPost, "/auth", "", `{"user": "agent", "pass": "wrong password"}`, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong password: expected status %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+	if w := s.request(t, http.MethodPost, "/auth", "", `{"user": "agent", "pass": "`+testPassword+`", "scopes": ["query"]}`, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("scope of another user: expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+	var login tokenResponse
+	if w := s.request(t, http.MethodPost, "/auth", "", `{"user": "agent", "pass": "`+testPassword+`"}`, &login); w.Code != http.StatusOK || login.Token == "" || login.RefreshToken == "" {
+		t.Fatalf("expected tokens, got %d: %s", w.Code, w.Body)
+	}
+	var refreshed tokenResponse
+	if w := s.request(t, http.MethodPost, "/auth/refresh", "", `{"refreshToken": "`+login.RefreshToken+`"}`, &refreshed); w.Code != http.StatusOK || refreshed.RefreshToken == login.RefreshToken {
+		t.Fatalf("expected a rotated refresh token, got %d: %s", w.Code, w.Body)
+	}
+	if w := s.request(t, http.MethodPost, "/events", refreshed.Token, `{"entityId": "plex001", "entityType": "mediaServer", "eventType": "downtime"}`, nil); w.Code != http.StatusOK {
+		t.Errorf("expected the refreshed token to be accepted, got %d: %s", w.Code, w.Body)
+	}
+
+	// Reusing the rotated token ends the session, including access tokens issued in it
+	var reused errResponse
+	if w := s.request(t, http.MethodPost, "/auth/refresh", "", `{"refreshToken": "`+login.RefreshToken+`"}`, &reused); w.Code != http.StatusUnauthorized || reused.Message != sessions.ErrTokenReused.Error() {
+		t.Errorf("reused token: expected status %d with %q, got %d: %s", http.StatusUnauthorized, sessions.ErrTokenReused, w.Code, w.Body)
+	}
+	for _, token := range []string{login.Token, refreshed.Token} {
+		if w := s.request(t, http.MethodPost, "/events", token, `{}`, nil); w.Code != http.StatusUnauthorized {
+			t.Errorf("expected tokens of the ended session to be rejected, got %d", w.Code)
+		}
+	}
+	if w := s.request(t, http.MethodPost, "/auth/refresh", "", `{"refreshToken": "`+refreshed.RefreshToken+`"}`, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("latest token of the ended session: expected status %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+// TestLogout ends sessions by access token or refresh token.
+func TestLogout(t *testing.T) {
+	s := newTestServer(t)
+	login := func() tokenResponse {
+		var response tokenResponse
+		if w := s.request(t, http.MethodPost, "/auth", "", `{"user": "admin", "pass": "`+testPassword+`"}`, &response); w.Code != http.StatusOK {
+			t.Fatalf("expected tokens, got %d: %s", w.Code, w.Body)
+		}
+		return response
+	}
+	if w := s.request(t, http.MethodPost, "/auth/logout", "", "", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("without credentials: expected status %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	first := login()
+	if w := s.request(t, http.MethodPost, "/auth/logout", first.Token, "", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body)
+	}
+	if w := s.request(t, http.MethodGet, "/admin/users", first.Token, "", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the access token to be revoked, got %d", w.Code)
+	}
+	if w := s.request(t, http.MethodPost, "/auth/refresh", "", `{"refreshToken": "`+first.RefreshToken+`"}`, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the session to end, got %d", w.Code)
+	}
+
+	second := login()
+	if w := s.request(t, http.MethodPost, "/auth/logout", "", `{"refreshToken": "`+second.RefreshToken+`"}`, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body)
+	}
+	if w := s.request(t, http.MethodGet, "/admin/users", second.Token, "", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected access tokens of the session to be revoked, got %d", w.Code)
+	}
+	if w := s.request(t, http.MethodPost, "/auth/logout", "", `{"refreshToken": "`+second.RefreshToken+`"}`, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("ended session: expected status %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
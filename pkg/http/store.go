@@ -0,0 +1,111 @@
+package http
+
+import (
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/access"
+	"github.com/rubinda/logtopus/pkg/apikeys"
+	"github.com/rubinda/logtopus/pkg/asyncstore"
+	"github.com/rubinda/logtopus/pkg/influxdb"
+	"github.com/rubinda/logtopus/pkg/sessions"
+	"github.com/rubinda/logtopus/pkg/userstore"
+)
+
+// Ensure the InfluxDB client and the asynchronous write pipeline can be used as storage backends.
+var (
+	_ EventStore         = (*influxdb.Client)(nil)
+	_ EventStore         = (*asyncstore.Store)(nil)
+	_ writeStatsReporter = (*asyncstore.Store)(nil)
+	_ eventChecker       = (*influxdb.Client)(nil)
+	_ eventChecker       = (*asyncstore.Store)(nil)
+	_ writeNotifier      = (*asyncstore.Store)(nil)
+	_ UserStore          = (*userstore.Store)(nil)
+	_ APIKeyStore        = (*apikeys.Store)(nil)
+	_ SessionStore       = (*sessions.Store)(nil)
+)
+
+// EventStore contains methods the HTTP server needs from a storage backend.
+type EventStore interface {
+	// StoreEvent writes event data to the storage backend.
+	StoreEvent(eventData influxdb.BasicEvent) error
+	// StoreEvents writes multiple events to the storage backend in a single operation.
+	StoreEvents(events []influxdb.BasicEvent) error
+	// QueryEvents returns a page of events matching given query fields (see "/query/events" for the accepted structure).
+	QueryEvents(queryFields map[string]any) (influxdb.QueryResult, error)
+	// AggregateEvents summarizes events matching given query fields (see "/query/aggregate" for the accepted structure).
+	AggregateEvents(queryFields map[string]any) (influxdb.AggregateResult, error)
+	// DistinctValues lists distinct values of entityType, eventType or entityId for events in the time range.
+	DistinctValues(field string, start, stop time.Time) ([]string, error)
+	// DetailFields lists detail field keys and their types for events in the time range, of all entity types
+	// when entityType is empty.
+	DetailFields(entityType string, start, stop time.Time) ([]influxdb.DetailField, error)
+	// Disconnect (gracefully) releases resources held by the storage backend.
+	Disconnect()
+}
+
+// writeStatsReporter is implemented by storage backends which write asynchronously.
+type writeStatsReporter interface {
+	// Stats returns write pipeline counters.
+	Stats() asyncstore.Stats
+}
+
+// writeNotifier is implemented by storage backends which store events after accepting them.
+type writeNotifier interface {
+	// StoreEventsFrom accepts events of the source (the name of the credentials they were posted with) for writing.
+	StoreEventsFrom(source string, events []influxdb.BasicEvent) error
+	// Notify registers callbacks for events of a source which were written and events which were dropped.
+	Notify(onWritten, onDropped func(source string, events []influxdb.BasicEvent))
+}
+
+// eventChecker is implemented by storage backends which can refuse events, so events are checked before they are
+// accepted (even when written asynchronously).
+type eventChecker interface {
+	// CheckEvent returns why the event can't be stored.
+	CheckEvent(eventData influxdb.BasicEvent) error
+	// TagKeys lists detail keys stored as tags, their values are stored as strings whatever their type.
+	TagKeys() []string
+}
+
+// UserStore contains methods the HTTP server needs from a user store.
+type UserStore interface {
+	// Create adds a user with the password and scopes. Invalid usernames, passwords and scopes are reported as problems.
+	Create(username, password string, scopes []string) (userstore.User, []influxdb.ModelError, error)
+	// Authenticate returns the user when the password matches and the user isn't disabled.
+	Authenticate(username, password string) (userstore.User, error)
+	// Get returns the user with the username.
+	Get(username string) (userstore.User, error)
+	// List returns all users ordered by username.
+	List() []userstore.User
+	// Update disables or enables the user (unless disabled is nil) and replaces its scopes (unless scopes is nil).
+	Update(username string, disabled *bool, scopes []string) (userstore.User, []influxdb.ModelError, error)
+	// Delete removes the user.
+	Delete(username string) error
+}
+
+// APIKeyStore contains methods the HTTP server needs from an API key store.
+type APIKeyStore interface {
+	// Create mints a key for the event source with the scopes and binding, expiring at expiresAt unless it is nil.
+	// Returns the key description and the key itself. Invalid parameters are reported as problems.
+	Create(source string, scopes []string, binding access.Binding, expiresAt *time.Time, now time.Time) (apikeys.Key, string, []influxdb.ModelError, error)
+	// Authenticate returns the description of a valid key and records its use.
+	Authenticate(key string, now time.Time) (apikeys.Key, error)
+	// Get returns the key with the id.
+	Get(id string) (apikeys.Key, error)
+	// List returns all keys (including revoked ones) ordered by creation.
+	List() []apikeys.Key
+	// Revoke stops accepting the key and returns its updated description.
+	Revoke(id string, now time.Time) (apikeys.Key, error)
+}
+
+// SessionStore contains methods the HTTP server needs from a session store.
+type SessionStore interface {
+	RevocationList
+	// Start begins a session of the user with the scopes and binding. Returns the session and its first refresh token.
+	Start(username string, scopes []string, binding access.Binding, now time.Time) (sessions.Session, string, error)
+	// Refresh exchanges a refresh token for a new one. Returns the session and the new refresh token.
+	Refresh(token string, now time.Time) (sessions.Session, string, error)
+	// End ends the session of a refresh token.
+	End(token string, now time.Time) error
+	// Revoke stops accepting access tokens and sessions with the identifiers.
+	Revoke(now time.Time, ids ...string) error
+}
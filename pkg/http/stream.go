@@ -0,0 +1,172 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/asyncstore"
+	"github.com/rubinda/logtopus/pkg/eventid"
+	"github.com/rubinda/logtopus/pkg/influxdb"
+)
+
+const (
+	// ndjsonContentType is the media type for newline delimited JSON.
+	ndjsonContentType string = "application/x-ndjson"
+	// streamChunkSize is the number of events written to the storage backend at once.
+	streamChunkSize int = 500
+	// maxStreamLineSize is the largest accepted line (a single event) in bytes.
+	maxStreamLineSize int = 1 << 20
+	// maxReportedLineErrors limits the number of line errors included in a response.
+	maxReportedLineErrors int = 1000
+	// streamChunkTimeout is how long reading a chunk of events (and writing the response) may take. Deadlines are
+	// extended with each chunk, so long streams aren't cut off by the server timeouts.
+	streamChunkTimeout time.Duration = 30 * time.Second
+)
+
+// eventsStreamHandler handles the "/events/stream" API endpoint requests.
+func (server *Server) eventsStreamHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[%s] %s\n", r.Method, r.URL.Path)
+	switch r.Method {
+	case http.MethodPost:
+		server.handleEventsStreamPost(w, r)
+	default:
+		server.methodNotAllowed(w)
+	}
+}
+
+// handleEventsStreamPost handles the POST request on the "/events/stream" endpoint. The body contains one event per
+// line (optionally gzip compressed), which are decoded incrementally and stored in chunks.
+func (server *Server) handleEventsStreamPost(w http.ResponseWriter, r *http.Request) {
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || mediaType != ndjsonContentType {
+			jsonResponse(w, http.StatusUnsupportedMediaType, errResponse{"expected Content-Type " + ndjsonContentType, nil})
+			return
+		}
+	}
+	var body io.Reader = r.Body
+	switch strings.ToLower(r.Header.Get("Content-Encoding")) {
+	case "", "identity":
+	case "gzip":
+		gzipReader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			jsonResponse(w, http.StatusBadRequest, errResponse{err.Error(), nil})
+			return
+		}
+		defer gzipReader.Close()
+		body = gzipReader
+	default:
+		jsonResponse(w, http.StatusUnsupportedMediaType, errResponse{"unsupported Content-Encoding, use gzip or none", nil})
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	extendDeadlines := func() {
+		// Not supported by every ResponseWriter, the server timeouts apply then
+		deadline := time.Now().Add(streamChunkTimeout)
+		rc.SetReadDeadline(deadline)
+		rc.SetWriteDeadline(deadline)
+	}
+	extendDeadlines()
+
+	response := streamResponse{Errors: make([]streamLineError, 0)}
+	reject := func(line int, problems []influxdb.ModelError) {
+		response.Rejected++
+		if len(response.Errors) < maxReportedLineErrors {
+			response.Errors = append(response.Errors, streamLineError{line, problems})
+		}
+	}
+	identity := requestPrincipal(r)
+	chunk := make([]influxdb.BasicEvent, 0, streamChunkSize)
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		if err := server.storeEvents(identity.Name, chunk...); err != nil {
+			server.dedup.Release(identity.Name, eventIds(chunk)...)
+			return err
+		}
+		server.accepted(identity.Name, chunk...)
+		response.Accepted += len(chunk)
+		chunk = chunk[:0]
+		extendDeadlines()
+		return nil
+	}
+
+	idempotencyKey := r.Header.Get(idempotencyKeyHeader)
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxStreamLineSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+		var eventData influxdb.BasicEvent
+		if err := json.Unmarshal(raw, &eventData); err != nil {
+			reject(line, []influxdb.ModelError{decodeProblem(err)})
+			continue
+		}
+		if eventData.EventId == "" && idempotencyKey != "" {
+			eventData.EventId = fmt.Sprintf("%s-%d", idempotencyKey, line)
+		}
+		if problems := server.validateEvent(&eventData, identity.Binding); len(problems) > 0 {
+			reject(line, problems)
+			continue
+		}
+		switch server.dedup.Reserve(identity.Name, eventData.EventId, time.Now()) {
+		case eventid.Stored:
+			response.Duplicates++
+			continue
+		case eventid.Pending:
+			reject(line, []influxdb.ModelError{{Field: influxdb.EventIdFieldName, Message: errEventPending}})
+			continue
+		}
+		chunk = append(chunk, eventData)
+		if len(chunk) == streamChunkSize {
+			if err := flush(); err != nil {
+				streamErrorResponse(w, err, response)
+				return
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		// Store what was decoded so far, the client is informed how far we got
+		if flushErr := flush(); flushErr != nil {
+			streamErrorResponse(w, flushErr, response)
+			return
+		}
+		jsonResponse(w, http.StatusBadRequest, errResponse{err.Error(), response})
+		return
+	}
+	if err := flush(); err != nil {
+		streamErrorResponse(w, err, response)
+		return
+	}
+	jsonResponse(w, http.StatusOK, response)
+}
+
+// streamErrorResponse reports a storage backend error together with the progress made so far. Events the backend
+// refuses (e.g. exceeding a tag cardinality limit) are reported as a bad request.
+func streamErrorResponse(w http.ResponseWriter, err error, progress streamResponse) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, asyncstore.ErrBufferFull) || errors.Is(err, asyncstore.ErrClosed) {
+		w.Header().Set("Retry-After", "1")
+		status = http.StatusServiceUnavailable
+	} else if influxdb.IsPermanent(err) {
+		status = http.StatusBadRequest
+	}
+	log.Printf("[WARNING] Storing streamed events failed: %s\n", err)
+	jsonResponse(w, status, errResponse{errStoringEvents, progress})
+}
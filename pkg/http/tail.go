@@ -0,0 +1,103 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/eventquery"
+)
+
+const (
+	// tailBufferSize is the number of events buffered for each live tail subscriber.
+	tailBufferSize int = 256
+	// tailHeartbeatInterval is the time between heartbeats on idle live tail connections.
+	tailHeartbeatInterval time.Duration = 15 * time.Second
+)
+
+// eventsTailHandler handles the "/events/tail" API endpoint requests.
+func (server *Server) eventsTailHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[%s] %s\n", r.Method, r.URL.Path)
+	switch r.Method {
+	case http.MethodGet:
+		server.handleEventsTailGet(w, r)
+	default:
+		server.methodNotAllowed(w)
+	}
+}
+
+// handleEventsTailGet streams newly stored events as Server-Sent Events. Events can be filtered with the "filter"
+// URL parameter, a JSON object with the same conditions as accepted by "/query/events".
+func (server *Server) handleEventsTailGet(w http.ResponseWriter, r *http.Request) {
+	queryFields := make(map[string]any)
+	if filter := r.URL.Query().Get("filter"); filter != "" {
+		if err := json.Unmarshal([]byte(filter), &queryFields); err != nil {
+			jsonResponse(w, http.StatusBadRequest, errResponse{err.Error(), nil})
+			return
+		}
+	}
+	query, err := eventquery.ParseFilter(requestPrincipal(r).Binding.Restrict(queryFields))
+	if err != nil {
+		queryErrorResponse(w, err)
+		return
+	}
+	// The connection stays open, so the server write timeout doesn't apply
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		jsonResponse(w, http.StatusInternalServerError, errResponse{"streaming is not supported", nil})
+		return
+	}
+	subscription := server.hub.Subscribe(query)
+	defer subscription.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	heartbeat := time.NewTicker(tailHeartbeatInterval)
+	defer heartbeat.Stop()
+	var reportedDrops uint64
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-subscription.Events():
+			if !ok {
+				// Server is shutting down
+				return
+			}
+			if err := writeServerSentEvent(w, "event", event); err != nil {
+				return
+			}
+			if dropped := subscription.Dropped(); dropped != reportedDrops {
+				reportedDrops = dropped
+				if err := writeServerSentEvent(w, "dropped", map[string]uint64{"dropped": dropped}); err != nil {
+					return
+				}
+			}
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// writeServerSentEvent writes a named event with JSON encoded data in the Server-Sent Events format.
+func writeServerSentEvent(w io.Writer, name string, data any) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, b)
+	return err
+}
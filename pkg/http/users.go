@@ -0,0 +1,105 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/rubinda/logtopus/pkg/userstore"
+)
+
+// usersHandler handles the "/admin/users" API endpoint requests.
+func (server *Server) usersHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[%s] %s\n", r.Method, r.URL.Path)
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, http.StatusOK, userListResponse{server.users.List()})
+	case http.MethodPost:
+		server.handleUsersPost(w, r)
+	default:
+		server.methodNotAllowed(w)
+	}
+}
+
+// handleUsersPost creates a user.
+func (server *Server) handleUsersPost(w http.ResponseWriter, r *http.Request) {
+	var request createUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		jsonResponse(w, http.StatusBadRequest, errResponse{err.Error(), nil})
+		return
+	}
+	user, problems, err := server.users.Create(request.Username, request.Password, request.Scopes)
+	if len(problems) > 0 {
+		jsonResponse(w, http.StatusBadRequest, errResponse{errBadRequestBody, problems})
+		return
+	}
+	if err != nil {
+		log.Printf("[WARNING] Can't save user store: %s\n", err)
+		jsonResponse(w, http.StatusInternalServerError, errResponse{errSavingUsers, nil})
+		return
+	}
+	jsonResponse(w, http.StatusCreated, user)
+}
+
+// userHandler handles the "/admin/users/{username}" API endpoint requests.
+func (server *Server) userHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[%s] %s\n", r.Method, r.URL.Path)
+	username := strings.TrimPrefix(r.URL.Path, apiBasePath+"/admin/users/")
+	switch r.Method {
+	case http.MethodGet:
+		user, err := server.users.Get(username)
+		if err != nil {
+			userErrorResponse(w, err)
+			return
+		}
+		jsonResponse(w, http.StatusOK, user)
+	case http.MethodPatch:
+		server.handleUserPatch(w, r, username)
+	case http.MethodDelete:
+		if err := server.users.Delete(username); err != nil {
+			userErrorResponse(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		server.methodNotAllowed(w)
+	}
+}
+
+// handleUserPatch disables or enables a user, or changes its scopes.
+func (server *Server) handleUserPatch(w http.ResponseWriter, r *http.Request, username string) {
+	var request updateUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		jsonResponse(w, http.StatusBadRequest, errResponse{err.Error(), nil})
+		return
+	}
+	if request.Disabled == nil && request.Scopes == nil {
+		jsonResponse(w, http.StatusBadRequest, errResponse{errBadRequestBody, "expected disabled or scopes"})
+		return
+	}
+	user, problems, err := server.users.Update(username, request.Disabled, request.Scopes)
+	if len(problems) > 0 {
+		jsonResponse(w, http.StatusBadRequest, errResponse{errBadRequestBody, problems})
+		return
+	}
+	if err != nil {
+		userErrorResponse(w, err)
+		return
+	}
+	jsonResponse(w, http.StatusOK, user)
+}
+
+// userErrorResponse responds with the status matching a user store error.
+func userErrorResponse(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, userstore.ErrNotFound):
+		jsonResponse(w, http.StatusNotFound, errResponse{err.Error(), nil})
+	case errors.Is(err, userstore.ErrLastAdmin):
+		jsonResponse(w, http.StatusConflict, errResponse{err.Error(), nil})
+	default:
+		log.Printf("[WARNING] Can't save user store: %s\n", err)
+		jsonResponse(w, http.StatusInternalServerError, errResponse{errSavingUsers, nil})
+	}
+}
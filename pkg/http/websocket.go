@@ -0,0 +1,373 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rubinda/logtopus/pkg/access"
+	"github.com/rubinda/logtopus/pkg/eventhub"
+	"github.com/rubinda/logtopus/pkg/eventquery"
+	"github.com/rubinda/logtopus/pkg/influxdb"
+)
+
+const (
+	// wsMaxMessageSize is the largest accepted client message in bytes.
+	wsMaxMessageSize int64 = 64 * 1024
+	// wsMaxSubscriptions is the maximum number of subscriptions on a single connection.
+	wsMaxSubscriptions int = 32
+	// wsOutgoingBufferSize is the number of messages queued for writing on a single connection.
+	wsOutgoingBufferSize int = 64
+	// wsWriteTimeout is the time allowed to write a single message.
+	wsWriteTimeout time.Duration = 10 * time.Second
+	// wsPongTimeout is the time allowed without any message (or heartbeat reply) from the client.
+	wsPongTimeout time.Duration = 2 * tailHeartbeatInterval
+	// wsRecheckInterval is how often the credentials of a connection are checked again, so revoked API keys,
+	// disabled users and ended sessions don't keep receiving events.
+	wsRecheckInterval time.Duration = 30 * time.Second
+)
+
+// wsUpgrader upgrades HTTP requests to WebSocket connections.
+var wsUpgrader = websocket.Upgrader{
+	// Clients authenticate with a token instead of cookies, so other origins can't connect on behalf of a user
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsConnection is an open WebSocket connection with its subscriptions.
+type wsConnection struct {
+	// server handles the connection.
+	server *Server
+	// conn is the underlying WebSocket connection.
+	conn *websocket.Conn
+	// outgoing queues messages for the writer, which is the only goroutine writing to conn.
+	outgoing chan wsServerMessage
+	// done is closed when the connection ends.
+	done chan struct{}
+	// closed is closed when the writer stops, messages can't be sent anymore.
+	closed chan struct{}
+	// subscriptions contains active subscriptions by their id, only used by the reader.
+	subscriptions map[string]*wsSubscription
+	// forwarders counts running subscription goroutines.
+	forwarders sync.WaitGroup
+	// binding limits subscriptions to the entities the credentials are bound to.
+	binding access.Binding
+	// authenticate checks the credentials the connection was opened with again.
+	authenticate func() (principal, error)
+}
+
+// wsSubscription is a filter subscription of a WebSocket client.
+type wsSubscription struct {
+	// live receives newly stored events matching the filter.
+	live *eventhub.Subscription
+	// stop is closed when the client unsubscribes.
+	stop chan struct{}
+}
+
+// eventsSubscribeHandler handles the "/events/subscribe" API endpoint requests.
+func (server *Server) eventsSubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[%s] %s\n", r.Method, r.URL.Path)
+	switch r.Method {
+	case http.MethodGet:
+		server.handleEventsSubscribeGet(w, r)
+	default:
+		server.methodNotAllowed(w)
+	}
+}
+
+// handleEventsSubscribeGet upgrades the request to a WebSocket connection, where clients add and remove filter
+// subscriptions and receive matching events. Browsers can't set headers on WebSocket requests, so besides the
+// "Token" (or "Authorization") header the token is also accepted as the "token" URL parameter.
+func (server *Server) handleEventsSubscribeGet(w http.ResponseWriter, r *http.Request) {
+	authenticate := server.subscribeCredentials(r)
+	identity, err := authenticate()
+	if err != nil {
+		jsonResponse(w, http.StatusUnauthorized, errResponse{err.Error(), nil})
+		return
+	}
+	if !access.HasScope(identity.Scopes, access.ScopeQuery) {
+		jsonResponse(w, http.StatusForbidden, errResponse{ErrScopeRequired.Error(), map[string]string{"scope": access.ScopeQuery}})
+		return
+	}
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrader has already responded
+		return
+	}
+	c := &wsConnection{
+		server:        server,
+		conn:          conn,
+		outgoing:      make(chan wsServerMessage, wsOutgoingBufferSize),
+		done:          make(chan struct{}),
+		closed:        make(chan struct{}),
+		subscriptions: make(map[string]*wsSubscription),
+		binding:       identity.Binding,
+		authenticate:  authenticate,
+	}
+	// The connection ends with the token (or API key), clients reconnect with a new one (and resume from the last event)
+	var expired <-chan time.Time
+	if !identity.Expiry.IsZero() {
+		timer := time.NewTimer(time.Until(identity.Expiry))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	go c.writeLoop(expired)
+	c.readLoop()
+	close(c.done)
+	c.forwarders.Wait()
+}
+
+// subscribeCredentials returns a function authenticating the credentials of a subscribe request: an API key in the
+// "Authorization" header, a token in the "Token" header or a token in the "token" URL parameter.
+func (server *Server) subscribeCredentials(r *http.Request) func() (principal, error) {
+	if authorization := r.Header.Get("Authorization"); authorization != "" {
+		return func() (principal, error) {
+			return server.authenticateKey(authorization)
+		}
+	}
+	tokenStr := r.URL.Query().Get("token")
+	if r.Header["Token"] != nil {
+		tokenStr = r.Header["Token"][0]
+	}
+	return func() (principal, error) {
+		if tokenStr == "" {
+			return principal{}, ErrTokenMissing
+		}
+		return server.authenticateToken(tokenStr)
+	}
+}
+
+// readLoop handles client messages until the connection fails or is closed.
+func (c *wsConnection) readLoop() {
+	c.conn.SetReadLimit(wsMaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+		var msg wsClientMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			c.send(wsServerMessage{Type: wsError, Message: errBadRequestBody, Details: []influxdb.ModelError{decodeProblem(err)}})
+			continue
+		}
+		switch msg.Type {
+		case wsSubscribe:
+			c.subscribe(msg)
+		case wsUnsubscribe:
+			c.unsubscribe(msg.Id)
+		default:
+			c.send(wsServerMessage{Type: wsError, Id: msg.Id, Message: errBadRequestBody, Details: []influxdb.ModelError{
+				{Field: "type", Message: fmt.Sprintf("expected %q or %q", wsSubscribe, wsUnsubscribe)},
+			}})
+		}
+	}
+}
+
+// writeLoop writes queued messages and heartbeats. The connection is closed when writing fails, the token expires,
+// the credentials are no longer accepted (or lost the query scope) or the server shuts down.
+func (c *wsConnection) writeLoop(expired <-chan time.Time) {
+	// Senders stop waiting for the writer, which unblocks the reader until the closed connection ends it
+	defer close(c.closed)
+	defer c.conn.Close()
+	heartbeat := time.NewTicker(tailHeartbeatInterval)
+	defer heartbeat.Stop()
+	recheck := time.NewTicker(wsRecheckInterval)
+	defer recheck.Stop()
+	for {
+		select {
+		case msg := <-c.outgoing:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := c.conn.WriteJSON(msg); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				return
+			}
+		case <-expired:
+			c.closeWith(websocket.ClosePolicyViolation, "token expired")
+			return
+		case <-recheck.C:
+			identity, err := c.authenticate()
+			if err == nil && !access.HasScope(identity.Scopes, access.ScopeQuery) {
+				err = ErrScopeRequired
+			}
+			if err != nil {
+				c.closeWith(websocket.ClosePolicyViolation, err.Error())
+				return
+			}
+		case <-c.server.hub.Done():
+			c.closeWith(websocket.CloseGoingAway, "server shutting down")
+			return
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// closeWith tells the client why the connection is closed.
+func (c *wsConnection) closeWith(code int, reason string) {
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteTimeout))
+}
+
+// send queues a message for the client. Returns false when the connection has ended.
+func (c *wsConnection) send(msg wsServerMessage) bool {
+	select {
+	case c.outgoing <- msg:
+		return true
+	case <-c.done:
+		return false
+	case <-c.closed:
+		return false
+	}
+}
+
+// subscribe validates and starts a new subscription.
+func (c *wsConnection) subscribe(msg wsClientMessage) {
+	problems := make([]influxdb.ModelError, 0)
+	if msg.Id == "" {
+		problems = append(problems, influxdb.ModelError{Field: "id", Message: influxdb.ErrFieldRequired.Error()})
+	} else if _, exists := c.subscriptions[msg.Id]; exists {
+		problems = append(problems, influxdb.ModelError{Field: "id", Message: "subscription already exists"})
+	}
+	if len(c.subscriptions) >= wsMaxSubscriptions {
+		problems = append(problems, influxdb.ModelError{Field: "id", Message: fmt.Sprintf("at most %d subscriptions are allowed", wsMaxSubscriptions)})
+	}
+	now := time.Now()
+	var since time.Time
+	if msg.Since != nil {
+		start, _, err := influxdb.ParseTimeRange(map[string]any{influxdb.QueryRangeStartTag: msg.Since}, now)
+		if err != nil {
+			problems = append(problems, influxdb.ModelError{Field: "since", Message: "expected a RFC3339 timestamp, Unix timestamp or duration (e.g. -3h) in the past"})
+		}
+		since = start
+	}
+	var query eventquery.Query
+	queryFields, err := decodeFilter(msg.Filter)
+	if err == nil {
+		query, err = eventquery.ParseFilter(c.binding.Restrict(queryFields))
+	}
+	if err != nil {
+		if queryErr, ok := err.(*influxdb.QueryError); ok {
+			problems = append(problems, queryErr.Problems...)
+		} else {
+			problems = append(problems, influxdb.ModelError{Field: "filter", Message: "expected an object with conditions"})
+		}
+	}
+	if len(problems) > 0 {
+		c.send(wsServerMessage{Type: wsError, Id: msg.Id, Message: influxdb.ErrInvalidQuery.Error(), Details: problems})
+		return
+	}
+	// Subscribe before backfilling, so no events are missed in between
+	sub := &wsSubscription{live: c.server.hub.Subscribe(query), stop: make(chan struct{})}
+	c.subscriptions[msg.Id] = sub
+	c.send(wsServerMessage{Type: wsSubscribed, Id: msg.Id})
+	c.forwarders.Add(1)
+	go c.forward(msg.Id, sub, msg.Filter, since, now)
+}
+
+// unsubscribe stops a subscription, the client is notified once no more events are sent for it.
+func (c *wsConnection) unsubscribe(id string) {
+	sub, ok := c.subscriptions[id]
+	if !ok {
+		c.send(wsServerMessage{Type: wsError, Id: id, Message: "unknown subscription", Details: []influxdb.ModelError{{Field: "id", Message: "no subscription with this id"}}})
+		return
+	}
+	delete(c.subscriptions, id)
+	close(sub.stop)
+}
+
+// forward sends stored events since the given time (when set) and then live events of a subscription to the client.
+func (c *wsConnection) forward(id string, sub *wsSubscription, filter json.RawMessage, since, until time.Time) {
+	defer c.forwarders.Done()
+	defer sub.live.Close()
+	if !since.IsZero() && !c.backfill(id, sub, filter, since, until) {
+		return
+	}
+	var reportedDrops uint64
+	for {
+		select {
+		case <-sub.stop:
+			c.send(wsServerMessage{Type: wsUnsubscribed, Id: id})
+			return
+		case <-c.done:
+			return
+		case <-c.closed:
+			return
+		case event, ok := <-sub.live.Events():
+			if !ok {
+				// Server is shutting down
+				return
+			}
+			if !c.send(wsServerMessage{Type: wsEvent, Id: id, Event: &event}) {
+				return
+			}
+			if dropped := sub.live.Dropped(); dropped != reportedDrops {
+				reportedDrops = dropped
+				if !c.send(wsServerMessage{Type: wsDropped, Id: id, Dropped: dropped}) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// backfill sends stored events with timestamps between since and until, page by page. Events stored while the backfill
+// runs may be delivered twice (as stored and as live events). Returns false when the subscription or connection ended.
+func (c *wsConnection) backfill(id string, sub *wsSubscription, filter json.RawMessage, since, until time.Time) bool {
+	cursor := ""
+	for {
+		// Filter has been validated on subscribe
+		queryFields, _ := decodeFilter(filter)
+		queryFields[influxdb.QueryRangeStartTag] = since.UTC().Format(time.RFC3339Nano)
+		queryFields[influxdb.QueryRangeStopTag] = until.UTC().Format(time.RFC3339Nano)
+		queryFields[influxdb.QuerySortTag] = influxdb.TimestampFieldName
+		queryFields[influxdb.QueryLimitTag] = float64(influxdb.MaxQueryLimit)
+		if cursor != "" {
+			queryFields[influxdb.QueryCursorTag] = cursor
+		}
+		result, err := c.server.db.QueryEvents(c.binding.Restrict(queryFields))
+		if err != nil {
+			log.Printf("[WARNING] backfill of subscription %q failed: %s\n", id, err)
+			return c.send(wsServerMessage{Type: wsError, Id: id, Message: "backfill failed, continuing with live events"})
+		}
+		for i := range result.Events {
+			select {
+			case <-sub.stop:
+				c.send(wsServerMessage{Type: wsUnsubscribed, Id: id})
+				return false
+			default:
+			}
+			if !c.send(wsServerMessage{Type: wsEvent, Id: id, Event: &result.Events[i]}) {
+				return false
+			}
+		}
+		if result.NextCursor == "" {
+			return c.send(wsServerMessage{Type: wsLive, Id: id})
+		}
+		cursor = result.NextCursor
+	}
+}
+
+// decodeFilter decodes the filter of a subscription, a missing filter matches every event.
+func decodeFilter(filter json.RawMessage) (map[string]any, error) {
+	queryFields := make(map[string]any)
+	if len(filter) > 0 {
+		if err := json.Unmarshal(filter, &queryFields); err != nil {
+			return nil, err
+		}
+	}
+	if queryFields == nil {
+		// Filter was null
+		queryFields = make(map[string]any)
+	}
+	return queryFields, nil
+}
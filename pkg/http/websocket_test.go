@@ -0,0 +1,55 @@
+package http
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/influxdb"
+)
+
+// TestBackfill sends every stored event once, also when events sharing a timestamp span a page boundary.
+func TestBackfill(t *testing.T) {
+	s := newTestServer(t)
+	base := time.Date(2023, 2, 5, 19, 43, 6, 0, time.UTC)
+	events := make([]influxdb.BasicEvent, 0, influxdb.MaxQueryLimit+2)
+	for i := 0; i < influxdb.MaxQueryLimit-1; i++ {
+		events = append(events, influxdb.BasicEvent{EventId: fmt.Sprintf("e%05d", i), EntityId: "plex001", EntityType: "mediaServer", EventType: "log", Timestamp: base.Add(time.Duration(i) * time.Millisecond)})
+	}
+	// The first page ends after the first of these
+	tied := base.Add(time.Minute)
+	for _, id := range []string{"tie-a", "tie-c", "tie-b"} {
+		events = append(events, influxdb.BasicEvent{EventId: id, EntityId: "plex001", EntityType: "mediaServer", EventType: "log", Timestamp: tied})
+	}
+	if err := s.db.StoreEvents(events); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &wsConnection{
+		server:   s.Server,
+		outgoing: make(chan wsServerMessage, len(events)+1),
+		done:     make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	sub := &wsSubscription{stop: make(chan struct{})}
+	if !c.backfill("s1", sub, nil, base, tied.Add(time.Second)) {
+		t.Fatal("expected the backfill to complete")
+	}
+	close(c.outgoing)
+	seen := make(map[string]int)
+	var last wsServerMessage
+	for msg := range c.outgoing {
+		if msg.Type == wsEvent {
+			seen[msg.Event.EventId]++
+		}
+		last = msg
+	}
+	if last.Type != wsLive {
+		t.Errorf("expected the backfill to end with %q, got %q", wsLive, last.Type)
+	}
+	for _, eventData := range events {
+		if seen[eventData.EventId] != 1 {
+			t.Errorf("event %s sent %d times", eventData.EventId, seen[eventData.EventId])
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package influxdb
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/rubinda/logtopus/pkg/parseutils"
+)
+
+const (
+	// AggregateFunctionTag is the JSON attribute for the aggregate function.
+	AggregateFunctionTag string = "_function"
+	// AggregateFieldTag is the JSON attribute for the (numeric) field the function is applied to.
+	AggregateFieldTag string = "_field"
+	// AggregateGroupByTag is the JSON attribute for the list of fields results are grouped by.
+	AggregateGroupByTag string = "_groupBy"
+	// AggregateIntervalTag is the JSON attribute for the time bucket size (a Flux duration, e.g. "1h").
+	AggregateIntervalTag string = "_interval"
+	// AggregatePercentileTag is the JSON attribute for the percentile (0 - 100) computed by the percentile function.
+	AggregatePercentileTag string = "_percentile"
+)
+
+// Aggregate functions.
+const (
+	AggregateCount      string = "count"
+	AggregateSum        string = "sum"
+	AggregateMin        string = "min"
+	AggregateMax        string = "max"
+	AggregateMean       string = "mean"
+	AggregatePercentile string = "percentile"
+)
+
+// Value types of aggregated series.
+const (
+	SeriesTypeInteger string = "integer"
+	SeriesTypeFloat   string = "float"
+)
+
+// aggregateFunctions contains supported aggregate functions and their Flux counterparts.
+var aggregateFunctions = map[string]string{
+	AggregateCount:      "count",
+	AggregateSum:        "sum",
+	AggregateMin:        "min",
+	AggregateMax:        "max",
+	AggregateMean:       "mean",
+	AggregatePercentile: "quantile",
+}
+
+// Aggregation describes how matching events are summarized.
+type Aggregation struct {
+	// Function is one of the Aggregate* function names.
+	Function string
+	// Field is the numeric field the function is applied to (not used for count).
+	Field string
+	// GroupBy contains field names events are grouped by.
+	GroupBy []string
+	// Interval is the size of time buckets, zero when events aren't bucketed by time.
+	Interval time.Duration
+	// Percentile is the computed percentile (0 - 100) for the percentile function.
+	Percentile float64
+}
+
+// AggregatePoint is a single aggregated value.
+type AggregatePoint struct {
+	// Time is the end of the time bucket (or query range) the value was computed for.
+	Time time.Time `json:"time"`
+	// Value is the computed value, an integer or float according to the series type.
+	Value any `json:"value"`
+}
+
+// AggregateSeries contains aggregated values for a single group.
+type AggregateSeries struct {
+	// Group contains the values of the groupBy fields.
+	Group map[string]any `json:"group"`
+	// Type is the type of values, SeriesTypeInteger or SeriesTypeFloat.
+	Type string `json:"type"`
+	// Points contains the aggregated values ordered by time.
+	Points []AggregatePoint `json:"points"`
+}
+
+// AggregateResult is the response to an aggregation query.
+type AggregateResult struct {
+	// Function is the applied aggregate function.
+	Function string `json:"function"`
+	// Field is the aggregated field.
+	Field string `json:"field,omitempty"`
+	// Series contains a series for each group.
+	Series []AggregateSeries `json:"series"`
+}
+
+// ParseAggregation removes the aggregation attributes from query params and validates them.
+// Problems are returned as a QueryError.
+func ParseAggregation(params map[string]any) (Aggregation, error) {
+	aggregation := Aggregation{Function: AggregateCount, GroupBy: make([]string, 0), Percentile: 50}
+	problems := make([]ModelError, 0)
+	function := parseutils.Pop(params, AggregateFunctionTag)
+	field := parseutils.Pop(params, AggregateFieldTag)
+	groupBy := parseutils.Pop(params, AggregateGroupByTag)
+	interval := parseutils.Pop(params, AggregateIntervalTag)
+	percentile := parseutils.Pop(params, AggregatePercentileTag)
+
+	if function != nil {
+		name, ok := function.(string)
+		if _, supported := aggregateFunctions[name]; !ok || !supported {
+			problems = append(problems, ModelError{AggregateFunctionTag, "expected one of count, sum, min, max, mean, percentile"})
+		} else {
+			aggregation.Function = name
+		}
+	}
+	if field != nil {
+		name, ok := field.(string)
+		if !ok || name == "" || isReservedField(name) {
+			problems = append(problems, ModelError{AggregateFieldTag, "expected the name of a numeric detail field"})
+		} else {
+			aggregation.Field = name
+		}
+	}
+	if aggregation.Function != AggregateCount && aggregation.Field == "" && field == nil {
+		problems = append(problems, ModelError{AggregateFieldTag, ErrFieldRequired.Error()})
+	}
+	if aggregation.Function == AggregateCount {
+		aggregation.Field = ""
+	}
+	if groupBy != nil {
+		list, ok := groupBy.([]any)
+		if !ok {
+			problems = append(problems, ModelError{AggregateGroupByTag, "expected an array of field names"})
+		}
+		for i, item := range list {
+			name, ok := item.(string)
+			if !ok || name == "" || name == TimestampFieldName || name == aggregation.Field {
+				problems = append(problems, ModelError{fmt.Sprintf("%s[%d]", AggregateGroupByTag, i), "expected a field name other than timestamp and the aggregated field"})
+				continue
+			}
+			aggregation.GroupBy = append(aggregation.GroupBy, name)
+		}
+	}
+	if interval != nil {
+		str, _ := interval.(string)
+		d, err := parseutils.ParseFluxDuration(str)
+		if err != nil {
+			problems = append(problems, ModelError{AggregateIntervalTag, "expected a positive duration without months or years, e.g. 1h"})
+		} else {
+			aggregation.Interval = d
+		}
+	}
+	if percentile != nil {
+		v, ok := percentile.(float64)
+		if !ok || v < 0 || v > 100 {
+			problems = append(problems, ModelError{AggregatePercentileTag, "expected a number between 0 and 100"})
+		} else {
+			aggregation.Percentile = v
+		}
+	}
+	if len(problems) > 0 {
+		return aggregation, &QueryError{problems}
+	}
+	return aggregation, nil
+}
+
+// isReservedField checks if the field name is a query attribute or a non-numeric event attribute.
+func isReservedField(name string) bool {
+	switch name {
+	case TimestampFieldName, MeasurementFieldName, EntityIdFieldName, EventTypeFieldName:
+		return true
+	}
+	return name[0] == '_' || name[0] == '$'
+}
+
+// aggregateQueryBuilder builds a Flux query which filters events like queryBuilder and aggregates the result.
+func aggregateQueryBuilder(params map[string]any, bucket string, tags map[string]bool) (query string, aggregation Aggregation, stop time.Time, err error) {
+	aggregation, err = ParseAggregation(params)
+	if err != nil {
+		return
+	}
+	timeField, err := ParseTimeField(params)
+	if err != nil {
+		return
+	}
+	start, stop, err := ParseTimeRange(params, time.Now())
+	if err != nil {
+		return
+	}
+	query, err = filteredQuery(params, bucket, start, stop, timeField, tags)
+	if err != nil {
+		return
+	}
+	// Aggregate on a copy of the value, so aggregated fields can't clash with group key columns
+	if aggregation.Function == AggregateCount {
+		query += `
+	|> map(fn: (r) => ({r with _value: 1}))`
+	} else {
+		query += fmt.Sprintf(`
+	|> filter(fn: (r) => exists %s)
+	|> map(fn: (r) => ({r with _value: float(v: %s)}))`, fluxFieldRef(aggregation.Field), fluxFieldRef(aggregation.Field))
+	}
+	groupColumns := ""
+	for i, field := range aggregation.GroupBy {
+		if i > 0 {
+			groupColumns += ", "
+		}
+		groupColumns += fluxColumn(field)
+	}
+	query += fmt.Sprintf(`
+	|> group(columns: [%s])`, groupColumns)
+
+	fn := aggregateFunctions[aggregation.Function]
+	if aggregation.Function == AggregatePercentile {
+		fn = fmt.Sprintf(`(column, tables=<-) => tables |> quantile(q: %s, column: column, method: "exact_selector")`,
+			fluxValueFloat(aggregation.Percentile/100))
+	}
+	if aggregation.Interval > 0 {
+		query += fmt.Sprintf(`
+	|> aggregateWindow(every: %dns, fn: %s, createEmpty: false)`, aggregation.Interval.Nanoseconds(), fn)
+	} else if aggregation.Function == AggregatePercentile {
+		query += fmt.Sprintf(`
+	|> quantile(q: %s, method: "exact_selector")`, fluxValueFloat(aggregation.Percentile/100))
+	} else {
+		query += fmt.Sprintf(`
+	|> %s()`, fn)
+	}
+	return
+}
+
+// AggregateEvents runs an aggregation query, where queryFields contain filters (same as QueryEvents) and aggregation attributes.
+func (c *Client) AggregateEvents(queryFields map[string]any) (AggregateResult, error) {
+	queryApi := c.influxClient.QueryAPI(c.Org)
+	queryString, aggregation, stop, err := aggregateQueryBuilder(queryFields, c.Bucket, c.layout.Tags)
+	if err != nil {
+		return AggregateResult{}, err
+	}
+	result, err := queryApi.Query(context.Background(), queryString)
+	if err != nil {
+		return AggregateResult{}, err
+	}
+	return queryResultsToAggregate(result, aggregation, stop)
+}
+
+// queryResultsToAggregate collects aggregated rows into series, one for each group.
+func queryResultsToAggregate(result *api.QueryTableResult, aggregation Aggregation, stop time.Time) (AggregateResult, error) {
+	builder := NewSeriesBuilder(aggregation)
+	for result.Next() {
+		values := result.Record().Values()
+		group := make(map[string]any, len(aggregation.GroupBy))
+		for _, field := range aggregation.GroupBy {
+			column := field
+			if field == MeasurementFieldName {
+				column = "_measurement"
+			}
+			group[field] = values[column]
+		}
+		pointTime := stop
+		if aggregation.Interval > 0 {
+			pointTime = result.Record().Time()
+		}
+		builder.Add(group, pointTime, values["_value"])
+	}
+	if err := result.Err(); err != nil {
+		return AggregateResult{}, err
+	}
+	return builder.Result(), nil
+}
+
+// SeriesBuilder collects aggregated values into typed series.
+type SeriesBuilder struct {
+	// aggregation describes the computed values.
+	aggregation Aggregation
+	// series contains collected series by their group key.
+	series map[string]*AggregateSeries
+}
+
+// NewSeriesBuilder returns an empty series builder for the aggregation.
+func NewSeriesBuilder(aggregation Aggregation) *SeriesBuilder {
+	return &SeriesBuilder{aggregation, make(map[string]*AggregateSeries)}
+}
+
+// Add appends a value to the series of the group. Whole numbers are stored as integers for count, sum, min and max
+// (same as InfluxDB, where integral detail values are stored as integers).
+func (b *SeriesBuilder) Add(group map[string]any, t time.Time, value any) {
+	key := fmt.Sprint(group)
+	series, ok := b.series[key]
+	if !ok {
+		series = &AggregateSeries{Group: group, Type: SeriesTypeInteger, Points: make([]AggregatePoint, 0)}
+		if b.aggregation.Function == AggregateMean || b.aggregation.Function == AggregatePercentile {
+			series.Type = SeriesTypeFloat
+		}
+		b.series[key] = series
+	}
+	switch v := value.(type) {
+	case float64:
+		if series.Type == SeriesTypeInteger && v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			value = int64(v)
+		} else {
+			series.Type = SeriesTypeFloat
+		}
+	case int64, uint64:
+	default:
+		value = nil
+	}
+	series.Points = append(series.Points, AggregatePoint{t, value})
+}
+
+// Result returns collected series ordered by their group, with points ordered by time.
+func (b *SeriesBuilder) Result() AggregateResult {
+	keys := make([]string, 0, len(b.series))
+	for key := range b.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := AggregateResult{Function: b.aggregation.Function, Field: b.aggregation.Field, Series: make([]AggregateSeries, 0, len(keys))}
+	for _, key := range keys {
+		series := b.series[key]
+		sort.SliceStable(series.Points, func(i, j int) bool {
+			return series.Points[i].Time.Before(series.Points[j].Time)
+		})
+		if series.Type == SeriesTypeFloat {
+			// A single fractional value turns the whole series into floats
+			for i, point := range series.Points {
+				if v, ok := point.Value.(int64); ok {
+					series.Points[i].Value = float64(v)
+				}
+			}
+		}
+		result.Series = append(result.Series, *series)
+	}
+	return result
+}
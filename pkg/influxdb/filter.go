@@ -0,0 +1,227 @@
+package influxdb
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Operators for query conditions. A field condition is either a plain value (equality) or an object of operators,
+// e.g. {"severity": {"$gte": 4}}. Logical operators contain a list of condition objects, e.g. {"$or": [{...}, {...}]}.
+const (
+	OpAnd    string = "$and"
+	OpOr     string = "$or"
+	OpEq     string = "$eq"
+	OpNe     string = "$ne"
+	OpGt     string = "$gt"
+	OpGte    string = "$gte"
+	OpLt     string = "$lt"
+	OpLte    string = "$lte"
+	OpIn     string = "$in"
+	OpNin    string = "$nin"
+	OpRegex  string = "$regex"
+	OpExists string = "$exists"
+)
+
+// ErrInvalidQuery is a message for query payloads which can't be compiled.
+var ErrInvalidQuery = fmt.Errorf("invalid query")
+
+// QueryError contains problems found in a query payload.
+type QueryError struct {
+	Problems []ModelError
+}
+
+// Error returns a summary of the query problems.
+func (e *QueryError) Error() string {
+	messages := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		messages[i] = fmt.Sprintf("%s: %s", problem.Field, problem.Message)
+	}
+	return fmt.Sprintf("%s: %s", ErrInvalidQuery, strings.Join(messages, "; "))
+}
+
+// Unwrap allows matching QueryError with errors.Is(err, ErrInvalidQuery).
+func (e *QueryError) Unwrap() error {
+	return ErrInvalidQuery
+}
+
+// Filter is a parsed query condition. Logical filters ($and, $or) contain sub-filters,
+// all others compare the value of Field to Value.
+type Filter struct {
+	// Operator is one of the Op* constants.
+	Operator string
+	// Field is the JSON attribute name of the compared value.
+	Field string
+	// Value is the (JSON decoded) value to compare with.
+	Value any
+	// Filters contains the sub-filters of logical operators.
+	Filters []Filter
+}
+
+// ParseFilter parses query fields (without time range attributes) into a filter. All problems found are returned
+// in a QueryError. An empty map results in a filter matching everything.
+func ParseFilter(fields map[string]any) (Filter, error) {
+	var problems []ModelError
+	filter := parseConditions(fields, "", &problems)
+	if len(problems) > 0 {
+		return Filter{}, &QueryError{problems}
+	}
+	return filter, nil
+}
+
+// Equalities returns field values which must be equal for the filter to match (top-level equality conditions).
+func (f Filter) Equalities() map[string]any {
+	equalities := make(map[string]any)
+	switch f.Operator {
+	case OpEq:
+		equalities[f.Field] = f.Value
+	case OpAnd:
+		for _, sub := range f.Filters {
+			if sub.Operator == OpEq {
+				equalities[sub.Field] = sub.Value
+			}
+		}
+	}
+	return equalities
+}
+
+// parseConditions parses a condition object, which matches when all of its conditions match.
+func parseConditions(fields map[string]any, path string, problems *[]ModelError) Filter {
+	filters := make([]Filter, 0, len(fields))
+	for _, key := range sortedKeys(fields) {
+		value := fields[key]
+		switch key {
+		case OpAnd, OpOr:
+			list, ok := value.([]any)
+			if !ok || len(list) == 0 {
+				*problems = append(*problems, ModelError{path + key, "expected a non-empty array of conditions"})
+				continue
+			}
+			subFilters := make([]Filter, 0, len(list))
+			for i, item := range list {
+				itemPath := fmt.Sprintf("%s%s[%d]", path, key, i)
+				conditions, ok := item.(map[string]any)
+				if !ok {
+					*problems = append(*problems, ModelError{itemPath, "expected an object with conditions"})
+					continue
+				}
+				subFilters = append(subFilters, parseConditions(conditions, itemPath+".", problems))
+			}
+			filters = append(filters, Filter{Operator: key, Filters: subFilters})
+		default:
+			if strings.HasPrefix(key, "$") {
+				*problems = append(*problems, ModelError{path + key, "unknown logical operator"})
+				continue
+			}
+			filters = append(filters, parseFieldConditions(key, value, path, problems)...)
+		}
+	}
+	if len(filters) == 1 {
+		return filters[0]
+	}
+	return Filter{Operator: OpAnd, Filters: filters}
+}
+
+// parseFieldConditions parses the condition for a single field, either a plain value or an object of operators.
+func parseFieldConditions(field string, value any, path string, problems *[]ModelError) []Filter {
+	problemField := path + field
+	if field == "" {
+		*problems = append(*problems, ModelError{problemField, "field name can't be empty"})
+		return nil
+	}
+	if value == nil {
+		*problems = append(*problems, ModelError{problemField, `null can't be compared, use {"$exists": false}`})
+		return nil
+	}
+	operators, ok := value.(map[string]any)
+	if !ok || !isOperatorObject(operators) {
+		if !isScalar(value) {
+			*problems = append(*problems, ModelError{problemField, "unsupported value type, expected a string, number, boolean or an object of operators"})
+			return nil
+		}
+		return []Filter{{Operator: OpEq, Field: field, Value: value}}
+	}
+	filters := make([]Filter, 0, len(operators))
+	for _, op := range sortedKeys(operators) {
+		operand := operators[op]
+		opField := problemField + "." + op
+		switch op {
+		case OpEq, OpNe:
+			if !isScalar(operand) {
+				*problems = append(*problems, ModelError{opField, "expected a string, number or boolean"})
+				continue
+			}
+		case OpGt, OpGte, OpLt, OpLte:
+			switch operand.(type) {
+			case string, float64:
+			default:
+				*problems = append(*problems, ModelError{opField, "expected a string or number"})
+				continue
+			}
+		case OpIn, OpNin:
+			list, ok := operand.([]any)
+			if !ok {
+				*problems = append(*problems, ModelError{opField, "expected an array"})
+				continue
+			}
+			valid := true
+			for _, item := range list {
+				valid = valid && isScalar(item)
+			}
+			if !valid {
+				*problems = append(*problems, ModelError{opField, "expected an array of strings, numbers or booleans"})
+				continue
+			}
+		case OpRegex:
+			pattern, ok := operand.(string)
+			if !ok {
+				*problems = append(*problems, ModelError{opField, "expected a regular expression string"})
+				continue
+			}
+			if _, err := regexp.Compile(pattern); err != nil {
+				*problems = append(*problems, ModelError{opField, err.Error()})
+				continue
+			}
+		case OpExists:
+			if _, ok := operand.(bool); !ok {
+				*problems = append(*problems, ModelError{opField, "expected a boolean"})
+				continue
+			}
+		default:
+			*problems = append(*problems, ModelError{opField, "unknown comparison operator"})
+			continue
+		}
+		filters = append(filters, Filter{Operator: op, Field: field, Value: operand})
+	}
+	return filters
+}
+
+// isOperatorObject checks if a condition object contains operators. Objects without operators are compared as values.
+func isOperatorObject(m map[string]any) bool {
+	for key := range m {
+		if strings.HasPrefix(key, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+// isScalar checks if a JSON decoded value is a string, number or boolean.
+func isScalar(v any) bool {
+	switch v.(type) {
+	case string, float64, bool:
+		return true
+	}
+	return false
+}
+
+// sortedKeys returns map keys in a stable order, so equal queries always compile to the same string.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
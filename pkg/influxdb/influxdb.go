@@ -3,29 +3,48 @@ package influxdb
 import (
 	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"time"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
-	"github.com/influxdata/influxdb-client-go/v2/api"
+	influxhttp "github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
 )
 
-const (
-	// defaultQueryRangeStart represents lowest possible time value (InfluxDB) and is used when nothing provided.
-	defaultQueryRangeStart = "0"
-)
+// ErrInvalidEvent is returned when an event can't be converted to a point.
+var ErrInvalidEvent = fmt.Errorf("event can't be stored")
+
+// IsPermanent reports whether storing events failed because of the events themselves (invalid values, conflicting
+// field types or too many tag values), so storing the same events again fails as well.
+func IsPermanent(err error) bool {
+	if errors.Is(err, ErrInvalidEvent) || errors.Is(err, ErrTagCardinality) {
+		return true
+	}
+	var httpErr *influxhttp.Error
+	if errors.As(err, &httpErr) {
+		switch httpErr.StatusCode {
+		case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+			return true
+		}
+	}
+	return false
+}
 
 // Client contains methods for database interaction.
 type Client struct {
 	// influxClient is a client to connect to InfluxDB.
 	influxClient influxdb2.Client
-	// defaultWriteApi contains the write operations to the database.
-	defaultWriteApi api.WriteAPI
 	// Org is the organization identifier for storing data.
 	Org string
 	// Bucket is the bucket name for storing data.
 	Bucket string
+	// layout describes how events are stored.
+	layout Layout
+	// tags limits distinct values of promoted tags.
+	tags *tagGuard
 }
 
 // Configuration represents database parameters.
@@ -38,10 +57,18 @@ type Configuration struct {
 	InfluxOrg string
 	// InfluxBucket is the bucket name for storing data.
 	InfluxBucket string
+	// FlattenDetails stores values of nested details as separate fields, so they can be queried.
+	FlattenDetails bool
+	// TagKeys are stored as tags besides eventType, so filtering by them uses the index: "entityId" or detail
+	// keys (e.g. "details.region").
+	TagKeys []string
+	// MaxTagCardinality limits distinct values of each promoted tag, DefaultMaxTagCardinality when not set.
+	MaxTagCardinality int
 }
 
-// NewClient initiates a new connection to InfluxDB based on given configuration.
-func NewClient(c Configuration) *Client {
+// NewClient initiates a new connection to InfluxDB based on given configuration. With tag keys configured, stored
+// tags and fields are read to check the keys can be promoted.
+func NewClient(c Configuration) (*Client, error) {
 	// Provide a single HTTP client that can be reused. According to documentation it should be thread safe.
 	httpClient := &http.Client{
 		Timeout: time.Second * time.Duration(60),
@@ -61,44 +88,85 @@ func NewClient(c Configuration) *Client {
 	influxClient := influxdb2.NewClientWithOptions(c.ServerURL, c.Token,
 		influxdb2.DefaultOptions().SetHTTPClient(httpClient).SetPrecision(time.Millisecond),
 	)
-	// TODO:
-	//  - one could use a non-blocking writeApi,error isn't returned to client - bad for testing purposes
-	// defaultWriteApi := influxClient.WriteAPI(c.InfluxOrg, c.InfluxBucket)
-	// errCh := defaultWriteApi.Errors()
-	// go func() {
-	// 	// TODO:
-	// 	//  - triggering a notification to a system administrator would be a great addition
-	// 	for err := range errCh {
-	// 		log.Printf("[WARNING] InfluxDB write error: %s \n", err.Error())
-	// 	}
-	// }()
-	return &Client{influxClient, nil, c.InfluxOrg, c.InfluxBucket}
+	// Non-blocking (batched) writes are provided by pkg/asyncstore. Clients are answered before their events are
+	// written, so its write errors only show up in the write stats and logs.
+	client := &Client{influxClient: influxClient, Org: c.InfluxOrg, Bucket: c.InfluxBucket, layout: Layout{FlattenDetails: c.FlattenDetails}}
+	if err := client.promoteTags(c.TagKeys, c.MaxTagCardinality); err != nil {
+		influxClient.Close()
+		return nil, err
+	}
+	return client, nil
 }
 
 // StoreEvent writes event data to the database.
 func (c *Client) StoreEvent(eventData BasicEvent) error {
 	writeApi := c.influxClient.WriteAPIBlocking(c.Org, c.Bucket)
-	influxPoint, err := eventData.ToPoint()
+	influxPoint, err := eventData.ToPoint(c.layout)
 	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidEvent, err)
+	}
+	if err := c.tags.admit([]*write.Point{influxPoint}); err != nil {
 		return err
 	}
 	return writeApi.WritePoint(context.Background(), influxPoint)
 }
 
-// QueryEvents runs a query, where queryFields are fields in InfluxDB. Returns results grouped (pivoted) by timestamp.
-func (c *Client) QueryEvents(queryFields map[string]any) ([]BasicEvent, error) {
+// StoreEvents writes multiple events to the database in a single request.
+func (c *Client) StoreEvents(events []BasicEvent) error {
+	writeApi := c.influxClient.WriteAPIBlocking(c.Org, c.Bucket)
+	influxPoints := make([]*write.Point, len(events))
+	for i, eventData := range events {
+		influxPoint, err := eventData.ToPoint(c.layout)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidEvent, err)
+		}
+		influxPoints[i] = influxPoint
+	}
+	if err := c.tags.admit(influxPoints); err != nil {
+		return err
+	}
+	return writeApi.WritePoint(context.Background(), influxPoints...)
+}
+
+// CheckEvent returns why the event can't be stored, without writing it. Promoted tag values of the event are counted
+// towards the cardinality limit, so events accepted for writing later don't exceed it.
+func (c *Client) CheckEvent(eventData BasicEvent) error {
+	influxPoint, err := eventData.ToPoint(c.layout)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidEvent, err)
+	}
+	return c.tags.admit([]*write.Point{influxPoint})
+}
+
+// TagKeys lists the detail keys stored as tags, in alphabetical order.
+func (c *Client) TagKeys() []string {
+	keys := make([]string, 0, len(c.layout.Tags))
+	for _, key := range sortedKeys(c.layout.Tags) {
+		if key != EntityIdFieldName {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// QueryEvents runs a query, where queryFields are fields in InfluxDB. Returns a page of results grouped (pivoted) by timestamp.
+func (c *Client) QueryEvents(queryFields map[string]any) (QueryResult, error) {
 	queryApi := c.influxClient.QueryAPI(c.Org)
 	// TODO:
 	//  - QueryWithParams is currently only supported for InfluxDB Cloud and doesn't support this usecase anyway :(
-	queryString, err := queryBuilder(queryFields, c.Bucket)
+	queryString, page, err := queryBuilder(queryFields, c.Bucket, c.layout.Tags)
 	if err != nil {
-		return nil, err
+		return QueryResult{}, err
 	}
 	result, err := queryApi.Query(context.Background(), queryString)
 	if err != nil {
-		return nil, err
+		return QueryResult{}, err
+	}
+	events, err := QueryResultsToBasicEvents(result, c.layout.FlattenDetails)
+	if err != nil {
+		return QueryResult{}, err
 	}
-	return QueryResultsToBasicEvents(result)
+	return page.Result(events), nil
 }
 
 // Disconnect (gracefully) shuts down the connection to InfluxDB if it is active.
@@ -1,9 +1,13 @@
 package influxdb
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
@@ -17,11 +21,28 @@ const (
 	MeasurementFieldName string = "entityType"
 	// TimestampFieldName is the JSON attribute name for InfluxDB _time field.
 	TimestampFieldName string = "timestamp"
+	// EntityIdFieldName is the JSON attribute name for the entity identifier (an InfluxDB field).
+	EntityIdFieldName string = "entityId"
+	// EventTypeFieldName is the JSON attribute name for the event type (an InfluxDB tag).
+	EventTypeFieldName string = "eventType"
+	// EventIdFieldName is the JSON attribute name for the event identifier (an InfluxDB field).
+	EventIdFieldName string = "eventId"
+	// ReceivedAtFieldName is the JSON attribute name for the server receive time (an InfluxDB field in Unix nanoseconds).
+	ReceivedAtFieldName string = "receivedAt"
+	// DetailsSeparator joins the keys of nested detail values stored as separate fields, e.g. "http.status".
+	DetailsSeparator string = "."
 )
 
+// maxEventIdLength is the longest accepted event identifier.
+const maxEventIdLength int = 128
+
 var (
 	// ErrFieldRequired is a message for missing required fields.
 	ErrFieldRequired = fmt.Errorf("required field missing value")
+	// ErrReservedKey is a message for detail keys which are used by event attributes stored as fields.
+	ErrReservedKey = fmt.Errorf("reserved key, used by an event attribute")
+	// ErrNumberOutOfRange is a message for numbers which can't be stored without losing precision.
+	ErrNumberOutOfRange = fmt.Errorf("number out of range, expected a 64-bit (signed or unsigned) integer or a float64")
 	// hiddenFields are column names for InfluxDB fields which shouldn't be visible (as extra fields) to a regular client.
 	hiddenFields = []string{"_measurement", "_start", "_stop", "_time", "result", "table"}
 )
@@ -34,6 +55,8 @@ type ModelError struct {
 
 // BasicEvent represents the data received by the API endpoints.
 type BasicEvent struct {
+	// EventId identifies the event, retries with the same identifier are stored once. Generated when not given.
+	EventId string `json:"eventId,omitempty"`
 	// EntityId describes a given event source (e.g. Customer ID).
 	EntityId string `json:"entityId"`
 	// EntityType represents type of the entity that produced the event (e.g. Customer, AutomatedTask, Admin).
@@ -42,18 +65,22 @@ type BasicEvent struct {
 	// EventType is the (unique and descriptive) textual representation of occurred event (e.g. "account_creation", "customer_action", "billing")
 	// Is part of InfluxDB tags
 	EventType string `json:"eventType"`
-	// Timestamp shoud be given in RFC3339 compatible format.
-	// TODO:
-	//  - using a single standard might be constrictive, based on use-cases it might be wise to change it for broader support
+	// Timestamp is given in RFC3339 format, as a Unix timestamp or in a common log format (see TimestampPolicy).
 	Timestamp time.Time `json:"timestamp"`
+	// ReceivedAt is the time the server received the event, set on ingestion. Zero for events stored before it was
+	// recorded.
+	ReceivedAt time.Time `json:"receivedAt"`
 	// EventDetails is an open map to provide values with some restrictions.
 	// TODO:
 	//  - for performance reasons with InfluxDB one shouldn't use the same key in fields as in measurements and/or tags.
 	EventDetails map[string]any `json:"details"`
+	// rawTimestamp is the decoded timestamp as received (a string or json.Number), nil when not given.
+	rawTimestamp any
 }
 
-// QueryResultsToBasicEvents wraps values from InfluxDB table rows to a custom struct.
-func QueryResultsToBasicEvents(result *api.QueryTableResult) (events []BasicEvent, err error) {
+// QueryResultsToBasicEvents wraps values from InfluxDB table rows to a custom struct. When details were stored
+// flattened, their nested structure is restored (see NestDetails).
+func QueryResultsToBasicEvents(result *api.QueryTableResult, flattened bool) (events []BasicEvent, err error) {
 	events = make([]BasicEvent, 0)
 	for result.Next() {
 		values := result.Record().Values()
@@ -61,10 +88,19 @@ func QueryResultsToBasicEvents(result *api.QueryTableResult) (events []BasicEven
 		event.EntityType = fmt.Sprint(parseutils.Pop(values, "_measurement"))
 		event.EntityId = fmt.Sprint(parseutils.Pop(values, "entityId"))
 		event.EventType = fmt.Sprint(parseutils.Pop(values, "eventType"))
+		if eventId, ok := parseutils.Pop(values, EventIdFieldName).(string); ok {
+			event.EventId = eventId
+		}
 		event.Timestamp = result.Record().Time()
+		if receivedAt, ok := parseutils.Pop(values, ReceivedAtFieldName).(int64); ok {
+			event.ReceivedAt = time.Unix(0, receivedAt).UTC()
+		}
 		for _, key := range hiddenFields {
 			delete(values, key)
 		}
+		if flattened {
+			values = NestDetails(values)
+		}
 		event.EventDetails = values
 		events = append(events, event)
 	}
@@ -72,39 +108,110 @@ func QueryResultsToBasicEvents(result *api.QueryTableResult) (events []BasicEven
 	return
 }
 
+// FieldValue returns the event value for a query field name. Names other than entityType, entityId, eventType,
+// eventId and receivedAt are looked up in event details, paths (e.g. "http.status" or "tags.0") select values nested inside details.
+func FieldValue(event BasicEvent, key string) (any, bool) {
+	switch key {
+	case MeasurementFieldName:
+		return event.EntityType, true
+	case EntityIdFieldName:
+		return event.EntityId, true
+	case EventTypeFieldName:
+		return event.EventType, true
+	case EventIdFieldName:
+		return event.EventId, event.EventId != ""
+	case ReceivedAtFieldName:
+		// Stored as Unix nanoseconds, same as in InfluxDB
+		if event.ReceivedAt.IsZero() {
+			return nil, false
+		}
+		return event.ReceivedAt.UnixNano(), true
+	}
+	if value, ok := event.EventDetails[key]; ok || !strings.Contains(key, DetailsSeparator) {
+		return value, ok
+	}
+	return nestedValue(event.EventDetails, strings.Split(key, DetailsSeparator))
+}
+
+// nestedValue follows a path of object keys and array indexes.
+func nestedValue(value any, path []string) (any, bool) {
+	for _, key := range path {
+		switch v := value.(type) {
+		case map[string]any:
+			var ok bool
+			if value, ok = v[key]; !ok {
+				return nil, false
+			}
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// Layout describes how events are stored in InfluxDB.
+type Layout struct {
+	// FlattenDetails stores values of nested details as separate fields (see FlattenDetails).
+	FlattenDetails bool
+	// Tags contains query field names stored as tags besides eventType: entityId or (flattened) detail keys.
+	Tags map[string]bool
+}
+
 // ToPoint converts a JSON deserialized BasicEvent to a InfluxDB point ready to be written to the database.
-func (e BasicEvent) ToPoint() (*write.Point, error) {
+// With flattening nested details are stored as separate fields (see FlattenDetails), otherwise arrays and
+// objects are stored as JSON strings. Values of promoted keys are stored as tags (see TagValue).
+func (e BasicEvent) ToPoint(layout Layout) (*write.Point, error) {
+	details := e.EventDetails
+	if layout.FlattenDetails {
+		details = FlattenDetails(details)
+	}
+	tags := map[string]string{EventTypeFieldName: e.EventType}
 	// Parse extra fields (values which shouldn't be indexed in InfluxDB)
-	extraFields := map[string]interface{}{
-		"entityId": e.EntityId,
+	extraFields := map[string]interface{}{}
+	if layout.Tags[EntityIdFieldName] {
+		tags[EntityIdFieldName] = e.EntityId
+	} else {
+		extraFields[EntityIdFieldName] = e.EntityId
+	}
+	if e.EventId != "" {
+		extraFields[EventIdFieldName] = e.EventId
+	}
+	if !e.ReceivedAt.IsZero() {
+		extraFields[ReceivedAtFieldName] = e.ReceivedAt.UnixNano()
 	}
 	var err error
-	// TODO:
-	//  - based on more usecases, one could further improve the structuring capability (e.g. are nested objects needed, will there be complex lists, etc.)
-	for key, value := range e.EventDetails {
+	for key, value := range details {
+		if layout.Tags[key] {
+			if tagValue := TagValue(value); tagValue != "" {
+				tags[key] = tagValue
+			}
+			continue
+		}
 		switch v := value.(type) {
 		case bool:
 			extraFields[key] = v
-		case float64:
-			// TODO:
-			//  - if an int64 is given, it could exceed float space and thus be stored wrongly! -> are big numbers needed?
-			if vAsInt := int(v); v == float64(vAsInt) {
-				extraFields[key] = vAsInt
-			} else {
-				extraFields[key] = v
+		case json.Number:
+			// Validate rejects numbers which don't fit, they are never stored approximated
+			if extraFields[key], err = ParseNumber(v); err != nil {
+				return nil, fmt.Errorf("details.%s: %w", key, err)
 			}
+		case float64, int64, uint64:
+			extraFields[key] = v
 		case string:
 			extraFields[key] = v
-		case []interface{}:
-			extraFields[key] = make([]string, len(v))
-			for i := range v {
-				extraFields[key].([]string)[i] = fmt.Sprintf("%v", v[i])
-			}
-		case map[string]interface{}:
-			extraFields[key], err = json.Marshal(v)
+		case []interface{}, map[string]interface{}:
+			// Encoded as JSON, so elements keep their types (e.g. [1,"1",true])
+			encoded, err := json.Marshal(v)
 			if err != nil {
 				return nil, err
 			}
+			extraFields[key] = string(encoded)
 		case nil:
 			log.Printf(`[WARNING] Skipping null field: "%s"`, key)
 		default:
@@ -113,25 +220,259 @@ func (e BasicEvent) ToPoint() (*write.Point, error) {
 	}
 	return influxdb2.NewPoint(
 		e.EntityType,
-		map[string]string{"eventType": e.EventType},
+		tags,
 		extraFields,
 		e.Timestamp,
 	), nil
 }
 
-// Validate checks if all required fields have valid values. Returns a list of errors.
+// TagValue converts a value to the string it is stored as in a tag. Values other than strings are written as JSON
+// (e.g. 5 or true), null values as an empty string (no tag).
+func TagValue(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(encoded)
+}
+
+// FlattenDetails returns the fields details are stored as when flattening is enabled. Values inside nested objects
+// are stored as separate fields named by their path and array elements by their index, e.g. "http.status" and
+// "tags.0", so they keep their types and can be queried. Empty objects and arrays have no fields.
+func FlattenDetails(details map[string]any) map[string]any {
+	fields := make(map[string]any, len(details))
+	for key, value := range details {
+		flattenValue(key, value, fields)
+	}
+	return fields
+}
+
+// flattenValue adds the value, or the values nested inside it, to fields.
+func flattenValue(path string, value any, fields map[string]any) {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, nested := range v {
+			flattenValue(path+DetailsSeparator+key, nested, fields)
+		}
+	case []any:
+		for i, nested := range v {
+			flattenValue(path+DetailsSeparator+strconv.Itoa(i), nested, fields)
+		}
+	default:
+		fields[path] = v
+	}
+}
+
+// NestDetails restores details stored by FlattenDetails. Objects with keys "0" to "n-1" are restored as arrays.
+// Fields conflicting with others (e.g. "http" and "http.status", stored before flattening was enabled) are kept
+// under their stored name.
+func NestDetails(fields map[string]any) map[string]any {
+	details := make(map[string]any, len(fields))
+	// Sorted, so parents always precede their children and conflicts are resolved the same way every time
+	for _, key := range sortedKeys(fields) {
+		if !setPath(details, strings.Split(key, DetailsSeparator), fields[key]) {
+			details[key] = fields[key]
+		}
+	}
+	for key, value := range details {
+		details[key] = restoreArrays(value)
+	}
+	return details
+}
+
+// setPath sets a value nested inside details, creating objects along the path. Returns false when the path is
+// already taken by another value.
+func setPath(details map[string]any, path []string, value any) bool {
+	for _, key := range path[:len(path)-1] {
+		next, ok := details[key]
+		if !ok {
+			nested := make(map[string]any)
+			details[key] = nested
+			details = nested
+			continue
+		}
+		if details, ok = next.(map[string]any); !ok {
+			return false
+		}
+	}
+	key := path[len(path)-1]
+	if _, ok := details[key]; ok {
+		return false
+	}
+	details[key] = value
+	return true
+}
+
+// restoreArrays converts objects created by NestDetails with keys "0" to "n-1" back to arrays.
+func restoreArrays(value any) any {
+	object, ok := value.(map[string]any)
+	if !ok || len(object) == 0 {
+		return value
+	}
+	for key, nested := range object {
+		object[key] = restoreArrays(nested)
+	}
+	if !isArrayLike(object) {
+		return object
+	}
+	array := make([]any, len(object))
+	for i := range array {
+		array[i] = object[strconv.Itoa(i)]
+	}
+	return array
+}
+
+// DetailKeyProblems reports details which can't be stored flattened: empty keys and keys containing DetailsSeparator,
+// since they would be indistinguishable from nested values, nested objects with keys "0" to "n-1" and nulls inside
+// arrays, since they wouldn't be restored as they were posted (see NestDetails).
+func DetailKeyProblems(details map[string]any) []ModelError {
+	problems := make([]ModelError, 0)
+	collectKeyProblems("details", details, false, &problems)
+	return problems
+}
+
+// collectKeyProblems checks keys of the value and the values nested inside it. Nested objects are restored as arrays
+// when their keys are array indexes, so they are reported.
+func collectKeyProblems(path string, value any, nested bool, problems *[]ModelError) {
+	switch v := value.(type) {
+	case map[string]any:
+		if nested && isArrayLike(v) {
+			*problems = append(*problems, ModelError{path, `objects with keys "0" to "n-1" would be returned as arrays`})
+			return
+		}
+		for _, key := range sortedKeys(v) {
+			if key == "" || strings.Contains(key, DetailsSeparator) {
+				*problems = append(*problems, ModelError{path + DetailsSeparator + key, fmt.Sprintf("keys can't be empty or contain %q", DetailsSeparator)})
+				continue
+			}
+			collectKeyProblems(path+DetailsSeparator+key, v[key], true, problems)
+		}
+	case []any:
+		for i, element := range v {
+			if element == nil {
+				*problems = append(*problems, ModelError{path + DetailsSeparator + strconv.Itoa(i), "arrays can't contain null"})
+				continue
+			}
+			collectKeyProblems(path+DetailsSeparator+strconv.Itoa(i), element, true, problems)
+		}
+	}
+}
+
+// isArrayLike checks if the keys of a non-empty object are "0" to "n-1".
+func isArrayLike(object map[string]any) bool {
+	for i := 0; i < len(object); i++ {
+		if _, ok := object[strconv.Itoa(i)]; !ok {
+			return false
+		}
+	}
+	return len(object) > 0
+}
+
+// Validate checks if all required fields have valid values. Returns a list of errors. Timestamps are checked by
+// ApplyTimestampPolicy.
 func (e *BasicEvent) Validate() []ModelError {
 	problems := make([]ModelError, 0)
 	if e.EntityId == "" {
 		problems = append(problems, ModelError{"entityId", ErrFieldRequired.Error()})
 	}
-	if e.Timestamp.IsZero() {
-		// TODO:
-		//  - testing purposes, should be required!
-		e.Timestamp = time.Now()
-	}
 	if e.EventType == "" {
 		problems = append(problems, ModelError{"eventType", ErrFieldRequired.Error()})
 	}
+	if len(e.EventId) > maxEventIdLength || strings.ContainsAny(e.EventId, "/?#") {
+		problems = append(problems, ModelError{EventIdFieldName, fmt.Sprintf("expected at most %d characters without \"/\", \"?\" or \"#\"", maxEventIdLength)})
+	}
+	for _, key := range []string{EventIdFieldName, EntityIdFieldName, ReceivedAtFieldName} {
+		if _, ok := e.EventDetails[key]; ok {
+			problems = append(problems, ModelError{"details." + key, ErrReservedKey.Error()})
+		}
+	}
+	for _, key := range sortedKeys(e.EventDetails) {
+		if number, ok := e.EventDetails[key].(json.Number); ok {
+			if _, err := ParseNumber(number); err != nil {
+				problems = append(problems, ModelError{"details." + key, err.Error()})
+			}
+		}
+	}
 	return problems
 }
+
+// MarshalJSON encodes an event, receivedAt is left out for events stored before it was recorded.
+func (e BasicEvent) MarshalJSON() ([]byte, error) {
+	// plainEvent has no methods, to avoid recursion
+	type plainEvent BasicEvent
+	encoded := struct {
+		plainEvent
+		ReceivedAt *time.Time `json:"receivedAt,omitempty"`
+	}{plainEvent: plainEvent(e)}
+	if !e.ReceivedAt.IsZero() {
+		encoded.ReceivedAt = &e.ReceivedAt
+	}
+	return json.Marshal(encoded)
+}
+
+// UnmarshalJSON decodes an event. Numbers in details are decoded as json.Number, so they can be stored without
+// losing precision (see ParseNumber). Timestamps in any supported format are read in UTC when they have no zone.
+func (e *BasicEvent) UnmarshalJSON(data []byte) error {
+	// plainEvent has no methods, to avoid recursion
+	type plainEvent BasicEvent
+	var decoded struct {
+		plainEvent
+		Timestamp    json.RawMessage `json:"timestamp"`
+		EventDetails json.RawMessage `json:"details"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*e = BasicEvent(decoded.plainEvent)
+	e.EventDetails = nil
+	if len(decoded.Timestamp) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(decoded.Timestamp))
+		decoder.UseNumber()
+		if err := decoder.Decode(&e.rawTimestamp); err != nil {
+			return err
+		}
+		// Parsed with the default policy, ApplyTimestampPolicy reports problems and applies the configured one
+		e.Timestamp, _ = TimestampPolicy{}.parse(e.rawTimestamp, time.Now())
+	}
+	if len(decoded.EventDetails) == 0 {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(decoded.EventDetails))
+	decoder.UseNumber()
+	if err := decoder.Decode(&e.EventDetails); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			typeErr.Struct = "BasicEvent"
+			typeErr.Field = strings.TrimSuffix("details."+typeErr.Field, ".")
+		}
+		return err
+	}
+	return nil
+}
+
+// ParseNumber converts a JSON number to the value it is stored as. Literals without a fraction or exponent are
+// integers: int64, or uint64 when they are too large for int64. Other literals are float64, so the type of a field
+// only depends on how clients write its values.
+func ParseNumber(number json.Number) (any, error) {
+	literal := number.String()
+	if strings.ContainsAny(literal, ".eE") {
+		v, err := strconv.ParseFloat(literal, 64)
+		if err != nil {
+			return nil, ErrNumberOutOfRange
+		}
+		return v, nil
+	}
+	if v, err := strconv.ParseInt(literal, 10, 64); err == nil {
+		return v, nil
+	}
+	if v, err := strconv.ParseUint(literal, 10, 64); err == nil {
+		return v, nil
+	}
+	return nil, ErrNumberOutOfRange
+}
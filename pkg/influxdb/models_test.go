@@ -0,0 +1,48 @@
+package influxdb
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestFlattenDetails makes sure details accepted with flattening are returned as they were posted, and the others
+// are reported by DetailKeyProblems.
+func TestFlattenDetails(t *testing.T) {
+	tests := []struct {
+		details  string
+		problems []string
+	}{
+		{`{"http": {"status": 200, "host": "a"}, "tags": ["x", "y"], "matrix": [[1, 2], [3]]}`, nil},
+		{`{"0": "top-level keys aren't restored", "1": true}`, nil},
+		{`{"list": [{"a": 1}, {"b": [true]}]}`, nil},
+		{`{"tags": ["x", null, "y"]}`, []string{"details.tags.1"}},
+		{`{"http": {"0": "a", "1": "b"}}`, []string{"details.http"}},
+		{`{"list": [{"0": 1}]}`, []string{"details.list.0"}},
+		{`{"http.status": 200, "http": {"": 1}}`, []string{"details.http.", "details.http.status"}},
+	}
+	for _, test := range tests {
+		decoder := json.NewDecoder(strings.NewReader(test.details))
+		decoder.UseNumber()
+		var details map[string]any
+		if err := decoder.Decode(&details); err != nil {
+			t.Fatal(err)
+		}
+		problems := DetailKeyProblems(details)
+		fields := make([]string, len(problems))
+		for i, problem := range problems {
+			fields[i] = problem.Field
+		}
+		if len(fields) != len(test.problems) || (len(fields) > 0 && !reflect.DeepEqual(fields, test.problems)) {
+			t.Errorf("%s: expected problems with %v, got %v", test.details, test.problems, problems)
+			continue
+		}
+		if len(problems) > 0 {
+			continue
+		}
+		if restored := NestDetails(FlattenDetails(details)); !reflect.DeepEqual(restored, details) {
+			t.Errorf("%s: restored as %v", test.details, restored)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package influxdb
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/parseutils"
+)
+
+const (
+	// QueryLimitTag is the JSON attribute for the maximum number of returned events.
+	QueryLimitTag string = "_limit"
+	// QuerySortTag is the JSON attribute for result ordering, e.g. "timestamp" or "severity:desc".
+	QuerySortTag string = "_sort"
+	// QueryCursorTag is the JSON attribute for the cursor of the next page (as returned in a previous response).
+	QueryCursorTag string = "_cursor"
+	// DefaultQueryLimit is the number of returned events when no limit is given.
+	DefaultQueryLimit int = 1000
+	// MaxQueryLimit is the largest accepted limit.
+	MaxQueryLimit int = 10000
+)
+
+// QueryResult is a page of events matching a query.
+type QueryResult struct {
+	// Events contains the events of the current page.
+	Events []BasicEvent `json:"events"`
+	// NextCursor is set when there are more events, pass it as "_cursor" (with the same query) to get the next page.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// Pagination describes which part of the query results is returned and in what order.
+type Pagination struct {
+	// Limit is the maximum number of returned events.
+	Limit int
+	// After is the position of the last event of the previous page, nil for the first page.
+	After *PagePosition
+	// SortField is the JSON attribute name events are ordered by.
+	SortField string
+	// Descending reverses the order.
+	Descending bool
+	// queryHash identifies the query a cursor belongs to.
+	queryHash string
+}
+
+// PagePosition is the position of an event in the query results: its sort field value, timestamp and identifier
+// (events with equal values are ordered by timestamp, then by identifier). Pages continue after a position, so events
+// stored meanwhile don't shift them.
+type PagePosition struct {
+	// Value is the sort field value, nil when the event has none or events are sorted by timestamp.
+	Value any
+	// Timestamp is the timestamp of the event.
+	Timestamp time.Time
+	// EventId is the identifier of the event, empty for events stored before events had identifiers.
+	EventId string
+}
+
+// pageCursor is the (encoded) content of a cursor.
+type pageCursor struct {
+	// Timestamp is the timestamp of the last event in Unix nanoseconds.
+	Timestamp int64 `json:"t"`
+	// Type is the field type of the sort field value of the last event, empty when there is none.
+	Type string `json:"y,omitempty"`
+	// Value is the sort field value of the last event, formatted as text.
+	Value string `json:"v,omitempty"`
+	// EventId is the identifier of the last event.
+	EventId string `json:"i,omitempty"`
+	// Query identifies the query the cursor was issued for.
+	Query string `json:"q"`
+}
+
+// ParsePagination removes the pagination attributes from query params and validates them. Has to be called before
+// other params are removed, since cursors are bound to the query they were issued for. Problems are returned as a QueryError.
+func ParsePagination(params map[string]any) (Pagination, error) {
+	page := Pagination{Limit: DefaultQueryLimit, SortField: TimestampFieldName}
+	problems := make([]ModelError, 0)
+	limit := parseutils.Pop(params, QueryLimitTag)
+	sort := parseutils.Pop(params, QuerySortTag)
+	cursor := parseutils.Pop(params, QueryCursorTag)
+
+	if limit != nil {
+		v, ok := limit.(float64)
+		if !ok || v != math.Trunc(v) || v < 1 || v > float64(MaxQueryLimit) {
+			problems = append(problems, ModelError{QueryLimitTag, fmt.Sprintf("expected a whole number between 1 and %d", MaxQueryLimit)})
+		} else {
+			page.Limit = int(v)
+		}
+	}
+	if sort != nil {
+		field, order, _ := strings.Cut(fmt.Sprint(sort), ":")
+		_, isString := sort.(string)
+		switch {
+		case !isString || field == "" || strings.HasPrefix(field, "$"):
+			problems = append(problems, ModelError{QuerySortTag, `expected a field name with an optional order, e.g. "severity:desc"`})
+		case order != "" && order != "asc" && order != "desc":
+			problems = append(problems, ModelError{QuerySortTag, `order must be "asc" or "desc"`})
+		default:
+			page.SortField = field
+			page.Descending = order == "desc"
+		}
+	}
+	page.queryHash = hashQuery(params, page.SortField, page.Descending)
+	if cursor != nil {
+		decoded, hash, ok := decodeCursor(cursor)
+		if !ok {
+			problems = append(problems, ModelError{QueryCursorTag, "invalid cursor"})
+		} else if hash != page.queryHash {
+			problems = append(problems, ModelError{QueryCursorTag, "cursor belongs to a different query"})
+		} else {
+			page.After = &decoded
+		}
+	}
+	if len(problems) > 0 {
+		return page, &QueryError{problems}
+	}
+	return page, nil
+}
+
+// Result builds a query result from the fetched events. Backends fetch one event more than the limit,
+// to determine if there is a next page.
+func (p Pagination) Result(events []BasicEvent) QueryResult {
+	if len(events) <= p.Limit {
+		return QueryResult{Events: events}
+	}
+	last := events[p.Limit-1]
+	cursor := pageCursor{Timestamp: last.Timestamp.UnixNano(), EventId: last.EventId, Query: p.queryHash}
+	cursor.Type, cursor.Value = cursorValue(p.Position(last).Value)
+	encoded, _ := json.Marshal(cursor)
+	return QueryResult{
+		Events:     events[:p.Limit],
+		NextCursor: base64.RawURLEncoding.EncodeToString(encoded),
+	}
+}
+
+// Position returns the position of the event in results ordered by the sort field.
+func (p Pagination) Position(event BasicEvent) PagePosition {
+	position := PagePosition{Timestamp: event.Timestamp, EventId: event.EventId}
+	if p.SortField == TimestampFieldName {
+		return position
+	}
+	value, _ := FieldValue(event, p.SortField)
+	if number, ok := value.(json.Number); ok {
+		// Compared the way it is stored
+		value, _ = ParseNumber(number)
+	}
+	switch value.(type) {
+	case int64, uint64, float64, string, bool:
+		position.Value = value
+	}
+	return position
+}
+
+// cursorValue formats a sort field value for a cursor.
+func cursorValue(value any) (fieldType, text string) {
+	switch v := value.(type) {
+	case float64:
+		return FieldTypeFloat, strconv.FormatFloat(v, 'g', -1, 64)
+	case string:
+		return FieldTypeString, v
+	case nil:
+		return "", ""
+	}
+	return FieldType(value), fmt.Sprint(value)
+}
+
+// decodeCursor parses a cursor issued by Result. Returns the position it continues after and the query hash.
+func decodeCursor(value any) (PagePosition, string, bool) {
+	var cursor pageCursor
+	str, ok := value.(string)
+	if !ok {
+		return PagePosition{}, "", false
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(str)
+	if err != nil {
+		return PagePosition{}, "", false
+	}
+	if err := json.Unmarshal(decoded, &cursor); err != nil {
+		return PagePosition{}, "", false
+	}
+	position := PagePosition{Timestamp: time.Unix(0, cursor.Timestamp).UTC(), EventId: cursor.EventId}
+	switch cursor.Type {
+	case "":
+	case FieldTypeInteger:
+		position.Value, err = strconv.ParseInt(cursor.Value, 10, 64)
+	case FieldTypeUnsigned:
+		position.Value, err = strconv.ParseUint(cursor.Value, 10, 64)
+	case FieldTypeFloat:
+		position.Value, err = strconv.ParseFloat(cursor.Value, 64)
+	case FieldTypeBoolean:
+		position.Value, err = strconv.ParseBool(cursor.Value)
+	case FieldTypeString:
+		position.Value = cursor.Value
+	default:
+		return PagePosition{}, "", false
+	}
+	return position, cursor.Query, err == nil
+}
+
+// hashQuery identifies a query by its params (without pagination attributes) and ordering.
+func hashQuery(params map[string]any, sortField string, descending bool) string {
+	// Maps are encoded with sorted keys, so equal queries result in equal hashes
+	encoded, _ := json.Marshal(params)
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%t", encoded, sortField, descending)))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,226 @@
+package influxdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fluxCompiler converts filters to Flux predicate expressions and keeps track of required package imports.
+type fluxCompiler struct {
+	// imports contains Flux packages used by the compiled expressions.
+	imports map[string]bool
+	// tags contains promoted query field names, which are compared as strings.
+	tags map[string]bool
+}
+
+// newFluxCompiler returns a compiler without any imports, tags are the promoted query field names.
+func newFluxCompiler(tags map[string]bool) *fluxCompiler {
+	return &fluxCompiler{imports: make(map[string]bool), tags: tags}
+}
+
+// isTag checks if a query field is stored as a tag (or is the measurement).
+func (c *fluxCompiler) isTag(field string) bool {
+	return field == MeasurementFieldName || field == EventTypeFieldName || c.tags[field]
+}
+
+// splitTagConditions separates top-level conditions only comparing tags from the rest. Both are returned as an
+// $and filter, which has no sub-filters when there are no such conditions.
+func (c *fluxCompiler) splitTagConditions(f Filter) (tagFilter, fieldFilter Filter) {
+	tagFilter = Filter{Operator: OpAnd}
+	fieldFilter = Filter{Operator: OpAnd}
+	conditions := []Filter{f}
+	if f.Operator == OpAnd {
+		conditions = f.Filters
+	}
+	for _, condition := range conditions {
+		if c.onlyTags(condition) {
+			tagFilter.Filters = append(tagFilter.Filters, condition)
+		} else {
+			fieldFilter.Filters = append(fieldFilter.Filters, condition)
+		}
+	}
+	return
+}
+
+// onlyTags checks if the filter (and all of its sub-filters) only compares tags.
+func (c *fluxCompiler) onlyTags(f Filter) bool {
+	switch f.Operator {
+	case OpAnd, OpOr:
+		for _, sub := range f.Filters {
+			if !c.onlyTags(sub) {
+				return false
+			}
+		}
+		return len(f.Filters) > 0
+	}
+	return c.isTag(f.Field)
+}
+
+// rangeProblems reports range comparisons of promoted tags. Their values are stored as strings (see TagValue), so
+// numbers would be compared as text, e.g. "10" < "9".
+func (c *fluxCompiler) rangeProblems(f Filter) []ModelError {
+	problems := make([]ModelError, 0)
+	switch f.Operator {
+	case OpAnd, OpOr:
+		for _, sub := range f.Filters {
+			problems = append(problems, c.rangeProblems(sub)...)
+		}
+	case OpGt, OpGte, OpLt, OpLte:
+		// Entity IDs are strings anyway
+		if c.tags[f.Field] && f.Field != EntityIdFieldName {
+			problems = append(problems, ModelError{f.Field + "." + f.Operator, "stored as a tag, values can't be compared by order"})
+		}
+	}
+	return problems
+}
+
+// value returns a Flux literal to compare the field with. Tags are strings, so values are written as they are
+// stored in tags (see TagValue).
+func (c *fluxCompiler) value(field string, value any) string {
+	if c.isTag(field) {
+		return fluxString(TagValue(value))
+	}
+	return fluxValue(value)
+}
+
+// compile returns a Flux predicate expression (for use inside filter(fn: (r) => ...)) for given filter.
+func (c *fluxCompiler) compile(f Filter) string {
+	switch f.Operator {
+	case OpAnd, OpOr:
+		if len(f.Filters) == 0 {
+			return strconv.FormatBool(f.Operator == OpAnd)
+		}
+		joiner := " and "
+		if f.Operator == OpOr {
+			joiner = " or "
+		}
+		parts := make([]string, len(f.Filters))
+		for i, sub := range f.Filters {
+			parts[i] = c.compile(sub)
+		}
+		return "(" + strings.Join(parts, joiner) + ")"
+	case OpIn, OpNin:
+		values := f.Value.([]any)
+		if len(values) == 0 {
+			return strconv.FormatBool(f.Operator == OpNin)
+		}
+		parts := make([]string, len(values))
+		for i, value := range values {
+			parts[i] = fmt.Sprintf("%s == %s", fluxFieldRef(f.Field), c.value(f.Field, value))
+		}
+		expression := "(" + strings.Join(parts, " or ") + ")"
+		if f.Operator == OpNin {
+			return "not " + expression
+		}
+		return expression
+	case OpRegex:
+		c.imports["regexp"] = true
+		return fmt.Sprintf("%s =~ regexp.compile(v: %s)", fluxFieldRef(f.Field), fluxString(f.Value.(string)))
+	case OpExists:
+		if f.Value.(bool) {
+			return "exists " + fluxFieldRef(f.Field)
+		}
+		return "not exists " + fluxFieldRef(f.Field)
+	}
+	return fmt.Sprintf("%s %s %s", fluxFieldRef(f.Field), fluxComparisonOperators[f.Operator], c.value(f.Field, f.Value))
+}
+
+// importStatements returns the Flux import statements for packages used by the compiled expressions.
+func (c *fluxCompiler) importStatements() string {
+	statements := ""
+	for _, pkg := range sortedKeys(c.imports) {
+		statements += fmt.Sprintf("\n\timport %s", fluxString(pkg))
+	}
+	return statements
+}
+
+// fluxComparisonOperators maps query operators to Flux comparison operators.
+var fluxComparisonOperators = map[string]string{
+	OpEq:  "==",
+	OpNe:  "!=",
+	OpGt:  ">",
+	OpGte: ">=",
+	OpLt:  "<",
+	OpLte: "<=",
+}
+
+// fluxFieldRef returns a Flux record property reference for a query field name.
+func fluxFieldRef(field string) string {
+	return fmt.Sprintf("r[%s]", fluxColumn(field))
+}
+
+// fluxColumn returns the quoted InfluxDB column name for a query field name.
+func fluxColumn(field string) string {
+	switch field {
+	case MeasurementFieldName:
+		return fluxString("_measurement")
+	case TimestampFieldName:
+		return fluxString("_time")
+	}
+	return fluxString(field)
+}
+
+// fluxValue returns a Flux literal for a JSON decoded value. Whole numbers are written as integers, since integral
+// detail values are stored as integers. Other values (rejected by ParseFilter) are written as a quoted JSON string.
+func fluxValue(value any) string {
+	switch v := value.(type) {
+	case string:
+		return fluxString(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<63 {
+			return strconv.FormatInt(int64(v), 10)
+		}
+		return fluxValueFloat(v)
+	}
+	encoded, _ := json.Marshal(value)
+	return fluxString(string(encoded))
+}
+
+// fluxValueFloat returns a Flux float literal.
+func fluxValueFloat(v float64) string {
+	literal := strconv.FormatFloat(v, 'f', -1, 64)
+	if !strings.Contains(literal, ".") {
+		literal += ".0"
+	}
+	return literal
+}
+
+// fluxTime returns a Flux time literal.
+func fluxTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// fluxString returns a quoted Flux string literal. Besides quotes and backslashes, string interpolation ("${")
+// has to be escaped.
+func fluxString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; ch {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(ch)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '$':
+			if i+1 < len(s) && s[i+1] == '{' {
+				b.WriteByte('\\')
+			}
+			b.WriteByte(ch)
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
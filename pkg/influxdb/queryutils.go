@@ -1,81 +1,237 @@
 package influxdb
 
 import (
-	"encoding/json"
 	"fmt"
+	"math"
+	"strconv"
 	"time"
 
 	"github.com/rubinda/logtopus/pkg/parseutils"
 )
 
 const (
-	// queryRangeStartTag is the JSON attribute for "start" (of time-series range) for InfluxDB queries.
-	queryRangeStartTag string = "_timeFrom"
-	// queryRangeStopTag is the JSON attribute for "stop" (end of time-series range) for InfluxDB queries.
-	queryRangeStopTag string = "_timeTo"
+	// QueryRangeStartTag is the JSON attribute for "start" (of time-series range) for InfluxDB queries.
+	QueryRangeStartTag string = "_timeFrom"
+	// QueryRangeStopTag is the JSON attribute for "stop" (end of time-series range) for InfluxDB queries.
+	QueryRangeStopTag string = "_timeTo"
+	// QueryTimeFieldTag is the JSON attribute selecting the time the range applies to, timestamp or receivedAt.
+	QueryTimeFieldTag string = "_timeField"
 )
 
-// escapeFieldCondition returns a Flux (InfluxDB query language) compliant condition for given values.
-func escapeFieldCondition(fieldName string, fieldValue any) string {
-	if fieldName == "" {
-		return ""
-	}
-	if fieldName == MeasurementFieldName {
-		return fmt.Sprintf(`r["_measurement"] == %q`, fieldValue)
-	}
-	var encodedValue string
-	switch v := fieldValue.(type) {
-	case int, float64, bool:
-		encodedValue = fmt.Sprintf("%v", v)
-	case string:
-		encodedValue = fmt.Sprintf(`%q`, v)
-	default:
-		foo, _ := json.Marshal(v)
-		encodedValue = string(foo)
+var (
+	// defaultQueryRangeStart represents lowest possible time value (InfluxDB) and is used when nothing provided.
+	defaultQueryRangeStart = time.Unix(0, 0).UTC()
+	// minQueryTime and maxQueryTime limit the time range to what InfluxDB can store (nanoseconds since epoch in int64).
+	minQueryTime = time.Unix(0, math.MinInt64).UTC()
+	maxQueryTime = time.Unix(0, math.MaxInt64).UTC()
+)
+
+// ParseTimeRange removes the range attributes from query params and converts them to absolute times.
+// Accepted are RFC3339 timestamps, Unix timestamps (in seconds) and Flux duration literals relative to now (e.g. "-3h").
+// Problems are returned as a QueryError.
+func ParseTimeRange(params map[string]any, now time.Time) (start, stop time.Time, err error) {
+	problems := make([]ModelError, 0)
+	start, problem := parseRangeTime(parseutils.Pop(params, QueryRangeStartTag), QueryRangeStartTag, defaultQueryRangeStart, now)
+	if problem != nil {
+		problems = append(problems, *problem)
+	}
+	stop, problem = parseRangeTime(parseutils.Pop(params, QueryRangeStopTag), QueryRangeStopTag, now, now)
+	if problem != nil {
+		problems = append(problems, *problem)
+	}
+	if len(problems) == 0 && !start.Before(stop) {
+		problems = append(problems, ModelError{QueryRangeStartTag, fmt.Sprintf("must be before %s", QueryRangeStopTag)})
+	}
+	if len(problems) > 0 {
+		return start, stop, &QueryError{problems}
 	}
-	return fmt.Sprintf("r[%q] == %v", fieldName, encodedValue)
+	return start, stop, nil
 }
 
-// validateTime makes sure given string is a valid time format (RFC3339).
-func validateTime(timeString string, layout string, defaultValue string) (string, error) {
-	// TODO:
-	//  - ugly hack because any -> string conversion, => PopString method?
-	if timeString == "" || timeString == "<nil>" {
+// parseRangeTime converts a (JSON decoded) range value to a point in time. Returns defaultValue when the value is not set.
+func parseRangeTime(value any, field string, defaultValue, now time.Time) (time.Time, *ModelError) {
+	switch v := value.(type) {
+	case nil:
 		return defaultValue, nil
+	case string:
+		if v == "" {
+			return defaultValue, nil
+		}
+		t, err := parseutils.ParseFluxTime(v, now)
+		if err != nil {
+			return t, &ModelError{field, "expected a RFC3339 timestamp, Unix timestamp or duration (e.g. -3h)"}
+		}
+		return checkTimeBounds(t, field)
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<62 {
+			return checkTimeBounds(time.Unix(int64(v), 0), field)
+		}
+	}
+	return now, &ModelError{field, "expected a RFC3339 timestamp, Unix timestamp or duration (e.g. -3h)"}
+}
+
+// ParseTimeField removes the time field attribute from query params and validates it. Returns TimestampFieldName
+// when it is not set. Problems are returned as a QueryError.
+func ParseTimeField(params map[string]any) (string, error) {
+	switch field := parseutils.Pop(params, QueryTimeFieldTag); field {
+	case nil:
+		return TimestampFieldName, nil
+	case TimestampFieldName, ReceivedAtFieldName:
+		return field.(string), nil
+	}
+	return "", &QueryError{[]ModelError{{QueryTimeFieldTag, fmt.Sprintf("expected %q or %q", TimestampFieldName, ReceivedAtFieldName)}}}
+}
+
+// checkTimeBounds makes sure the time can be used in InfluxDB queries.
+func checkTimeBounds(t time.Time, field string) (time.Time, *ModelError) {
+	if t.Before(minQueryTime) || t.After(maxQueryTime) {
+		return t, &ModelError{field, fmt.Sprintf("time must be between %s and %s", fluxTime(minQueryTime), fluxTime(maxQueryTime))}
 	}
-	// TODO:
-	//  - InfluxDB accepts -1m or -5d as range strings.
-	//	  for simplicity, I didn't implement checking every possible combination, but this allows query injection
-	return timeString, nil
+	return t, nil
 }
 
-// queryBuilder provides a way to achieve parametrised queries for InfluxDB OSS.
-func queryBuilder(params map[string]any, bucket string) (query string, err error) {
-	startTime, err := validateTime(fmt.Sprint(parseutils.Pop(params, queryRangeStartTag)), time.RFC3339, defaultQueryRangeStart)
+// queryBuilder provides a way to achieve parametrised queries for InfluxDB OSS. Every user supplied value is either
+// validated and converted (time range, pagination) or written as a quoted Flux literal, so query params can't alter
+// the query. One event more than the page limit is requested, to determine if there is a next page.
+func queryBuilder(params map[string]any, bucket string, tags map[string]bool) (query string, page Pagination, err error) {
+	page, err = ParsePagination(params)
+	if err != nil {
+		return
+	}
+	timeField, err := ParseTimeField(params)
 	if err != nil {
 		return
 	}
-	endTime, err := validateTime(fmt.Sprint(parseutils.Pop(params, queryRangeStopTag)), time.RFC3339, time.Now().Format(time.RFC3339))
+	startTime, endTime, err := ParseTimeRange(params, time.Now())
 	if err != nil {
 		return
 	}
+	query, err = filteredQuery(params, bucket, startTime, endTime, timeField, tags)
+	if err != nil {
+		return
+	}
+	sortColumns := fluxString("_time") + ", " + fluxString(EventIdFieldName)
+	if page.SortField != TimestampFieldName {
+		sortColumns = fluxColumn(page.SortField) + ", " + sortColumns
+	}
+	if page.After != nil {
+		query += fmt.Sprintf(`
+	|> filter(fn: (r) => %s)`, afterPredicate(page, tags))
+	}
+	query += fmt.Sprintf(`
+	|> group()
+	|> sort(columns: [%s], desc: %t)
+	|> limit(n: %d)`, sortColumns, page.Descending, page.Limit+1)
+	return
+}
+
+// afterPredicate returns a Flux predicate matching events after the position of the page in the sort order, i.e.
+// (value, time, eventId) > (value0, time0, eventId0). Rows without a value of the sort field or an event identifier are
+// sorted first, same as null values by sort().
+func afterPredicate(page Pagination, tags map[string]bool) string {
+	timeOp := ">"
+	if page.Descending {
+		timeOp = "<"
+	}
+	idColumn := fluxFieldRef(EventIdFieldName)
+	var afterId string
+	switch {
+	case page.After.EventId == "" && page.Descending:
+		afterId = "false"
+	case page.After.EventId == "":
+		afterId = fmt.Sprintf("exists %s", idColumn)
+	case page.Descending:
+		afterId = fmt.Sprintf("(not exists %s or %s < %s)", idColumn, idColumn, fluxString(page.After.EventId))
+	default:
+		afterId = fmt.Sprintf("(exists %s and %s > %s)", idColumn, idColumn, fluxString(page.After.EventId))
+	}
+	timestamp := fluxTime(page.After.Timestamp)
+	afterTime := fmt.Sprintf("(r._time %s %s or (r._time == %s and %s))", timeOp, timestamp, timestamp, afterId)
+	if page.SortField == TimestampFieldName {
+		return afterTime
+	}
+	column := fluxFieldRef(page.SortField)
+	value := page.After.Value
+	switch {
+	case value == nil && !page.Descending:
+		return fmt.Sprintf("(exists %s or %s)", column, afterTime)
+	case value == nil:
+		return fmt.Sprintf("(not exists %s and %s)", column, afterTime)
+	}
+	literal := cursorLiteral(value)
+	if tags[page.SortField] || page.SortField == EventTypeFieldName || page.SortField == MeasurementFieldName {
+		literal = fluxString(TagValue(value))
+	}
+	after := fmt.Sprintf("%s %s %s", column, timeOp, literal)
+	if v, ok := value.(bool); ok {
+		// Booleans can't be compared by order, false is sorted before true
+		after = "false"
+		if v == page.Descending {
+			after = fmt.Sprintf("%s == %t", column, !v)
+		}
+	}
+	equalAfter := fmt.Sprintf("(%s == %s and %s)", column, literal, afterTime)
+	if page.Descending {
+		return fmt.Sprintf("(not exists %s or %s or %s)", column, after, equalAfter)
+	}
+	return fmt.Sprintf("(exists %s and (%s or %s))", column, after, equalAfter)
+}
+
+// cursorLiteral returns a Flux literal of the same type as a sort field value read from the results.
+func cursorLiteral(value any) string {
+	switch v := value.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case uint64:
+		return fmt.Sprintf("uint(v: %s)", fluxString(strconv.FormatUint(v, 10)))
+	case float64:
+		return fluxValueFloat(v)
+	}
+	return fluxValue(value)
+}
+
+// filteredQuery returns a Flux query reading events with timeField in the time range, which match the conditions in
+// params. Conditions only comparing tags are applied before fields are pivoted to columns, so InfluxDB can use its index.
+func filteredQuery(params map[string]any, bucket string, start, stop time.Time, timeField string, tags map[string]bool) (string, error) {
 	// Ignore timestamp field
 	parseutils.Pop(params, TimestampFieldName)
-	query = fmt.Sprintf(`
-	import "influxdata/influxdb/schema"
-	from(bucket: "%s")
-	|> range(start: %v, stop: %v)
-	|> schema.fieldsAsCols()`, bucket, startTime, endTime)
-
-	if len(params) > 0 {
-		fields := ""
-		for key, value := range params {
-			if fields != "" {
-				fields += " and "
-			}
-			fields += escapeFieldCondition(key, value)
+	filter, err := ParseFilter(params)
+	if err != nil {
+		return "", err
+	}
+	compiler := newFluxCompiler(tags)
+	if problems := compiler.rangeProblems(filter); len(problems) > 0 {
+		return "", &QueryError{problems}
+	}
+	compiler.imports["influxdata/influxdb/schema"] = true
+	tagFilter, fieldFilter := compiler.splitTagConditions(filter)
+	tagPredicate, predicate := "", ""
+	if len(tagFilter.Filters) > 0 {
+		tagPredicate = compiler.compile(tagFilter)
+	}
+	if len(fieldFilter.Filters) > 0 {
+		predicate = compiler.compile(fieldFilter)
+	}
+	if timeField == ReceivedAtFieldName {
+		// Receive times are fields, events with any timestamp have to be read
+		timePredicate := fmt.Sprintf("%s >= %d and %s < %d", fluxFieldRef(ReceivedAtFieldName), start.UnixNano(), fluxFieldRef(ReceivedAtFieldName), stop.UnixNano())
+		if predicate != "" {
+			timePredicate += " and " + predicate
 		}
-		query += fmt.Sprintf(` |> filter(fn: (r) => %s)`, fields)
+		predicate = timePredicate
+		start, stop = minQueryTime, maxQueryTime
 	}
-	return
+	query := compiler.importStatements() + fmt.Sprintf(`
+	from(bucket: %s)
+	|> range(start: %s, stop: %s)`, fluxString(bucket), fluxTime(start), fluxTime(stop))
+	if tagPredicate != "" {
+		query += fmt.Sprintf(`
+	|> filter(fn: (r) => %s)`, tagPredicate)
+	}
+	query += `
+	|> schema.fieldsAsCols()`
+	if predicate != "" {
+		query += fmt.Sprintf(` |> filter(fn: (r) => %s)`, predicate)
+	}
+	return query, nil
 }
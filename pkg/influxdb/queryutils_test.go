@@ -0,0 +1,210 @@
+package influxdb
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// queryStructure matches every query queryBuilder may produce. The filter predicates are checked separately.
+var queryStructure = regexp.MustCompile(`(?s)^
+	import "influxdata/influxdb/schema"(
+	import "regexp")?
+	from\(bucket: "bucket"\)
+	\|> range\(start: [0-9T:.Z-]+, stop: [0-9T:.Z-]+\)(
+	\|> filter\(fn: \(r\) => (.*)\))?
+	\|> schema\.fieldsAsCols\(\)(?: \|> filter\(fn: \(r\) => (.*)\))?
+	\|> group\(\)
+	\|> sort\(columns: \[("(?:[^"\\$]|\\.|\$[^{])*", )?"_time", "eventId"\], desc: (?:true|false)\)
+	\|> limit\(n: [0-9]+\)$`)
+
+// fuzzTags are promoted tags, so conditions are split between the tag and field predicates.
+var fuzzTags = map[string]bool{"entityId": true, "region": true}
+
+// predicateWords are the only identifiers allowed outside of string literals in a filter predicate.
+var predicateWords = map[string]bool{
+	"r": true, "and": true, "or": true, "not": true, "exists": true, "true": true, "false": true,
+	"regexp.compile": true, "v": true,
+}
+
+// FuzzQueryBuilder makes sure no query payload can change the structure of the generated Flux query.
+func FuzzQueryBuilder(f *testing.F) {
+	seeds := []string{
+		`{}`,
+		`{"severity": 4, "entityType": "mediaServer", "_timeFrom": "-3h"}`,
+		`{"_timeFrom": "-1h) |> drop(columns: [\"x\"]) |> range(start: 0"}`,
+		`{"_timeTo": "2023-02-05T19:43:06.159Z", "_timeFrom": 0}`,
+		`{"cause\"]) or (r[\"x": "y"}`,
+		`{"cause": "\") or true or (\""}`,
+		`{"cause": "${r._value}"}`,
+		`{"cause": "\\${x}\\"}`,
+		`{"$or": [{"severity": {"$gte": 4}}, {"cause": {"$regex": "^a\"b)"}}]}`,
+		`{"eventType": {"$in": ["a", "b\")"], "$exists": true}}`,
+		`{"entityId": 5, "region": {"$regex": "^eu"}, "$or": [{"region": "us"}, {"severity": 1}]}`,
+		`{"severity": {"$lt": 1e300, "$gt": -0.5}}`,
+		`{"_sort": "severity\"]) |> drop(columns: [\"x:desc", "_limit": 10}`,
+		`{"_sort": "${x}:asc", "_cursor": "eyJvIjoxMCwicSI6IngifQ"}`,
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, payload string) {
+		var params map[string]any
+		if err := json.Unmarshal([]byte(payload), &params); err != nil {
+			t.Skip()
+		}
+		query, _, err := queryBuilder(params, "bucket", fuzzTags)
+		if err != nil {
+			var queryErr *QueryError
+			if !errors.As(err, &queryErr) {
+				t.Fatalf("expected a QueryError, got %T: %s", err, err)
+			}
+			return
+		}
+		match := queryStructure.FindStringSubmatch(query)
+		if match == nil {
+			t.Fatalf("unexpected query structure:\n%s", query)
+		}
+		for _, predicate := range []string{match[3], match[4]} {
+			if err := checkPredicate(predicate); err != nil {
+				t.Fatalf("%s in predicate:\n%s", err, predicate)
+			}
+		}
+	})
+}
+
+// checkPredicate scans a Flux predicate and makes sure that outside of string literals it only contains allowed
+// identifiers, number literals and operators, and that all brackets are balanced.
+func checkPredicate(predicate string) error {
+	tokens := regexp.MustCompile(`^(?:\s+|==|!=|>=|<=|=~|[<>()\[\]:,]|-?[0-9]+(?:\.[0-9]+)?|[a-z]+(?:\.[a-z]+)?)`)
+	depth := 0
+	for rest := predicate; rest != ""; {
+		if rest[0] == '"' {
+			end := stringLiteralEnd(rest)
+			if end < 0 {
+				return errors.New("unterminated string literal")
+			}
+			rest = rest[end:]
+			continue
+		}
+		token := tokens.FindString(rest)
+		if token == "" {
+			return errors.New("unexpected character " + rest[:1])
+		}
+		rest = rest[len(token):]
+		switch {
+		case token == "(" || token == "[":
+			depth++
+		case token == ")" || token == "]":
+			depth--
+			if depth < 0 {
+				return errors.New("unbalanced brackets")
+			}
+		case token[0] >= 'a' && token[0] <= 'z' && !predicateWords[token]:
+			return errors.New("unexpected identifier " + token)
+		}
+	}
+	if depth != 0 {
+		return errors.New("unbalanced brackets")
+	}
+	return nil
+}
+
+// stringLiteralEnd returns the position after a Flux string literal at the start of s, or -1 if it isn't terminated.
+// String interpolation ("${") is reported as an error, since no user value may contain an expression.
+func stringLiteralEnd(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		case '$':
+			if strings.HasPrefix(s[i:], "${") {
+				return -1
+			}
+		}
+	}
+	return -1
+}
+
+// TestQueryBuilderTagRanges makes sure promoted tags, which are stored as strings, can't be compared by order.
+func TestQueryBuilderTagRanges(t *testing.T) {
+	tests := []struct {
+		payload string
+		problem string
+	}{
+		{`{"region": {"$gt": "eu"}}`, "region.$gt"},
+		{`{"$or": [{"severity": 1}, {"region": {"$lte": 5}}]}`, "region.$lte"},
+		{`{"entityId": {"$gte": "a"}, "severity": {"$lt": 5}}`, ""},
+		{`{"region": {"$in": ["eu", "us"]}}`, ""},
+	}
+	for _, test := range tests {
+		var params map[string]any
+		if err := json.Unmarshal([]byte(test.payload), &params); err != nil {
+			t.Fatal(err)
+		}
+		_, _, err := queryBuilder(params, "bucket", fuzzTags)
+		var queryErr *QueryError
+		switch {
+		case test.problem == "" && err != nil:
+			t.Errorf("%s: unexpected error %s", test.payload, err)
+		case test.problem != "" && !errors.As(err, &queryErr):
+			t.Errorf("%s: expected a QueryError, got %v", test.payload, err)
+		case test.problem != "" && (len(queryErr.Problems) != 1 || queryErr.Problems[0].Field != test.problem):
+			t.Errorf("%s: expected a problem with %s, got %v", test.payload, test.problem, queryErr.Problems)
+		}
+	}
+}
+
+// TestAfterPredicate checks the conditions continuing a page after the position of a cursor.
+func TestAfterPredicate(t *testing.T) {
+	at := time.Date(2023, 2, 5, 19, 43, 6, 159000000, time.UTC)
+	// Events with the same value and timestamp are ordered by their identifier
+	const after = `(r._time > 2023-02-05T19:43:06.159Z or (r._time == 2023-02-05T19:43:06.159Z and (exists r["eventId"] and r["eventId"] > "e5")))`
+	const before = `(r._time < 2023-02-05T19:43:06.159Z or (r._time == 2023-02-05T19:43:06.159Z and (not exists r["eventId"] or r["eventId"] < "e5")))`
+	tests := []struct {
+		page      Pagination
+		predicate string
+	}{
+		{Pagination{SortField: TimestampFieldName, After: &PagePosition{nil, at, "e5"}}, after},
+		{Pagination{SortField: TimestampFieldName, Descending: true, After: &PagePosition{nil, at, "e5"}}, before},
+		{Pagination{SortField: TimestampFieldName, After: &PagePosition{nil, at, ""}}, `(r._time > 2023-02-05T19:43:06.159Z or (r._time == 2023-02-05T19:43:06.159Z and exists r["eventId"]))`},
+		{Pagination{SortField: TimestampFieldName, Descending: true, After: &PagePosition{nil, at, ""}}, `(r._time < 2023-02-05T19:43:06.159Z or (r._time == 2023-02-05T19:43:06.159Z and false))`},
+		{Pagination{SortField: "severity", After: &PagePosition{int64(3), at, "e5"}}, `(exists r["severity"] and (r["severity"] > 3 or (r["severity"] == 3 and ` + after + `)))`},
+		{Pagination{SortField: "load", Descending: true, After: &PagePosition{float64(2), at, "e5"}}, `(not exists r["load"] or r["load"] < 2.0 or (r["load"] == 2.0 and ` + before + `))`},
+		{Pagination{SortField: "severity", After: &PagePosition{nil, at, "e5"}}, `(exists r["severity"] or ` + after + `)`},
+		{Pagination{SortField: "region", After: &PagePosition{"eu", at, "e5"}}, `(exists r["region"] and (r["region"] > "eu" or (r["region"] == "eu" and ` + after + `)))`},
+		{Pagination{SortField: "ok", After: &PagePosition{false, at, "e5"}}, `(exists r["ok"] and (r["ok"] == true or (r["ok"] == false and ` + after + `)))`},
+		{Pagination{SortField: "ok", After: &PagePosition{true, at, "e5"}}, `(exists r["ok"] and (false or (r["ok"] == true and ` + after + `)))`},
+	}
+	for _, test := range tests {
+		if predicate := afterPredicate(test.page, fuzzTags); predicate != test.predicate {
+			t.Errorf("expected\n%s\ngot\n%s", test.predicate, predicate)
+		}
+	}
+}
+
+// TestCursor makes sure cursors continue after the last event of a page.
+func TestCursor(t *testing.T) {
+	at := time.Date(2023, 2, 5, 19, 43, 6, 159000001, time.UTC)
+	for _, value := range []any{json.Number("18446744073709551615"), json.Number("-4"), json.Number("0.1"), "eu", true, nil} {
+		params := map[string]any{QuerySortTag: "value:desc", QueryLimitTag: float64(1)}
+		page, err := ParsePagination(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events := []BasicEvent{{EventId: "01GRHE9N2FQ4ZB1R9D4TW6V8XK", Timestamp: at, EventDetails: map[string]any{"value": value}}, {}}
+		params = map[string]any{QuerySortTag: "value:desc", QueryLimitTag: float64(1), QueryCursorTag: page.Result(events).NextCursor}
+		next, err := ParsePagination(params)
+		if err != nil {
+			t.Fatalf("%v: %s", value, err)
+		}
+		if expected := page.Position(events[0]); next.After == nil || *next.After != expected {
+			t.Errorf("%v: expected position %v, got %v", value, expected, next.After)
+		}
+	}
+}
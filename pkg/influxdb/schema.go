@@ -0,0 +1,178 @@
+package influxdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Types of detail fields, as stored in InfluxDB.
+const (
+	FieldTypeInteger  string = "integer"
+	FieldTypeUnsigned string = "unsigned"
+	FieldTypeFloat    string = "float"
+	FieldTypeString   string = "string"
+	FieldTypeBoolean  string = "boolean"
+)
+
+// ErrUnknownSchemaField is returned when distinct values are requested for an attribute other than
+// entityType, eventType and entityId.
+var ErrUnknownSchemaField = fmt.Errorf("distinct values are only listed for %s, %s and %s", MeasurementFieldName, EventTypeFieldName, EntityIdFieldName)
+
+// DetailField describes a detail field key found in stored events.
+type DetailField struct {
+	// Name is the key of the field in event details.
+	Name string `json:"name"`
+	// Types contains the types of stored values, more than one when events disagree.
+	Types []string `json:"types"`
+}
+
+// FieldType returns the type a detail value is stored as (see BasicEvent.ToPoint and ParseNumber), arrays and
+// objects are stored as strings. Returns an empty string for null values and numbers which can't be stored.
+func FieldType(value any) string {
+	switch v := value.(type) {
+	case bool:
+		return FieldTypeBoolean
+	case json.Number:
+		number, err := ParseNumber(v)
+		if err != nil {
+			return ""
+		}
+		return FieldType(number)
+	case float64:
+		return FieldTypeFloat
+	case int, int64:
+		return FieldTypeInteger
+	case uint64:
+		return FieldTypeUnsigned
+	case nil:
+		return ""
+	}
+	return FieldTypeString
+}
+
+// DetailFieldCollector gathers detail field keys and their types.
+type DetailFieldCollector struct {
+	// types contains the found types by field name.
+	types map[string]map[string]bool
+}
+
+// NewDetailFieldCollector returns an empty collector.
+func NewDetailFieldCollector() *DetailFieldCollector {
+	return &DetailFieldCollector{make(map[string]map[string]bool)}
+}
+
+// Add records a type of the field, empty types (null values) are ignored.
+func (c *DetailFieldCollector) Add(name string, fieldType string) {
+	if fieldType == "" {
+		return
+	}
+	if c.types[name] == nil {
+		c.types[name] = make(map[string]bool)
+	}
+	c.types[name][fieldType] = true
+}
+
+// Result returns the collected fields ordered by name, with types in alphabetical order.
+func (c *DetailFieldCollector) Result() []DetailField {
+	fields := make([]DetailField, 0, len(c.types))
+	for _, name := range sortedKeys(c.types) {
+		fields = append(fields, DetailField{name, sortedKeys(c.types[name])})
+	}
+	return fields
+}
+
+// distinctValuesQuery builds a Flux query listing distinct values of an event attribute in the time range.
+// entityIdTag is set when entity identifiers are promoted to a tag.
+func distinctValuesQuery(field, bucket string, start, stop time.Time, entityIdTag bool) (string, error) {
+	switch {
+	case field == MeasurementFieldName:
+		return fmt.Sprintf(`
+	import "influxdata/influxdb/schema"
+	schema.measurements(bucket: %s, start: %s, stop: %s)`, fluxString(bucket), fluxTime(start), fluxTime(stop)), nil
+	case field == EventTypeFieldName, field == EntityIdFieldName && entityIdTag:
+		return fmt.Sprintf(`
+	import "influxdata/influxdb/schema"
+	schema.tagValues(bucket: %s, tag: %s, start: %s, stop: %s)`, fluxString(bucket), fluxString(field), fluxTime(start), fluxTime(stop)), nil
+	case field == EntityIdFieldName:
+		// Entity identifiers are fields, which schema functions don't list values for
+		return fmt.Sprintf(`
+	from(bucket: %s)
+	|> range(start: %s, stop: %s)
+	|> filter(fn: (r) => r._field == %s)
+	|> keep(columns: ["_value"])
+	|> group()
+	|> distinct()`, fluxString(bucket), fluxTime(start), fluxTime(stop), fluxString(EntityIdFieldName)), nil
+	}
+	return "", ErrUnknownSchemaField
+}
+
+// detailFieldsQuery builds a Flux query returning the last value of each detail field series in the time range,
+// limited to a measurement when entityType is set. Series aren't merged, since values of a field may have different
+// types in different measurements.
+func detailFieldsQuery(bucket, entityType string, start, stop time.Time) string {
+	predicate := fmt.Sprintf("r._field != %s and r._field != %s and r._field != %s", fluxString(EventIdFieldName), fluxString(EntityIdFieldName), fluxString(ReceivedAtFieldName))
+	if entityType != "" {
+		predicate += fmt.Sprintf(" and r._measurement == %s", fluxString(entityType))
+	}
+	return fmt.Sprintf(`
+	from(bucket: %s)
+	|> range(start: %s, stop: %s)
+	|> filter(fn: (r) => %s)
+	|> last()
+	|> keep(columns: ["_field", "_value"])`, fluxString(bucket), fluxTime(start), fluxTime(stop), predicate)
+}
+
+// detailTagsQuery builds a Flux query listing tag keys of events in the time range, limited to a measurement when
+// entityType is set.
+func detailTagsQuery(bucket, entityType string, start, stop time.Time) string {
+	predicate := "(r) => true"
+	if entityType != "" {
+		predicate = fmt.Sprintf("(r) => r._measurement == %s", fluxString(entityType))
+	}
+	return fmt.Sprintf(`
+	import "influxdata/influxdb/schema"
+	schema.tagKeys(bucket: %s, predicate: %s, start: %s, stop: %s)`, fluxString(bucket), predicate, fluxTime(start), fluxTime(stop))
+}
+
+// DistinctValues lists distinct values of entityType, eventType or entityId for events in the time range.
+func (c *Client) DistinctValues(field string, start, stop time.Time) ([]string, error) {
+	queryString, err := distinctValuesQuery(field, c.Bucket, start, stop, c.layout.Tags[EntityIdFieldName])
+	if err != nil {
+		return nil, err
+	}
+	values, err := c.queryStrings(queryString)
+	if err != nil {
+		return nil, err
+	}
+	return sortedKeys(values), nil
+}
+
+// DetailFields lists detail field keys and their types for events in the time range, of all entity types when
+// entityType is empty. Detail keys promoted to tags are listed as strings.
+func (c *Client) DetailFields(entityType string, start, stop time.Time) ([]DetailField, error) {
+	result, err := c.influxClient.QueryAPI(c.Org).Query(context.Background(), detailFieldsQuery(c.Bucket, entityType, start, stop))
+	if err != nil {
+		return nil, err
+	}
+	collector := NewDetailFieldCollector()
+	for result.Next() {
+		collector.Add(result.Record().Field(), FieldType(result.Record().Value()))
+	}
+	if err := result.Err(); err != nil {
+		return nil, err
+	}
+	if len(c.layout.Tags) > 0 {
+		tagKeys, err := c.queryStrings(detailTagsQuery(c.Bucket, entityType, start, stop))
+		if err != nil {
+			return nil, err
+		}
+		for key := range tagKeys {
+			if c.layout.Tags[key] && key != EntityIdFieldName {
+				collector.Add(key, FieldTypeString)
+			}
+		}
+	}
+	return collector.Result(), nil
+}
@@ -0,0 +1,124 @@
+package influxdb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// DefaultMaxTagCardinality is the number of distinct values a promoted tag may have when no limit is configured.
+const DefaultMaxTagCardinality int = 10000
+
+// ErrTagCardinality is returned when storing events would exceed the number of distinct values of a promoted tag.
+var ErrTagCardinality = fmt.Errorf("tag cardinality limit reached")
+
+// tagGuard keeps distinct values of promoted tags, so no tag exceeds the cardinality limit. Every new tag value
+// creates a new series in InfluxDB, which are kept in memory.
+type tagGuard struct {
+	// mu guards values.
+	mu sync.Mutex
+	// values contains the known distinct values of each promoted tag.
+	values map[string]map[string]bool
+	// limit is the maximum number of distinct values of a tag.
+	limit int
+}
+
+// admit records tag values of the points. Returns ErrTagCardinality without recording anything when a promoted tag
+// would exceed the limit.
+func (g *tagGuard) admit(points []*write.Point) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	added := make(map[string]map[string]bool)
+	for _, point := range points {
+		for _, tag := range point.TagList() {
+			known, ok := g.values[tag.Key]
+			if !ok || known[tag.Value] || added[tag.Key][tag.Value] {
+				continue
+			}
+			if len(known)+len(added[tag.Key]) >= g.limit {
+				return fmt.Errorf("%w: %s already has %d distinct values", ErrTagCardinality, tag.Key, g.limit)
+			}
+			if added[tag.Key] == nil {
+				added[tag.Key] = make(map[string]bool)
+			}
+			added[tag.Key][tag.Value] = true
+		}
+	}
+	for key, values := range added {
+		for value := range values {
+			g.values[key][value] = true
+		}
+	}
+	return nil
+}
+
+// parseTagKey converts a configured tag key ("entityId" or "details.<key>") to its query field name.
+func parseTagKey(key string) (string, error) {
+	if key == EntityIdFieldName {
+		return key, nil
+	}
+	if name := strings.TrimPrefix(key, "details."); name != key && name != "" {
+		return name, nil
+	}
+	return "", fmt.Errorf("%q can't be promoted to a tag, expected %s or details.<key>", key, EntityIdFieldName)
+}
+
+// promoteTags stores the configured keys as tags. Keys already stored as fields aren't promoted, since a tag and
+// a field with the same name can't be told apart in queries, neither are tags already at the cardinality limit.
+// Known tag values are loaded for the cardinality limit.
+func (c *Client) promoteTags(keys []string, limit int) error {
+	if limit <= 0 {
+		limit = DefaultMaxTagCardinality
+	}
+	c.layout.Tags = make(map[string]bool)
+	c.tags = &tagGuard{values: make(map[string]map[string]bool), limit: limit}
+	if len(keys) == 0 {
+		return nil
+	}
+	fieldKeys, err := c.queryStrings(fmt.Sprintf(`
+	import "influxdata/influxdb/schema"
+	schema.fieldKeys(bucket: %s, start: %s)`, fluxString(c.Bucket), fluxTime(minQueryTime)))
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		name, err := parseTagKey(key)
+		if err != nil {
+			return err
+		}
+		if fieldKeys[name] {
+			log.Printf("[WARNING] Not promoting %s to a tag, it is already stored as a field\n", key)
+			continue
+		}
+		values, err := c.queryStrings(fmt.Sprintf(`
+	import "influxdata/influxdb/schema"
+	schema.tagValues(bucket: %s, tag: %s, start: %s)`, fluxString(c.Bucket), fluxString(name), fluxTime(minQueryTime)))
+		if err != nil {
+			return err
+		}
+		if len(values) >= limit {
+			log.Printf("[WARNING] Not promoting %s to a tag, it already has %d distinct values\n", key, len(values))
+			continue
+		}
+		c.layout.Tags[name] = true
+		c.tags.values[name] = values
+	}
+	return nil
+}
+
+// queryStrings runs a query and returns the distinct values of its result rows.
+func (c *Client) queryStrings(queryString string) (map[string]bool, error) {
+	result, err := c.influxClient.QueryAPI(c.Org).Query(context.Background(), queryString)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]bool)
+	for result.Next() {
+		values[fmt.Sprint(result.Record().Value())] = true
+	}
+	return values, result.Err()
+}
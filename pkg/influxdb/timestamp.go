@@ -0,0 +1,68 @@
+package influxdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/parseutils"
+)
+
+// errTimestampFormat is a message for timestamps which can't be parsed.
+var errTimestampFormat = fmt.Errorf("expected a RFC3339 timestamp, Unix timestamp (seconds, milliseconds, microseconds or nanoseconds) or a common log format")
+
+// TimestampPolicy configures how event timestamps are read and how far they may be from server time.
+type TimestampPolicy struct {
+	// Required rejects events without a timestamp, otherwise server time is used.
+	Required bool
+	// Location is the time zone of timestamps without one, UTC when nil.
+	Location *time.Location
+	// MaxFuture rejects timestamps further ahead of server time, no limit when zero.
+	MaxFuture time.Duration
+	// MaxPast rejects timestamps further behind server time, no limit when zero.
+	MaxPast time.Duration
+}
+
+// parse converts a decoded timestamp (a string or json.Number) to a point in time.
+func (p TimestampPolicy) parse(value any, now time.Time) (time.Time, error) {
+	location := p.Location
+	if location == nil {
+		location = time.UTC
+	}
+	switch v := value.(type) {
+	case string:
+		return parseutils.ParseTimestamp(v, location, now)
+	case json.Number:
+		return parseutils.ParseUnixTimestamp(v.String())
+	}
+	return time.Time{}, errTimestampFormat
+}
+
+// ApplyTimestampPolicy reads the received timestamp according to the policy and checks its distance to now.
+// Events without a timestamp get now, unless the policy requires one.
+func (e *BasicEvent) ApplyTimestampPolicy(p TimestampPolicy, now time.Time) []ModelError {
+	problems := make([]ModelError, 0)
+	if e.rawTimestamp != nil {
+		t, err := p.parse(e.rawTimestamp, now)
+		if err != nil {
+			return append(problems, ModelError{TimestampFieldName, errTimestampFormat.Error()})
+		}
+		e.Timestamp = t
+	} else if e.Timestamp.IsZero() {
+		if p.Required {
+			return append(problems, ModelError{TimestampFieldName, ErrFieldRequired.Error()})
+		}
+		e.Timestamp = now
+		return problems
+	}
+	if e.Timestamp.Before(minQueryTime) || e.Timestamp.After(maxQueryTime) {
+		return append(problems, ModelError{TimestampFieldName, fmt.Sprintf("time must be between %s and %s", fluxTime(minQueryTime), fluxTime(maxQueryTime))})
+	}
+	if p.MaxFuture > 0 && e.Timestamp.After(now.Add(p.MaxFuture)) {
+		problems = append(problems, ModelError{TimestampFieldName, fmt.Sprintf("more than %s ahead of server time", p.MaxFuture)})
+	}
+	if p.MaxPast > 0 && e.Timestamp.Before(now.Add(-p.MaxPast)) {
+		problems = append(problems, ModelError{TimestampFieldName, fmt.Sprintf("more than %s behind server time", p.MaxPast)})
+	}
+	return problems
+}
@@ -0,0 +1,124 @@
+package memstore
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/eventquery"
+	"github.com/rubinda/logtopus/pkg/influxdb"
+)
+
+// Store keeps events in memory. Intended for development and testing, all data is lost on shutdown.
+type Store struct {
+	// mu guards events.
+	mu sync.RWMutex
+	// events contains every stored event in insertion order.
+	events []influxdb.BasicEvent
+}
+
+// New returns an empty in-memory event store.
+func New() *Store {
+	return &Store{events: make([]influxdb.BasicEvent, 0)}
+}
+
+// StoreEvent saves a copy of the event data.
+func (s *Store) StoreEvent(eventData influxdb.BasicEvent) error {
+	return s.StoreEvents([]influxdb.BasicEvent{eventData})
+}
+
+// StoreEvents saves a copy of each event.
+func (s *Store) StoreEvents(events []influxdb.BasicEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, eventData := range events {
+		details := make(map[string]any, len(eventData.EventDetails))
+		for key, value := range eventData.EventDetails {
+			// Null values are skipped, same as with InfluxDB
+			if value != nil {
+				details[key] = value
+			}
+		}
+		eventData.EventDetails = details
+		s.events = append(s.events, eventData)
+	}
+	return nil
+}
+
+// QueryEvents returns a page of events matching the query. See eventquery.Parse for the semantics.
+func (s *Store) QueryEvents(queryFields map[string]any) (influxdb.QueryResult, error) {
+	query, err := eventquery.Parse(queryFields, time.Now())
+	if err != nil {
+		return influxdb.QueryResult{}, err
+	}
+	events, err := s.matchingEvents(query)
+	if err != nil {
+		return influxdb.QueryResult{}, err
+	}
+	return query.Paginate(events), nil
+}
+
+// AggregateEvents summarizes events matching the query. See eventquery.Query.Aggregate for the semantics.
+func (s *Store) AggregateEvents(queryFields map[string]any) (influxdb.AggregateResult, error) {
+	aggregation, err := influxdb.ParseAggregation(queryFields)
+	if err != nil {
+		return influxdb.AggregateResult{}, err
+	}
+	query, err := eventquery.Parse(queryFields, time.Now())
+	if err != nil {
+		return influxdb.AggregateResult{}, err
+	}
+	events, err := s.matchingEvents(query)
+	if err != nil {
+		return influxdb.AggregateResult{}, err
+	}
+	return query.Aggregate(events, aggregation), nil
+}
+
+// DistinctValues lists distinct values of entityType, eventType or entityId for events in the time range.
+func (s *Store) DistinctValues(field string, start, stop time.Time) ([]string, error) {
+	events, err := s.matchingEvents(eventquery.TimeRange(start, stop))
+	if err != nil {
+		return nil, err
+	}
+	return eventquery.DistinctValues(events, field)
+}
+
+// DetailFields lists detail field keys and their types for events in the time range, of all entity types when
+// entityType is empty.
+func (s *Store) DetailFields(entityType string, start, stop time.Time) ([]influxdb.DetailField, error) {
+	query := eventquery.TimeRange(start, stop)
+	if entityType != "" {
+		query.Filter = influxdb.Filter{Operator: influxdb.OpEq, Field: influxdb.MeasurementFieldName, Value: entityType}
+	}
+	events, err := s.matchingEvents(query)
+	if err != nil {
+		return nil, err
+	}
+	return eventquery.DetailFields(events), nil
+}
+
+// matchingEvents returns copies of all events matching the query.
+func (s *Store) matchingEvents(query eventquery.Query) ([]influxdb.BasicEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	events := make([]influxdb.BasicEvent, 0)
+	for _, event := range s.events {
+		if query.Matches(event) {
+			events = append(events, copyEvent(event))
+		}
+	}
+	return events, nil
+}
+
+// Disconnect is a no-op, there are no resources to release.
+func (s *Store) Disconnect() {}
+
+// copyEvent returns an event with its own copy of details, so callers can't modify stored data.
+func copyEvent(event influxdb.BasicEvent) influxdb.BasicEvent {
+	details := make(map[string]any, len(event.EventDetails))
+	for key, value := range event.EventDetails {
+		details[key] = value
+	}
+	event.EventDetails = details
+	return event
+}
@@ -0,0 +1,75 @@
+package memstore
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/influxdb"
+)
+
+// TestTimeRange only returns events inside the query time range, which includes its start but not its stop.
+func TestTimeRange(t *testing.T) {
+	now := time.Now().UTC()
+	at := time.Date(2023, 2, 5, 19, 43, 6, 0, time.UTC)
+	s := New()
+	events := []influxdb.BasicEvent{
+		{EventId: "10m ago", Timestamp: now.Add(-10 * time.Minute), ReceivedAt: now.Add(-10 * time.Minute)},
+		{EventId: "2h ago", Timestamp: now.Add(-2 * time.Hour), ReceivedAt: now.Add(-5 * time.Minute)},
+		{EventId: "26h ago", Timestamp: now.Add(-26 * time.Hour), ReceivedAt: now.Add(-26 * time.Hour)},
+		{EventId: "40d ago", Timestamp: now.AddDate(0, 0, -40), ReceivedAt: now.AddDate(0, 0, -40)},
+		{EventId: "in 1h", Timestamp: now.Add(time.Hour), ReceivedAt: now.Add(-time.Minute)},
+		{EventId: "at", Timestamp: at},
+		{EventId: "at+1s", Timestamp: at.Add(time.Second)},
+		{EventId: "at+2s", Timestamp: at.Add(2 * time.Second)},
+	}
+	for i := range events {
+		events[i].EntityType, events[i].EntityId, events[i].EventType = "mediaServer", "plex001", "log"
+	}
+	if err := s.StoreEvents(events); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		params map[string]any
+		ids    string
+	}{
+		// The range ends now by default, so events in the future aren't found
+		{map[string]any{}, "[at at+1s at+2s 40d ago 26h ago 2h ago 10m ago]"},
+		{map[string]any{influxdb.QueryRangeStartTag: "-1h30m"}, "[10m ago]"},
+		{map[string]any{influxdb.QueryRangeStartTag: "-3h", influxdb.QueryRangeStopTag: "-1h"}, "[2h ago]"},
+		{map[string]any{influxdb.QueryRangeStartTag: "-1mo"}, "[26h ago 2h ago 10m ago]"},
+		{map[string]any{influxdb.QueryRangeStartTag: "-1h", influxdb.QueryRangeStopTag: "2h"}, "[10m ago in 1h]"},
+		{map[string]any{influxdb.QueryRangeStartTag: "2023-02-05T19:43:06Z", influxdb.QueryRangeStopTag: "2023-02-05T19:43:08Z"}, "[at at+1s]"},
+		{map[string]any{influxdb.QueryRangeStartTag: float64(at.Unix() + 1), influxdb.QueryRangeStopTag: fmt.Sprint(at.Unix() + 3)}, "[at+1s at+2s]"},
+		// The range applies to the receive time, events are still ordered by their timestamp
+		{map[string]any{influxdb.QueryRangeStartTag: "-30m", influxdb.QueryTimeFieldTag: influxdb.ReceivedAtFieldName}, "[2h ago 10m ago in 1h]"},
+	}
+	for _, test := range tests {
+		query := fmt.Sprint(test.params)
+		result, err := s.QueryEvents(test.params)
+		if err != nil {
+			t.Errorf("%s: %s", query, err)
+			continue
+		}
+		ids := make([]string, len(result.Events))
+		for i, e := range result.Events {
+			ids[i] = e.EventId
+		}
+		if fmt.Sprint(ids) != test.ids {
+			t.Errorf("%s: expected %s, got %v", query, test.ids, ids)
+		}
+	}
+
+	for _, params := range []map[string]any{
+		{influxdb.QueryRangeStartTag: "-1x"},
+		{influxdb.QueryRangeStartTag: "-1h", influxdb.QueryRangeStopTag: "-2h"},
+		{influxdb.QueryRangeStopTag: true},
+	} {
+		query := fmt.Sprint(params)
+		var queryErr *influxdb.QueryError
+		if _, err := s.QueryEvents(params); !errors.As(err, &queryErr) {
+			t.Errorf("%s: expected a QueryError, got %v", query, err)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package parseutils
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ErrInvalidDuration is returned when a string is not a valid Flux duration literal.
+var ErrInvalidDuration = fmt.Errorf("invalid duration")
+
+// fluxDurationUnits maps Flux duration units (without calendar units) to their length.
+var fluxDurationUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"µs": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+}
+
+// ParseFluxTime converts a time string as accepted by the Flux range() function to a point in time.
+// Supported are RFC3339 timestamps, Unix timestamps (in seconds) and durations relative to now (e.g. "-3h", "-1mo2d").
+func ParseFluxTime(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return AddFluxDuration(now, value)
+}
+
+// AddFluxDuration adds a Flux duration literal (e.g. "-3h", "1y2mo", "1h30m") to the given time.
+// Calendar units (months and years) are applied with time.AddDate.
+func AddFluxDuration(t time.Time, duration string) (time.Time, error) {
+	sign := 1
+	rest := duration
+	if strings.HasPrefix(rest, "-") {
+		sign = -1
+		rest = rest[1:]
+	}
+	if rest == "" {
+		return t, fmt.Errorf("%w: %q", ErrInvalidDuration, duration)
+	}
+	for rest != "" {
+		digits := strings.IndexFunc(rest, func(r rune) bool { return !unicode.IsDigit(r) })
+		if digits <= 0 {
+			return t, fmt.Errorf("%w: %q", ErrInvalidDuration, duration)
+		}
+		magnitude, err := strconv.Atoi(rest[:digits])
+		if err != nil {
+			return t, fmt.Errorf("%w: %q", ErrInvalidDuration, duration)
+		}
+		rest = rest[digits:]
+		unitEnd := strings.IndexFunc(rest, unicode.IsDigit)
+		if unitEnd < 0 {
+			unitEnd = len(rest)
+		}
+		unit := rest[:unitEnd]
+		rest = rest[unitEnd:]
+		magnitude *= sign
+		switch unit {
+		case "y":
+			t = t.AddDate(magnitude, 0, 0)
+		case "mo":
+			t = t.AddDate(0, magnitude, 0)
+		default:
+			length, ok := fluxDurationUnits[unit]
+			if !ok || int64(magnitude) > math.MaxInt64/int64(length) || int64(magnitude) < math.MinInt64/int64(length) {
+				return t, fmt.Errorf("%w: %q", ErrInvalidDuration, duration)
+			}
+			t = t.Add(time.Duration(magnitude) * length)
+		}
+	}
+	return t, nil
+}
+
+// ParseFluxDuration converts a positive Flux duration literal with fixed length units (e.g. "1h30m", "1w") to a duration.
+// Calendar units (months and years) are not supported, since their length depends on the point in time.
+func ParseFluxDuration(duration string) (time.Duration, error) {
+	if strings.HasPrefix(duration, "-") || strings.Contains(duration, "mo") || strings.Contains(duration, "y") {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidDuration, duration)
+	}
+	epoch := time.Unix(0, 0)
+	t, err := AddFluxDuration(epoch, duration)
+	if err != nil {
+		return 0, err
+	}
+	d := t.Sub(epoch)
+	if d <= 0 || d == math.MaxInt64 {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidDuration, duration)
+	}
+	return d, nil
+}
+
+// ErrInvalidTimestamp is returned when a string is not a timestamp in any of the supported formats.
+var ErrInvalidTimestamp = fmt.Errorf("invalid timestamp")
+
+// zonedTimestampLayouts are accepted timestamp formats containing a time zone. Fractional seconds are optional.
+var zonedTimestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999 Z07:00",
+	"2006-01-02T15:04:05.999999999Z0700",
+	"02/Jan/2006:15:04:05 -0700", // Common Log Format (Apache, Nginx)
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RubyDate,
+	time.UnixDate,
+}
+
+// localTimestampLayouts are accepted timestamp formats without a time zone, they are read in the given location.
+var localTimestampLayouts = []string{
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	time.ANSIC,
+}
+
+// ParseTimestamp converts a timestamp string to a point in time. Supported are Unix timestamps (see
+// ParseUnixTimestamp), RFC3339 and a few common log formats: "2006-01-02 15:04:05", Common Log Format
+// ("02/Jan/2006:15:04:05 -0700"), RFC1123, ctime and syslog ("Jan _2 15:04:05"). Timestamps without a time zone are
+// read in location, syslog timestamps without a year are placed within the year before now.
+func ParseTimestamp(value string, location *time.Location, now time.Time) (time.Time, error) {
+	if t, err := ParseUnixTimestamp(value); err == nil {
+		return t, nil
+	}
+	for _, layout := range zonedTimestampLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	for _, layout := range localTimestampLayouts {
+		if t, err := time.ParseInLocation(layout, value, location); err == nil {
+			return t, nil
+		}
+	}
+	if t, err := time.ParseInLocation(time.Stamp, value, location); err == nil {
+		year := now.In(location).Year()
+		// Allow for clocks running slightly ahead
+		if withYear(t, year).After(now.Add(24 * time.Hour)) {
+			year--
+		}
+		return withYear(t, year), nil
+	}
+	return time.Time{}, fmt.Errorf("%w: %q", ErrInvalidTimestamp, value)
+}
+
+// ParseUnixTimestamp converts a decimal number (optionally with a fraction) to a point in time. The unit is told
+// apart by magnitude: seconds below 1e11 (year 5138), milliseconds below 1e14, microseconds below 1e17 and
+// nanoseconds above.
+func ParseUnixTimestamp(literal string) (time.Time, error) {
+	integer, fraction, _ := strings.Cut(literal, ".")
+	digits := strings.TrimPrefix(integer, "-")
+	if digits == "" || strings.TrimFunc(digits+fraction, unicode.IsDigit) != "" || strings.HasPrefix(fraction, "-") {
+		return time.Time{}, fmt.Errorf("%w: %q", ErrInvalidTimestamp, literal)
+	}
+	value, err := strconv.ParseInt(integer, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: %q", ErrInvalidTimestamp, literal)
+	}
+	unit := time.Nanosecond
+	switch magnitude := len(strings.TrimLeft(digits, "0")); {
+	case magnitude <= 11:
+		unit = time.Second
+	case magnitude <= 14:
+		unit = time.Millisecond
+	case magnitude <= 17:
+		unit = time.Microsecond
+	}
+	// Fraction of a unit in nanoseconds, digits beyond nanosecond precision are dropped
+	fraction = (fraction + "000000000")[:9]
+	fractionNanos, _ := strconv.ParseInt(fraction, 10, 64)
+	if strings.HasPrefix(integer, "-") {
+		fractionNanos = -fractionNanos
+	}
+	perSecond := int64(time.Second / unit)
+	nanos := value%perSecond*int64(unit) + fractionNanos*int64(unit)/int64(time.Second)
+	return time.Unix(value/perSecond, nanos), nil
+}
+
+// withYear returns the time with its year replaced.
+func withYear(t time.Time, year int) time.Time {
+	return time.Date(year, t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+}
@@ -0,0 +1,76 @@
+package parseutils
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestAddFluxDuration adds duration literals with fixed length and calendar units.
+func TestAddFluxDuration(t *testing.T) {
+	now := time.Date(2023, 3, 31, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		duration string
+		expected time.Time
+	}{
+		{"-3h", now.Add(-3 * time.Hour)},
+		{"-1h30m", now.Add(-90 * time.Minute)},
+		{"1h30m", now.Add(90 * time.Minute)},
+		{"2w3d", now.Add(17 * 24 * time.Hour)},
+		{"1s500ms", now.Add(1500 * time.Millisecond)},
+		{"10µs5us", now.Add(15 * time.Microsecond)},
+		// Calendar units are applied with AddDate, so March 31st plus a month is May 1st
+		{"1mo", time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)},
+		{"-1mo", time.Date(2023, 3, 3, 12, 0, 0, 0, time.UTC)},
+		{"1y2mo", time.Date(2024, 5, 31, 12, 0, 0, 0, time.UTC)},
+		{"-1y1d", time.Date(2022, 3, 30, 12, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		if result, err := AddFluxDuration(now, test.duration); err != nil || !result.Equal(test.expected) {
+			t.Errorf("%s: expected %s, got %s (%v)", test.duration, test.expected, result, err)
+		}
+	}
+	for _, duration := range []string{"", "-", "3", "h", "3x", "1M", "1.5h", "1h-30m", "-1h 30m", "9999999999999999999h", "3000000h"} {
+		if _, err := AddFluxDuration(now, duration); !errors.Is(err, ErrInvalidDuration) {
+			t.Errorf("%q: expected %v, got %v", duration, ErrInvalidDuration, err)
+		}
+	}
+}
+
+// TestParseFluxTime accepts RFC3339 timestamps, Unix timestamps and durations relative to now.
+func TestParseFluxTime(t *testing.T) {
+	now := time.Date(2023, 2, 5, 19, 43, 6, 0, time.UTC)
+	tests := []struct {
+		value    string
+		expected time.Time
+	}{
+		{"2023-02-05T19:43:06.159Z", time.Date(2023, 2, 5, 19, 43, 6, 159000000, time.UTC)},
+		{"2023-02-05T20:43:06+01:00", now},
+		{"1675626186", now},
+		{"-1h30m", now.Add(-90 * time.Minute)},
+		{"-1mo", time.Date(2023, 1, 5, 19, 43, 6, 0, time.UTC)},
+		{"1d", now.Add(24 * time.Hour)},
+	}
+	for _, test := range tests {
+		if result, err := ParseFluxTime(test.value, now); err != nil || !result.Equal(test.expected) {
+			t.Errorf("%s: expected %s, got %s (%v)", test.value, test.expected, result, err)
+		}
+	}
+	for _, value := range []string{"", "yesterday", "2023-02-05", "-1x", "1675626186.5"} {
+		if _, err := ParseFluxTime(value, now); !errors.Is(err, ErrInvalidDuration) {
+			t.Errorf("%q: expected %v, got %v", value, ErrInvalidDuration, err)
+		}
+	}
+}
+
+// TestParseFluxDuration only accepts positive durations of fixed length units.
+func TestParseFluxDuration(t *testing.T) {
+	if d, err := ParseFluxDuration("1h30m"); err != nil || d != 90*time.Minute {
+		t.Errorf("1h30m: expected %s, got %s (%v)", 90*time.Minute, d, err)
+	}
+	for _, duration := range []string{"-1h", "1mo", "1y", "0s", "1x"} {
+		if _, err := ParseFluxDuration(duration); !errors.Is(err, ErrInvalidDuration) {
+			t.Errorf("%q: expected %v, got %v", duration, ErrInvalidDuration, err)
+		}
+	}
+}
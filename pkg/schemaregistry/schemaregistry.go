@@ -0,0 +1,280 @@
+package schemaregistry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/influxdb"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// Validation modes of a registered schema.
+const (
+	// ModeEnforce rejects events violating the schema.
+	ModeEnforce string = "enforce"
+	// ModeWarn accepts events violating the schema and logs the violations.
+	ModeWarn string = "warn"
+	// ModeOff keeps the schema registered without validating events.
+	ModeOff string = "off"
+)
+
+var (
+	// ErrNotFound is returned when removing a schema which isn't registered.
+	ErrNotFound = fmt.Errorf("schema not registered")
+	// errExternalReference is returned when a schema references a document other than the standard metaschemas.
+	errExternalReference = fmt.Errorf("external references are not supported")
+)
+
+// schemaURL is the location schemas are compiled at, so relative references can't point to local files.
+const schemaURL string = "mem:///schema.json"
+
+// Registration is a JSON Schema for the details of events of an event type, optionally limited to an entity type.
+type Registration struct {
+	// EventType is the event type the schema applies to.
+	EventType string `json:"eventType"`
+	// EntityType limits the schema to events of an entity type, a schema with an entity type is preferred
+	// over the one without.
+	EntityType string `json:"entityType,omitempty"`
+	// Mode is one of ModeEnforce (default), ModeWarn or ModeOff.
+	Mode string `json:"mode"`
+	// Schema is the JSON Schema event details are validated against.
+	Schema json.RawMessage `json:"schema"`
+	// UpdatedAt is the time the schema was registered.
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// key identifies a registration.
+type key struct {
+	eventType  string
+	entityType string
+}
+
+// entry is a registration with its compiled schema.
+type entry struct {
+	Registration
+	// compiled validates event details.
+	compiled *jsonschema.Schema
+}
+
+// Registry keeps registered schemas and validates event details against them.
+type Registry struct {
+	// mu guards entries and the registry file.
+	mu sync.RWMutex
+	// entries contains registrations by event and entity type.
+	entries map[key]*entry
+	// path is the file registrations are persisted to, empty when they are only kept in memory.
+	path string
+}
+
+// New returns an empty registry which keeps registrations in memory.
+func New() *Registry {
+	return &Registry{entries: make(map[key]*entry)}
+}
+
+// Open returns a registry persisted to the file at given path, registrations stored in the file are loaded.
+func Open(path string) (*Registry, error) {
+	r := &Registry{entries: make(map[key]*entry), path: path}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var registrations []Registration
+	if err := json.Unmarshal(content, &registrations); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, registration := range registrations {
+		compiled, err := compile(registration.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("%s: schema for %q: %w", path, registration.EventType, err)
+		}
+		r.entries[key{registration.EventType, registration.EntityType}] = &entry{registration, compiled}
+	}
+	return r, nil
+}
+
+// Register adds or replaces the schema for an event type (and entity type) and returns the stored registration.
+// Invalid registrations are reported as problems, the error is set when the registry can't be persisted.
+func (r *Registry) Register(registration Registration) (Registration, []influxdb.ModelError, error) {
+	problems := make([]influxdb.ModelError, 0)
+	if registration.EventType == "" {
+		problems = append(problems, influxdb.ModelError{Field: "eventType", Message: influxdb.ErrFieldRequired.Error()})
+	}
+	if registration.Mode == "" {
+		registration.Mode = ModeEnforce
+	}
+	if registration.Mode != ModeEnforce && registration.Mode != ModeWarn && registration.Mode != ModeOff {
+		problems = append(problems, influxdb.ModelError{Field: "mode", Message: fmt.Sprintf("expected %q, %q or %q", ModeEnforce, ModeWarn, ModeOff)})
+	}
+	var compiled *jsonschema.Schema
+	if len(registration.Schema) == 0 {
+		problems = append(problems, influxdb.ModelError{Field: "schema", Message: influxdb.ErrFieldRequired.Error()})
+	} else {
+		var err error
+		if compiled, err = compile(registration.Schema); err != nil {
+			problems = append(problems, influxdb.ModelError{Field: "schema", Message: err.Error()})
+		}
+	}
+	if len(problems) > 0 {
+		return registration, problems, nil
+	}
+	registration.UpdatedAt = time.Now().UTC()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k := key{registration.EventType, registration.EntityType}
+	previous, existed := r.entries[k]
+	r.entries[k] = &entry{registration, compiled}
+	if err := r.save(); err != nil {
+		// Keep memory and file consistent
+		if existed {
+			r.entries[k] = previous
+		} else {
+			delete(r.entries, k)
+		}
+		return registration, nil, err
+	}
+	return registration, nil, nil
+}
+
+// Remove unregisters the schema for an event type (and entity type).
+func (r *Registry) Remove(eventType, entityType string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k := key{eventType, entityType}
+	previous, ok := r.entries[k]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(r.entries, k)
+	if err := r.save(); err != nil {
+		r.entries[k] = previous
+		return err
+	}
+	return nil
+}
+
+// List returns all registrations ordered by event type and entity type.
+func (r *Registry) List() []Registration {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.registrations()
+}
+
+// Validate checks event details against the schema registered for the event. Returns the mode of the applied
+// schema (ModeOff when there is none) and every violation, with fields named by their path (e.g. "details.severity").
+func (r *Registry) Validate(event influxdb.BasicEvent) (string, []influxdb.ModelError) {
+	r.mu.RLock()
+	e, ok := r.entries[key{event.EventType, event.EntityType}]
+	if !ok {
+		e, ok = r.entries[key{event.EventType, ""}]
+	}
+	r.mu.RUnlock()
+	if !ok || e.Mode == ModeOff {
+		return ModeOff, nil
+	}
+	details := map[string]any(event.EventDetails)
+	if details == nil {
+		details = make(map[string]any)
+	}
+	err := e.compiled.Validate(details)
+	var validationErr *jsonschema.ValidationError
+	if !errors.As(err, &validationErr) {
+		return e.Mode, nil
+	}
+	problems := make([]influxdb.ModelError, 0)
+	collectViolations(validationErr, &problems)
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Field < problems[j].Field
+	})
+	return e.Mode, problems
+}
+
+// registrations returns all registrations ordered by event type and entity type. Has to be called with mu held.
+func (r *Registry) registrations() []Registration {
+	registrations := make([]Registration, 0, len(r.entries))
+	for _, e := range r.entries {
+		registrations = append(registrations, e.Registration)
+	}
+	sort.Slice(registrations, func(i, j int) bool {
+		if registrations[i].EventType != registrations[j].EventType {
+			return registrations[i].EventType < registrations[j].EventType
+		}
+		return registrations[i].EntityType < registrations[j].EntityType
+	})
+	return registrations
+}
+
+// save writes all registrations to the registry file (when set). The file is replaced atomically,
+// so a failed write doesn't lose earlier registrations. Has to be called with mu held.
+func (r *Registry) save() error {
+	if r.path == "" {
+		return nil
+	}
+	content, err := json.MarshalIndent(r.registrations(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := r.path + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, r.path)
+}
+
+// compile parses a JSON Schema. Only the standard metaschemas can be referenced, so schemas can't read files or URLs.
+func compile(schema json.RawMessage) (*jsonschema.Schema, error) {
+	compiler := jsonschema.NewCompiler()
+	compiler.LoadURL = func(string) (io.ReadCloser, error) {
+		return nil, errExternalReference
+	}
+	if err := compiler.AddResource(schemaURL, bytes.NewReader(schema)); err != nil {
+		return nil, schemaProblem(err)
+	}
+	compiled, err := compiler.Compile(schemaURL)
+	if err != nil {
+		return nil, schemaProblem(err)
+	}
+	return compiled, nil
+}
+
+// schemaProblem strips the (internal) schema location from compilation errors.
+func schemaProblem(err error) error {
+	var schemaErr *jsonschema.SchemaError
+	if errors.As(err, &schemaErr) && schemaErr.Err != nil {
+		return schemaErr.Err
+	}
+	return err
+}
+
+// collectViolations adds a problem for each leaf of the validation error tree.
+func collectViolations(err *jsonschema.ValidationError, problems *[]influxdb.ModelError) {
+	if len(err.Causes) == 0 {
+		*problems = append(*problems, influxdb.ModelError{Field: detailsPath(err.InstanceLocation), Message: err.Message})
+		return
+	}
+	for _, cause := range err.Causes {
+		collectViolations(cause, problems)
+	}
+}
+
+// detailsPath converts a JSON pointer inside event details to a dotted field path, e.g. "/tags/0" to "details.tags.0".
+func detailsPath(pointer string) string {
+	path := "details"
+	if pointer == "" {
+		return path
+	}
+	for _, token := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		path += "." + token
+	}
+	return path
+}
@@ -0,0 +1,164 @@
+package schemaregistry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rubinda/logtopus/pkg/influxdb"
+)
+
+// loginSchema requires an integer severity between 0 and 5 and a string user.
+const loginSchema string = `{
+	"type": "object",
+	"required": ["severity"],
+	"properties": {
+		"severity": {"type": "integer", "minimum": 0, "maximum": 5},
+		"user": {"$ref": "#/$defs/name"}
+	},
+	"$defs": {"name": {"type": "string"}}
+}`
+
+// register registers the schema and fails the test on problems.
+func register(t *testing.T, r *Registry, eventType, entityType, mode, schema string) {
+	t.Helper()
+	if _, problems, err := r.Register(Registration{EventType: eventType, EntityType: entityType, Mode: mode, Schema: json.RawMessage(schema)}); err != nil || len(problems) > 0 {
+		t.Fatalf("can't register %s: %v %v", eventType, err, problems)
+	}
+}
+
+// TestRegister rejects invalid registrations, and schemas referencing other documents.
+func TestRegister(t *testing.T) {
+	tests := []struct {
+		name         string
+		registration Registration
+		problem      string
+	}{
+		{"valid", Registration{EventType: "login", Schema: json.RawMessage(loginSchema)}, ""},
+		{"metaschema", Registration{EventType: "login", Mode: ModeWarn, Schema: json.RawMessage(`{"$schema": "https://json-schema.org/draft/2020-12/schema", "type": "object"}`)}, ""},
+		{"event type", Registration{Schema: json.RawMessage(`{}`)}, "eventType"},
+		{"mode", Registration{EventType: "login", Mode: "strict", Schema: json.RawMessage(`{}`)}, "mode"},
+		{"missing schema", Registration{EventType: "login"}, "schema"},
+		{"malformed schema", Registration{EventType: "login", Schema: json.RawMessage(`{"type": `)}, "schema"},
+		{"invalid schema", Registration{EventType: "login", Schema: json.RawMessage(`{"type": 5}`)}, "schema"},
+		{"unknown definition", Registration{EventType: "login", Schema: json.RawMessage(`{"$ref": "#/$defs/missing"}`)}, "schema"},
+		{"URL reference", Registration{EventType: "login", Schema: json.RawMessage(`{"$ref": "https://example.com/schema.json"}`)}, "schema"},
+		{"file reference", Registration{EventType: "login", Schema: json.RawMessage(`{"$ref": "file:///etc/passwd"}`)}, "schema"},
+		{"relative reference", Registration{EventType: "login", Schema: json.RawMessage(`{"properties": {"a": {"$ref": "other.json"}}}`)}, "schema"},
+	}
+	for _, test := range tests {
+		r := New()
+		registration, problems, err := r.Register(test.registration)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if test.problem == "" {
+			if len(problems) > 0 || len(r.List()) != 1 || registration.UpdatedAt.IsZero() {
+				t.Errorf("%s: expected the schema to be registered, got %v", test.name, problems)
+			}
+			continue
+		}
+		if len(problems) != 1 || problems[0].Field != test.problem {
+			t.Errorf("%s: expected a problem with %s, got %v", test.name, test.problem, problems)
+		}
+		if len(r.List()) != 0 {
+			t.Errorf("%s: expected the schema not to be registered", test.name)
+		}
+	}
+	if _, err := compile(json.RawMessage(`{"$ref": "https://example.com/schema.json"}`)); !errors.Is(err, errExternalReference) {
+		t.Errorf("expected %v, got %v", errExternalReference, err)
+	}
+}
+
+// TestValidate validates event details against the schema of their event type, preferring the one of their entity
+// type, and reports the mode of the applied schema.
+func TestValidate(t *testing.T) {
+	r := New()
+	register(t, r, "login", "", "", loginSchema)
+	register(t, r, "login", "router", ModeWarn, loginSchema)
+	register(t, r, "logout", "", ModeOff, loginSchema)
+	tests := []struct {
+		eventType  string
+		entityType string
+		details    map[string]any
+		mode       string
+		problems   string
+	}{
+		{"login", "mediaServer", map[string]any{"severity": json.Number("3"), "user": "alice"}, ModeEnforce, "[]"},
+		{"login", "mediaServer", map[string]any{"severity": json.Number("7"), "user": 5}, ModeEnforce, "[details.severity details.user]"},
+		{"login", "mediaServer", map[string]any{"severity": json.Number("1.5")}, ModeEnforce, "[details.severity]"},
+		{"login", "mediaServer", nil, ModeEnforce, "[details]"},
+		{"login", "router", map[string]any{"severity": json.Number("7")}, ModeWarn, "[details.severity]"},
+		{"logout", "mediaServer", map[string]any{"severity": "high"}, ModeOff, "[]"},
+		{"playback", "mediaServer", map[string]any{"severity": "high"}, ModeOff, "[]"},
+	}
+	for _, test := range tests {
+		event := influxdb.BasicEvent{EventType: test.eventType, EntityType: test.entityType, EventDetails: test.details}
+		mode, problems := r.Validate(event)
+		fields := make([]string, len(problems))
+		for i, problem := range problems {
+			fields[i] = problem.Field
+		}
+		if mode != test.mode || fmt.Sprint(fields) != test.problems {
+			t.Errorf("%s/%s %v: expected %s with problems %s, got %s with %v", test.eventType, test.entityType, test.details, test.mode, test.problems, mode, problems)
+		}
+	}
+}
+
+// TestOpen keeps registrations across reopening the registry file, and keeps the registry unchanged when the file
+// can't be written.
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "schemas.json")
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	register(t, r, "login", "", "", loginSchema)
+	register(t, r, "login", "router", ModeWarn, `{"type": "object"}`)
+	register(t, r, "logout", "", ModeOff, `{}`)
+	if err := r.Remove("logout", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Remove("logout", ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected %v, got %v", ErrNotFound, err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the temporary file to be renamed, got %v", err)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := json.Marshal(r.List())
+	if registrations, _ := json.Marshal(reopened.List()); string(registrations) != string(expected) {
+		t.Errorf("expected\n%s\nafter reopening, got\n%s", expected, registrations)
+	}
+	mode, problems := reopened.Validate(influxdb.BasicEvent{EventType: "login", EntityType: "mediaServer"})
+	if mode != ModeEnforce || len(problems) != 1 {
+		t.Errorf("expected the reopened schema to be enforced, got %s with %v", mode, problems)
+	}
+
+	// The temporary file can't be created in a missing directory
+	unwritable, err := Open(filepath.Join(dir, "missing", "schemas.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := unwritable.Register(Registration{EventType: "login", Schema: json.RawMessage(loginSchema)}); err == nil {
+		t.Errorf("expected an error when the registry can't be saved")
+	}
+	if registrations := unwritable.List(); len(registrations) != 0 {
+		t.Errorf("expected no registrations after a failed save, got %v", registrations)
+	}
+
+	if err := os.WriteFile(path, []byte(`[{"eventType": "login", "schema": {"type": 5}}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Errorf("expected an error for an invalid stored schema")
+	}
+}
@@ -0,0 +1,298 @@
+package sessions
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/access"
+	"github.com/rubinda/logtopus/pkg/eventid"
+)
+
+const (
+	// tokenPrefix starts every refresh token, so leaked tokens are easy to recognize (e.g. by secret scanners).
+	tokenPrefix string = "ltr_"
+	// secretSize is the number of random bytes in a refresh token.
+	secretSize int = 32
+	// maxRotatedSecrets is the number of rotated secrets of a session which are recognized when reused.
+	maxRotatedSecrets int = 64
+)
+
+var (
+	// ErrInvalidToken is returned when a refresh token is unknown or expired, or its session has ended.
+	ErrInvalidToken = fmt.Errorf("invalid or expired refresh token")
+	// ErrTokenReused is returned when a refresh token is used after it was rotated. The token might have been stolen,
+	// so the session is ended.
+	ErrTokenReused = fmt.Errorf("refresh token was already used, the session has ended")
+)
+
+// Session is a login of a user, kept alive by rotating refresh tokens.
+type Session struct {
+	// Id identifies the session, access tokens refer to it so they can be revoked with the session.
+	Id string `json:"id"`
+	// Username is the user who logged in.
+	Username string `json:"username"`
+	// Scopes are the scopes requested at login, the scopes of the user when nil.
+	Scopes []string `json:"scopes,omitempty"`
+	// Binding limits tokens of the session to events of some entity types or entities.
+	access.Binding
+	// CreatedAt is the time of the login.
+	CreatedAt time.Time `json:"createdAt"`
+	// ExpiresAt is the time the current refresh token stops being accepted.
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// record is a session as persisted, with the hash of its current refresh token secret.
+type record struct {
+	Session
+	// SecretHash is the hex encoded SHA-256 hash of the current secret. Secrets are random, so a slow hash isn't needed.
+	SecretHash string `json:"secretHash"`
+	// RotatedHashes contains hashes of the latest rotated secrets, oldest first, so their reuse can be recognized.
+	RotatedHashes []string `json:"rotatedHashes,omitempty"`
+}
+
+// match reports whether the secret is the current secret of the session, or one of its rotated secrets.
+func (r *record) match(secret string) (current, rotated bool) {
+	hash := []byte(hashSecret(secret))
+	if subtle.ConstantTimeCompare(hash, []byte(r.SecretHash)) == 1 {
+		return true, false
+	}
+	for _, rotatedHash := range r.RotatedHashes {
+		if subtle.ConstantTimeCompare(hash, []byte(rotatedHash)) == 1 {
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// revocation is a revoked access token or session identifier.
+type revocation struct {
+	// Id is the identifier of the access token (its "jti" claim) or session.
+	Id string `json:"id"`
+	// Until is the time access tokens issued before the revocation have expired, the entry is dropped afterwards.
+	Until time.Time `json:"until"`
+}
+
+// file is the content of the store file.
+type file struct {
+	// Sessions contains active sessions.
+	Sessions []*record `json:"sessions"`
+	// Revoked contains identifiers of revoked access tokens and sessions.
+	Revoked []revocation `json:"revoked"`
+}
+
+// Store keeps sessions and revoked access tokens in memory and persists them to a file.
+type Store struct {
+	// mu guards sessions, revoked and the store file.
+	mu sync.RWMutex
+	// sessions contains sessions by id.
+	sessions map[string]*record
+	// revoked contains the time revocations can be dropped by revoked identifier.
+	revoked map[string]time.Time
+	// path is the file sessions are persisted to.
+	path string
+	// accessTTL is how long access tokens are valid, revocations are kept as long.
+	accessTTL time.Duration
+	// refreshTTL is how long a refresh token is valid, each rotation extends the session.
+	refreshTTL time.Duration
+}
+
+// Open returns a store persisted to the file at given path, sessions and revocations stored in the file are loaded.
+// Access tokens are valid for accessTTL and refresh tokens for refreshTTL.
+func Open(path string, accessTTL, refreshTTL time.Duration) (*Store, error) {
+	s := &Store{sessions: make(map[string]*record), revoked: make(map[string]time.Time), path: path, accessTTL: accessTTL, refreshTTL: refreshTTL}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var stored file
+	if err := json.Unmarshal(content, &stored); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, r := range stored.Sessions {
+		s.sessions[r.Id] = r
+	}
+	for _, revoked := range stored.Revoked {
+		s.revoked[revoked.Id] = revoked.Until
+	}
+	return s, nil
+}
+
+// Start begins a session of the user with the scopes and binding. Returns the session and its first refresh token,
+// which isn't stored and can't be shown again.
+func (s *Store) Start(username string, scopes []string, binding access.Binding, now time.Time) (Session, string, error) {
+	secret, err := newSecret()
+	if err != nil {
+		return Session{}, "", err
+	}
+	r := &record{Session: Session{Id: eventid.New(now), Username: username, Scopes: scopes, Binding: binding, CreatedAt: now.UTC(), ExpiresAt: now.Add(s.refreshTTL).UTC()}, SecretHash: hashSecret(secret)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[r.Id] = r
+	if err := s.save(now); err != nil {
+		// Keep memory and file consistent
+		delete(s.sessions, r.Id)
+		return Session{}, "", err
+	}
+	return r.Session, tokenPrefix + r.Id + "_" + secret, nil
+}
+
+// Refresh rotates the refresh token of a session: the token is exchanged for a new one and isn't accepted again.
+// Returns the session and the new refresh token. Using a rotated token ends the session with ErrTokenReused, any
+// other token is rejected with ErrInvalidToken.
+func (s *Store) Refresh(token string, now time.Time) (Session, string, error) {
+	rotated, err := newSecret()
+	if err != nil {
+		return Session{}, "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, secret, err := s.find(token, now)
+	if err != nil {
+		return Session{}, "", err
+	}
+	current, reused := r.match(secret)
+	if reused {
+		// Either the client or someone else holds the newer token, neither can be trusted anymore
+		s.revoke(r.Id, now)
+		if err := s.save(now); err != nil {
+			return Session{}, "", err
+		}
+		return Session{}, "", ErrTokenReused
+	} else if !current {
+		// Session identifiers are part of access tokens, a guessed secret mustn't end the session
+		return Session{}, "", ErrInvalidToken
+	}
+	previous := *r
+	r.RotatedHashes = append(r.RotatedHashes[:len(r.RotatedHashes):len(r.RotatedHashes)], r.SecretHash)
+	if len(r.RotatedHashes) > maxRotatedSecrets {
+		r.RotatedHashes = r.RotatedHashes[len(r.RotatedHashes)-maxRotatedSecrets:]
+	}
+	r.SecretHash, r.ExpiresAt = hashSecret(rotated), now.Add(s.refreshTTL).UTC()
+	if err := s.save(now); err != nil {
+		*r = previous
+		return Session{}, "", err
+	}
+	return r.Session, tokenPrefix + r.Id + "_" + rotated, nil
+}
+
+// End ends the session of a refresh token (current or rotated), so it can be ended after its access tokens expired.
+func (s *Store) End(token string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, secret, err := s.find(token, now)
+	if err != nil {
+		return err
+	}
+	if current, rotated := r.match(secret); !current && !rotated {
+		return ErrInvalidToken
+	}
+	s.revoke(r.Id, now)
+	return s.save(now)
+}
+
+// find returns the unexpired session of a refresh token and the secret of the token. Has to be called with mu held.
+func (s *Store) find(token string, now time.Time) (*record, string, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(token, tokenPrefix), "_")
+	if !ok || !strings.HasPrefix(token, tokenPrefix) {
+		return nil, "", ErrInvalidToken
+	}
+	r, ok := s.sessions[id]
+	if !ok || !r.ExpiresAt.After(now) {
+		return nil, "", ErrInvalidToken
+	}
+	return r, secret, nil
+}
+
+// Revoke stops accepting access tokens and sessions with the identifiers, sessions among them are ended.
+func (s *Store) Revoke(now time.Time, ids ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		if id != "" {
+			s.revoke(id, now)
+		}
+	}
+	return s.save(now)
+}
+
+// IsRevoked reports whether the access token or session identifier was revoked.
+func (s *Store) IsRevoked(id string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.revoked[id]
+	return ok
+}
+
+// revoke ends the session with the id, if any, and remembers the id as revoked until access tokens issued meanwhile
+// have expired. Has to be called with mu held.
+func (s *Store) revoke(id string, now time.Time) {
+	delete(s.sessions, id)
+	s.revoked[id] = now.Add(s.accessTTL).UTC()
+}
+
+// newSecret returns a hex encoded random refresh token secret.
+func newSecret() (string, error) {
+	secret := make([]byte, secretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// hashSecret returns the hex encoded SHA-256 hash of a refresh token secret.
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// save drops expired sessions and revocations, and writes the rest to the store file. The file is replaced
+// atomically, so a failed write doesn't lose earlier sessions. Has to be called with mu held.
+func (s *Store) save(now time.Time) error {
+	stored := file{Sessions: make([]*record, 0, len(s.sessions)), Revoked: make([]revocation, 0, len(s.revoked))}
+	for id, r := range s.sessions {
+		if !r.ExpiresAt.After(now) {
+			delete(s.sessions, id)
+			continue
+		}
+		stored.Sessions = append(stored.Sessions, r)
+	}
+	for id, until := range s.revoked {
+		if !until.After(now) {
+			delete(s.revoked, id)
+			continue
+		}
+		stored.Revoked = append(stored.Revoked, revocation{id, until})
+	}
+	sort.Slice(stored.Sessions, func(i, j int) bool {
+		return stored.Sessions[i].Id < stored.Sessions[j].Id
+	})
+	sort.Slice(stored.Revoked, func(i, j int) bool {
+		return stored.Revoked[i].Id < stored.Revoked[j].Id
+	})
+	content, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	// Refresh token hashes are only readable by the server user
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
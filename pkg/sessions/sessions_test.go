@@ -0,0 +1,143 @@
+package sessions
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/access"
+)
+
+// openStore returns an empty store in a temporary directory, with access tokens valid for a minute and refresh
+// tokens for an hour.
+func openStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := Open(filepath.Join(t.TempDir(), "sessions.json"), time.Minute, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// TestRefresh rotates refresh tokens and ends the session when a rotated token is reused.
+func TestRefresh(t *testing.T) {
+	s := openStore(t)
+	now := time.Now()
+	binding := access.Binding{EntityTypes: []string{"mediaServer"}}
+	session, first, err := s.Start("alice", []string{access.ScopeQuery}, binding, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(first, tokenPrefix+session.Id+"_") || !session.ExpiresAt.Equal(now.Add(time.Hour).UTC()) {
+		t.Fatalf("unexpected session %+v (%s)", session, first)
+	}
+	refreshed, second, err := s.Refresh(first, now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshed.Id != session.Id || refreshed.Username != "alice" || len(refreshed.EntityTypes) != 1 || second == first {
+		t.Errorf("unexpected refreshed session %+v (%s)", refreshed, second)
+	}
+	if !refreshed.ExpiresAt.Equal(now.Add(time.Minute + time.Hour).UTC()) {
+		t.Errorf("expected the rotation to extend the session, got %s", refreshed.ExpiresAt)
+	}
+	id, _, _ := strings.Cut(strings.TrimPrefix(second, tokenPrefix), "_")
+	for _, token := range []string{"", first[:len(tokenPrefix)], strings.TrimPrefix(second, tokenPrefix), tokenPrefix + id + "_" + strings.Repeat("0", 2*secretSize), tokenPrefix + "unknown_00"} {
+		if _, _, err := s.Refresh(token, now.Add(time.Minute)); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%q: expected %v, got %v", token, ErrInvalidToken, err)
+		}
+	}
+	if s.IsRevoked(session.Id) {
+		t.Fatalf("expected invalid tokens not to end the session")
+	}
+	// The first token was rotated, its reuse ends the session with the second token
+	if _, _, err := s.Refresh(first, now.Add(2*time.Minute)); !errors.Is(err, ErrTokenReused) {
+		t.Errorf("expected %v, got %v", ErrTokenReused, err)
+	}
+	if !s.IsRevoked(session.Id) {
+		t.Errorf("expected the session to be revoked")
+	}
+	if _, _, err := s.Refresh(second, now.Add(2*time.Minute)); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected %v after the session ended, got %v", ErrInvalidToken, err)
+	}
+}
+
+// TestExpiry makes sure expired refresh tokens are rejected and persisted sessions are restored.
+func TestExpiry(t *testing.T) {
+	s := openStore(t)
+	now := time.Now()
+	_, token, err := s.Start("alice", nil, access.Binding{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := Open(s.path, time.Minute, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := reopened.Refresh(token, now.Add(time.Hour)); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expired: expected %v, got %v", ErrInvalidToken, err)
+	}
+	if _, token, err = reopened.Refresh(token, now.Add(time.Hour-time.Second)); err != nil {
+		t.Errorf("expected the session to be restored, got %v", err)
+	}
+	if _, _, err := reopened.Refresh(token, now.Add(time.Hour)); err != nil {
+		t.Errorf("expected the rotated token to be valid, got %v", err)
+	}
+}
+
+// TestEnd ends sessions with current and rotated refresh tokens, and drops revocations once access tokens expired.
+func TestEnd(t *testing.T) {
+	s := openStore(t)
+	now := time.Now()
+	session, first, err := s.Start("alice", nil, access.Binding{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, second, err := s.Refresh(first, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, current, err := s.Start("bob", nil, access.Binding{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _, _ := strings.Cut(strings.TrimPrefix(second, tokenPrefix), "_")
+	if err := s.End(tokenPrefix+id+"_00", now); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("wrong secret: expected %v, got %v", ErrInvalidToken, err)
+	}
+	if err := s.End(first, now); err != nil {
+		t.Errorf("rotated token: expected the session to end, got %v", err)
+	}
+	if err := s.End(current, now); err != nil {
+		t.Errorf("current token: expected the session to end, got %v", err)
+	}
+	if !s.IsRevoked(session.Id) || !s.IsRevoked(other.Id) {
+		t.Errorf("expected both sessions to be revoked")
+	}
+	if _, _, err := s.Refresh(second, now); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected %v after the session ended, got %v", ErrInvalidToken, err)
+	}
+	if err := s.End(second, now); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected %v after the session ended, got %v", ErrInvalidToken, err)
+	}
+
+	// Revocations are kept as long as access tokens are valid
+	if err := s.Revoke(now.Add(time.Second), "token-1", ""); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := Open(s.path, time.Minute, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reopened.IsRevoked("token-1") || !reopened.IsRevoked(session.Id) || reopened.IsRevoked("") {
+		t.Errorf("expected revocations to be restored")
+	}
+	if err := reopened.Revoke(now.Add(time.Minute), "token-2"); err != nil {
+		t.Fatal(err)
+	}
+	if reopened.IsRevoked(session.Id) || !reopened.IsRevoked("token-1") || !reopened.IsRevoked("token-2") {
+		t.Errorf("expected only revocations of expired access tokens to be dropped")
+	}
+}
@@ -0,0 +1,272 @@
+package userstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rubinda/logtopus/pkg/access"
+	"github.com/rubinda/logtopus/pkg/influxdb"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// minPasswordLength is the shortest accepted password in bytes.
+	minPasswordLength int = 8
+	// maxPasswordLength is the longest accepted password in bytes, bcrypt ignores anything beyond.
+	maxPasswordLength int = 72
+)
+
+var (
+	// ErrNotFound is returned when a user doesn't exist.
+	ErrNotFound = fmt.Errorf("user not found")
+	// ErrInvalidCredentials is returned when the username or password is wrong, or the user is disabled.
+	ErrInvalidCredentials = fmt.Errorf("invalid username / password combination")
+	// ErrLastAdmin is returned when disabling or deleting the only enabled admin, nobody could manage users afterwards.
+	ErrLastAdmin = fmt.Errorf("can't remove the last enabled admin")
+)
+
+// DefaultScopes are granted to users created without scopes.
+var DefaultScopes = []string{access.ScopeIngest, access.ScopeQuery}
+
+// usernamePattern limits usernames to characters which are safe in URL paths and logs.
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._@-]{1,64}$`)
+
+// dummyHash is compared against when a user doesn't exist, so response times don't reveal which usernames exist.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("logtopus-dummy-password"), bcrypt.DefaultCost)
+
+// User is an account which can request tokens.
+type User struct {
+	// Username identifies the user when logging in.
+	Username string `json:"username"`
+	// Scopes are the scopes of tokens issued to the user (see the access package).
+	Scopes []string `json:"scopes"`
+	// Disabled users can't log in and their tokens are rejected.
+	Disabled bool `json:"disabled"`
+	// CreatedAt is the time the user was created.
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// record is a user as persisted, with the password hash.
+type record struct {
+	User
+	// PasswordHash is the bcrypt hash of the password.
+	PasswordHash string `json:"passwordHash"`
+	// LegacyAdmin is set in files written before users had scopes, admins are granted every scope.
+	LegacyAdmin bool `json:"admin,omitempty"`
+}
+
+// Store keeps users in memory and persists them to a file.
+type Store struct {
+	// mu guards records and the store file.
+	mu sync.RWMutex
+	// records contains users by username.
+	records map[string]*record
+	// path is the file users are persisted to.
+	path string
+}
+
+// Open returns a store persisted to the file at given path, users stored in the file are loaded.
+func Open(path string) (*Store, error) {
+	s := &Store{records: make(map[string]*record), path: path}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var records []record
+	if err := json.Unmarshal(content, &records); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i := range records {
+		if records[i].Scopes == nil {
+			records[i].Scopes = DefaultScopes
+			if records[i].LegacyAdmin {
+				records[i].Scopes = access.AllScopes
+			}
+			records[i].LegacyAdmin = false
+		}
+		s.records[records[i].Username] = &records[i]
+	}
+	return s, nil
+}
+
+// Create adds a user with the password and scopes (DefaultScopes when empty). Invalid usernames, passwords and scopes
+// are reported as problems, the error is set when the store can't be persisted.
+func (s *Store) Create(username, password string, scopes []string) (User, []influxdb.ModelError, error) {
+	problems := make([]influxdb.ModelError, 0)
+	if !usernamePattern.MatchString(username) {
+		problems = append(problems, influxdb.ModelError{Field: "username", Message: "expected 1 to 64 letters, digits or any of . _ @ -"})
+	}
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		problems = append(problems, influxdb.ModelError{Field: "password", Message: fmt.Sprintf("expected %d to %d bytes", minPasswordLength, maxPasswordLength)})
+	}
+	if len(scopes) == 0 {
+		scopes = DefaultScopes
+	}
+	problems = append(problems, access.ValidateScopes(scopes, access.AllScopes, "scopes")...)
+	if len(problems) > 0 {
+		return User{}, problems, nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.records[username]; ok {
+		return User{}, []influxdb.ModelError{{Field: "username", Message: "user already exists"}}, nil
+	}
+	r := &record{User: User{Username: username, Scopes: scopes, CreatedAt: time.Now().UTC()}, PasswordHash: string(hash)}
+	s.records[username] = r
+	if err := s.save(); err != nil {
+		// Keep memory and file consistent
+		delete(s.records, username)
+		return User{}, nil, err
+	}
+	return r.User, nil, nil
+}
+
+// Authenticate returns the user when the password matches and the user isn't disabled, ErrInvalidCredentials otherwise.
+func (s *Store) Authenticate(username, password string) (User, error) {
+	s.mu.RLock()
+	r, ok := s.records[username]
+	var user User
+	hash := dummyHash
+	if ok {
+		user, hash = r.User, []byte(r.PasswordHash)
+	}
+	s.mu.RUnlock()
+	// Hashing is slow, the lock isn't held meanwhile
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !ok || user.Disabled {
+		return User{}, ErrInvalidCredentials
+	}
+	return user, nil
+}
+
+// Get returns the user with the username, ErrNotFound when there is none.
+func (s *Store) Get(username string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.records[username]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return r.User, nil
+}
+
+// List returns all users ordered by username.
+func (s *Store) List() []User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := make([]User, 0, len(s.records))
+	for _, r := range s.records {
+		users = append(users, r.User)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	return users
+}
+
+// Update disables or enables the user (unless disabled is nil) and replaces its scopes (unless scopes is nil).
+// Returns the updated user, invalid scopes are reported as problems.
+func (s *Store) Update(username string, disabled *bool, scopes []string) (User, []influxdb.ModelError, error) {
+	if scopes != nil {
+		if problems := access.ValidateScopes(scopes, access.AllScopes, "scopes"); len(problems) > 0 {
+			return User{}, problems, nil
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.records[username]
+	if !ok {
+		return User{}, nil, ErrNotFound
+	}
+	updated := r.User
+	if disabled != nil {
+		updated.Disabled = *disabled
+	}
+	if scopes != nil {
+		updated.Scopes = scopes
+	}
+	if s.isLastAdmin(r) && (updated.Disabled || !access.HasScope(updated.Scopes, access.ScopeAdmin)) {
+		return User{}, nil, ErrLastAdmin
+	}
+	previous := r.User
+	r.User = updated
+	if err := s.save(); err != nil {
+		r.User = previous
+		return User{}, nil, err
+	}
+	return r.User, nil, nil
+}
+
+// Delete removes the user.
+func (s *Store) Delete(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.records[username]
+	if !ok {
+		return ErrNotFound
+	}
+	if s.isLastAdmin(r) {
+		return ErrLastAdmin
+	}
+	delete(s.records, username)
+	if err := s.save(); err != nil {
+		s.records[username] = r
+		return err
+	}
+	return nil
+}
+
+// isLastAdmin reports whether the user is the only enabled admin. Has to be called with mu held.
+func (s *Store) isLastAdmin(r *record) bool {
+	if !isAdmin(r) {
+		return false
+	}
+	for _, other := range s.records {
+		if other != r && isAdmin(other) {
+			return false
+		}
+	}
+	return true
+}
+
+// isAdmin reports whether the user is enabled and has the admin scope.
+func isAdmin(r *record) bool {
+	return !r.Disabled && access.HasScope(r.Scopes, access.ScopeAdmin)
+}
+
+// save writes all users to the store file. The file is replaced atomically, so a failed write doesn't lose earlier
+// users. Has to be called with mu held.
+func (s *Store) save() error {
+	records := make([]*record, 0, len(s.records))
+	for _, r := range s.records {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Username < records[j].Username
+	})
+	content, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	// Password hashes are only readable by the server user
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
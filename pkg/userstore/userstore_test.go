@@ -0,0 +1,185 @@
+package userstore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rubinda/logtopus/pkg/access"
+)
+
+// openStore returns an empty store in a temporary directory.
+func openStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := Open(filepath.Join(t.TempDir(), "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// TestCreate checks validation of new users and that passwords are only stored hashed.
+func TestCreate(t *testing.T) {
+	s := openStore(t)
+	tests := []struct {
+		name     string
+		username string
+		password string
+		scopes   []string
+		problems []string
+	}{
+		{"valid", "alice", "password123", nil, nil},
+		{"existing", "alice", "password123", nil, []string{"username"}},
+		{"invalid username", "bob smith", "password123", nil, []string{"username"}},
+		{"short password", "bob", "short", nil, []string{"password"}},
+		{"long password", "bob", strings.Repeat("x", maxPasswordLength+1), nil, []string{"password"}},
+		{"unknown scope", "bob", "password123", []string{"everything"}, []string{"scopes"}},
+		{"everything wrong", "", "", []string{"everything"}, []string{"username", "password", "scopes"}},
+	}
+	for _, test := range tests {
+		_, problems, err := s.Create(test.username, test.password, test.scopes)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if len(problems) != len(test.problems) {
+			t.Errorf("%s: expected problems with %v, got %v", test.name, test.problems, problems)
+			continue
+		}
+		for i, field := range test.problems {
+			if problems[i].Field != field {
+				t.Errorf("%s: expected a problem with %s, got %v", test.name, field, problems[i])
+			}
+		}
+	}
+	user, err := s.Get("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(user.Scopes, ",") != strings.Join(DefaultScopes, ",") || user.Disabled || user.CreatedAt.IsZero() {
+		t.Errorf("unexpected user %+v", user)
+	}
+	content, err := os.ReadFile(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "password123") || !strings.Contains(string(content), `"passwordHash": "$2`) {
+		t.Errorf("expected only a bcrypt hash of the password to be stored, got %s", content)
+	}
+}
+
+// TestAuthenticate checks passwords against their hashes and rejects disabled users.
+func TestAuthenticate(t *testing.T) {
+	s := openStore(t)
+	for _, username := range []string{"alice", "bob"} {
+		if _, _, err := s.Create(username, "password123", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	disabled := true
+	if _, _, err := s.Update("bob", &disabled, nil); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		username string
+		password string
+		err      error
+	}{
+		{"alice", "password123", nil},
+		{"alice", "password124", ErrInvalidCredentials},
+		{"alice", "", ErrInvalidCredentials},
+		{"carol", "password123", ErrInvalidCredentials},
+		{"bob", "password123", ErrInvalidCredentials},
+	}
+	for _, test := range tests {
+		user, err := s.Authenticate(test.username, test.password)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s/%s: expected %v, got %v", test.username, test.password, test.err, err)
+		} else if err == nil && user.Username != test.username {
+			t.Errorf("%s: got user %q", test.username, user.Username)
+		}
+	}
+}
+
+// TestLastAdmin makes sure the only enabled admin can't be disabled, demoted or deleted.
+func TestLastAdmin(t *testing.T) {
+	s := openStore(t)
+	for _, username := range []string{"root", "backup"} {
+		if _, _, err := s.Create(username, "password123", access.AllScopes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	disabled, enabled := true, false
+	steps := []struct {
+		name     string
+		do       func() error
+		expected error
+	}{
+		{"disable an admin", func() error { _, _, err := s.Update("backup", &disabled, nil); return err }, nil},
+		{"disable the last admin", func() error { _, _, err := s.Update("root", &disabled, nil); return err }, ErrLastAdmin},
+		{"demote the last admin", func() error { _, _, err := s.Update("root", nil, DefaultScopes); return err }, ErrLastAdmin},
+		{"delete the last admin", func() error { return s.Delete("root") }, ErrLastAdmin},
+		{"delete a disabled admin", func() error { return s.Delete("backup") }, nil},
+		{"delete a missing user", func() error { return s.Delete("backup") }, ErrNotFound},
+		{"update a missing user", func() error { _, _, err := s.Update("backup", &enabled, nil); return err }, ErrNotFound},
+		{"keep the last admin enabled", func() error { _, _, err := s.Update("root", &enabled, nil); return err }, nil},
+	}
+	for _, step := range steps {
+		if err := step.do(); !errors.Is(err, step.expected) {
+			t.Errorf("%s: expected %v, got %v", step.name, step.expected, err)
+		}
+	}
+	if _, err := s.Get("root"); err != nil {
+		t.Errorf("expected the last admin to remain, got %v", err)
+	}
+}
+
+// TestOpen makes sure users are restored from the store file, including files written before users had scopes.
+func TestOpen(t *testing.T) {
+	s := openStore(t)
+	if _, _, err := s.Create("alice", "password123", []string{access.ScopeIngest}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Create("bob", "password123", access.AllScopes); err != nil {
+		t.Fatal(err)
+	}
+	disabled := true
+	if _, _, err := s.Update("alice", &disabled, nil); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := Open(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := reopened.List()
+	if len(users) != 2 || users[0].Username != "alice" || !users[0].Disabled || users[1].Username != "bob" {
+		t.Fatalf("unexpected users %+v", users)
+	}
+	if _, err := reopened.Authenticate("bob", "password123"); err != nil {
+		t.Errorf("expected the password to be restored, got %v", err)
+	}
+	if strings.Join(users[0].Scopes, ",") != access.ScopeIngest {
+		t.Errorf("expected scopes to be restored, got %v", users[0].Scopes)
+	}
+
+	legacy := filepath.Join(t.TempDir(), "users.json")
+	content := `[{"username": "root", "admin": true, "passwordHash": ""}, {"username": "agent", "passwordHash": ""}]`
+	if err := os.WriteFile(legacy, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err = Open(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users = reopened.List()
+	if len(users) != 2 || !access.HasScope(users[1].Scopes, access.ScopeAdmin) || access.HasScope(users[0].Scopes, access.ScopeAdmin) {
+		t.Errorf("expected only the legacy admin to get the admin scope, got %+v", users)
+	}
+	if err := os.WriteFile(legacy, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(legacy); err == nil {
+		t.Errorf("expected an error for a malformed file")
+	}
+}